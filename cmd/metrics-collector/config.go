@@ -0,0 +1,441 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/stolostron/metrics-collector/pkg/config"
+	"github.com/stolostron/metrics-collector/pkg/forwarder"
+	"github.com/stolostron/metrics-collector/pkg/metricfamily"
+	"github.com/stolostron/metrics-collector/pkg/metricsclient"
+)
+
+// invalidSamplesKept is the number of rejected series listed at /debug/invalid-samples.
+const invalidSamplesKept = 100
+
+// collectorConfig is the configuration derived from the flags and the configuration file.
+// It holds the worker configuration along with the settings the transformer is built from.
+type collectorConfig struct {
+	forwarder.Config
+
+	Labels         map[string]string
+	Renames        map[string]string
+	RelabelConfigs []metricfamily.RelabelConfig
+	ElideLabels    []string
+	StrictMetrics  []string
+	MaxSampleAge   time.Duration
+	MaxFutureSkew  time.Duration
+}
+
+// config derives the worker configuration from the flags and, if set, the configuration file.
+// It is called at startup and on every reload, so the configuration file is re-read each time.
+// A source or destination defined in the file replaces the corresponding flags as a whole.
+func (o *Options) config() (collectorConfig, error) {
+	var file *config.File
+	if len(o.ConfigFile) > 0 {
+		var err error
+		if file, err = config.Load(o.ConfigFile); err != nil {
+			return collectorConfig{}, err
+		}
+	}
+
+	labels, err := parseLabels(o.LabelFlag)
+	if err != nil {
+		return collectorConfig{}, err
+	}
+	renames, err := parseRenames(o.RenameFlag)
+	if err != nil {
+		return collectorConfig{}, err
+	}
+	recordingRules, err := parseRecordingRules(o.RecordingRules)
+	if err != nil {
+		return collectorConfig{}, err
+	}
+
+	fromURL, toUploadURL := o.From, o.ToUpload
+	fromToken, fromTokenFile, fromCAFile := o.FromToken, o.FromTokenFile, o.FromCAFile
+	rules, rulesFile := o.Rules, o.RulesFile
+	interval, limitBytes := o.Interval, o.LimitBytes
+	partialResponses := o.PartialResponses
+	remoteWriteVersion := o.RemoteWriteVersion
+	metadataCycles, disableMetadata := o.MetadataCycles, o.DisableMetadata
+	writeTimeout, minBackoff, maxBackoff := o.RemoteWriteTimeout, o.RemoteWriteMinBackoff, o.RemoteWriteMaxBackoff
+	batchSeries, batchBytes, writeConcurrency := o.RemoteWriteBatchSeries, o.RemoteWriteBatchBytes, o.RemoteWriteConcurrency
+	ruleConcurrency, ruleTimeout := o.RecordingRuleConcurrency, o.RecordingRuleTimeout
+	localRules := o.LocalRecordingRules
+	elideLabels := o.ElideLabels
+	var relabelConfigs []metricfamily.RelabelConfig
+	denyRules := o.DenyRules
+	strictMetrics := o.StrictMetrics
+	maxSampleAge, maxFutureSkew := o.MaxSampleAge, o.MaxFutureSkew
+	cardinality := metricfamily.CardinalityLimits{MaxSeries: o.MaxSeries, MaxSeriesPerMetric: o.MaxSeriesPerMetric}
+	sourceLabel := o.SourceLabel
+	var sources []forwarder.Source
+	var destinations []forwarder.Destination
+	anonymizeLabels, anonymizeSalt, anonymizeSaltFile := o.AnonymizeLabels, o.AnonymizeSalt, o.AnonymizeSaltFile
+
+	if file != nil {
+		if file.Interval > 0 {
+			interval = file.Interval
+		}
+		if file.LimitBytes > 0 {
+			limitBytes = file.LimitBytes
+		}
+		if file.RecordingRuleConcurrency > 0 {
+			ruleConcurrency = file.RecordingRuleConcurrency
+		}
+		if file.RecordingRuleTimeout > 0 {
+			ruleTimeout = file.RecordingRuleTimeout
+		}
+		if file.LocalRecordingRules {
+			localRules = true
+		}
+		if len(file.PartialResponses) > 0 {
+			partialResponses = file.PartialResponses
+		}
+		if len(file.RemoteWriteVersion) > 0 {
+			remoteWriteVersion = file.RemoteWriteVersion
+		}
+		if file.MetadataCycles > 0 {
+			metadataCycles = file.MetadataCycles
+		}
+		if file.DisableMetadata {
+			disableMetadata = true
+		}
+		if file.RemoteWriteTimeout > 0 {
+			writeTimeout = file.RemoteWriteTimeout
+		}
+		if file.RemoteWriteMinBackoff > 0 {
+			minBackoff = file.RemoteWriteMinBackoff
+		}
+		if file.RemoteWriteMaxBackoff > 0 {
+			maxBackoff = file.RemoteWriteMaxBackoff
+		}
+		if file.RemoteWriteBatchSeries > 0 {
+			batchSeries = file.RemoteWriteBatchSeries
+		}
+		if file.RemoteWriteBatchBytes > 0 {
+			batchBytes = file.RemoteWriteBatchBytes
+		}
+		if file.RemoteWriteConcurrency > 0 {
+			writeConcurrency = file.RemoteWriteConcurrency
+		}
+		if len(file.Sources) > 0 {
+			fromURL = ""
+			for _, s := range file.Sources {
+				u, err := parseSourceURL(s.URL)
+				if err != nil {
+					return collectorConfig{}, fmt.Errorf("source %s is not a valid URL: %v", s.URL, err)
+				}
+				var rrs []forwarder.RecordingRule
+				for _, r := range s.RecordingRules {
+					rrs = append(rrs, forwarder.RecordingRule{Name: r.Name, Query: r.Query, Type: r.Type})
+				}
+				sources = append(sources, forwarder.Source{
+					Name:           s.Name,
+					URL:            u,
+					Token:          s.Token,
+					TokenFile:      s.TokenFile,
+					CAFile:         s.CAFile,
+					Rules:          s.Match,
+					RulesFile:      s.MatchFile,
+					RecordingRules: rrs,
+				})
+			}
+		}
+		if len(file.SourceLabel) > 0 {
+			sourceLabel = file.SourceLabel
+		}
+		if len(file.Destinations) > 0 {
+			toUploadURL = ""
+			for _, d := range file.Destinations {
+				u, err := url.Parse(d.URL)
+				if err != nil {
+					return collectorConfig{}, fmt.Errorf("destination %s is not a valid URL: %v", d.URL, err)
+				}
+				dest := forwarder.Destination{
+					Name:               d.Name,
+					URL:                u,
+					CAFile:             d.CAFile,
+					CertFile:           d.CertFile,
+					KeyFile:            d.KeyFile,
+					ServerName:         d.ServerName,
+					InsecureSkipVerify: d.InsecureSkipVerify,
+					Token:              d.Token,
+					TokenFile:          d.TokenFile,
+					Headers:            d.Headers,
+					Match:              d.Match,
+					MaxRetryDuration:   d.MaxRetryDuration,
+					RemoteWriteVersion: metricsclient.RemoteWriteVersion(d.RemoteWriteVersion),
+					RequestTimeout:     d.RequestTimeout,
+					MinBackoff:         d.MinBackoff,
+					MaxBackoff:         d.MaxBackoff,
+				}
+				// Destinations without their own TLS material share the one of the upload client.
+				if len(d.CAFile) == 0 && len(d.CertFile) == 0 && len(d.KeyFile) == 0 {
+					dest.CAFile, dest.CertFile, dest.KeyFile = o.ToCAFile, o.ToCertFile, o.ToKeyFile
+				}
+				destinations = append(destinations, dest)
+			}
+		}
+		if file.Labels != nil {
+			labels = file.Labels
+		}
+		if file.Renames != nil {
+			renames = file.Renames
+		}
+		if c := file.Cardinality; c != nil {
+			cardinality = metricfamily.CardinalityLimits{
+				MaxSeries:          c.MaxSeries,
+				MaxSeriesPerMetric: c.MaxSeriesPerMetric,
+				PerMetric:          c.PerMetric,
+			}
+		}
+		if file.Deny != nil {
+			denyRules = file.Deny
+		}
+		if file.MaxSampleAge > 0 {
+			maxSampleAge = file.MaxSampleAge
+		}
+		if file.MaxFutureSkew > 0 {
+			maxFutureSkew = file.MaxFutureSkew
+		}
+		if file.StrictMetrics != nil {
+			strictMetrics = file.StrictMetrics
+		}
+		relabelConfigs = file.RelabelConfigs
+		if file.ElideLabels != nil {
+			elideLabels = file.ElideLabels
+		}
+		if a := file.Anonymize; a != nil {
+			anonymizeLabels, anonymizeSalt, anonymizeSaltFile = a.Labels, a.Salt, a.SaltFile
+		}
+	}
+
+	if len(fromURL) == 0 && len(sources) == 0 {
+		return collectorConfig{}, fmt.Errorf("you must specify a Prometheus server to federate from (e.g. http://localhost:9090)")
+	}
+	var from *url.URL
+	if len(fromURL) > 0 {
+		from, err = parseSourceURL(fromURL)
+		if err != nil {
+			return collectorConfig{}, fmt.Errorf("--from is not a valid URL: %v", err)
+		}
+	}
+
+	var toUpload *url.URL
+	if len(toUploadURL) > 0 {
+		toUpload, err = url.Parse(toUploadURL)
+		if err != nil {
+			return collectorConfig{}, fmt.Errorf("--to-upload is not a valid URL: %v", err)
+		}
+	}
+	if toUpload == nil && len(destinations) == 0 {
+		return collectorConfig{}, fmt.Errorf("--to-upload must be specified")
+	}
+
+	switch forwarder.PartialResponsePolicy(partialResponses) {
+	case forwarder.PartialResponseFail, forwarder.PartialResponseForward:
+	default:
+		return collectorConfig{}, fmt.Errorf("--partial-responses must be fail or forward, not %q", partialResponses)
+	}
+
+	version, err := metricsclient.ParseRemoteWriteVersion(remoteWriteVersion)
+	if err != nil {
+		return collectorConfig{}, fmt.Errorf("--remote-write-version: %v", err)
+	}
+	if minBackoff > 0 && maxBackoff > 0 && minBackoff > maxBackoff {
+		return collectorConfig{}, fmt.Errorf("--remote-write-min-backoff %s must not exceed --remote-write-max-backoff %s", minBackoff, maxBackoff)
+	}
+
+	var transformer metricfamily.MultiTransformer
+
+	if len(labels) > 0 {
+		transformer.WithFunc(func() metricfamily.Transformer {
+			return metricfamily.NewLabel(labels, nil)
+		})
+	}
+
+	if len(renames) > 0 {
+		transformer.WithFunc(func() metricfamily.Transformer {
+			return metricfamily.RenameMetrics{Names: renames}
+		})
+	}
+
+	if len(relabelConfigs) > 0 {
+		relabel, err := metricfamily.NewRelabel(relabelConfigs)
+		if err != nil {
+			return collectorConfig{}, err
+		}
+		transformer.With(relabel)
+	}
+
+	if len(elideLabels) == 0 {
+		elideLabels = []string{"prometheus", "prometheus_replica"}
+	}
+	transformer.WithFunc(func() metricfamily.Transformer {
+		return metricfamily.NewElide(elideLabels...)
+	})
+
+	// Without a recorder, for instance in tests, the invalid samples are only counted.
+	invalidSamples := o.invalidSamples
+	if maxSampleAge <= 0 {
+		maxSampleAge = 24 * time.Hour
+	}
+	transformer.WithFunc(func() metricfamily.Transformer {
+		// The builder is called for every family, so the bounds follow the current time.
+		now := time.Now()
+		var max time.Time
+		if maxFutureSkew > 0 {
+			max = now.Add(maxFutureSkew)
+		}
+		return metricfamily.NewReportInvalidFederateSamples(now.Add(-maxSampleAge), max, invalidSamples.Report, strictMetrics)
+	})
+	transformer.WithFunc(func() metricfamily.Transformer {
+		// Samples in the future but within the allowed skew are sent with the current time.
+		return metricfamily.ClampFutureTimestamps(time.Now())
+	})
+
+	transformer.With(metricfamily.TransformerFunc(metricfamily.PackMetrics))
+	transformer.With(metricfamily.TransformerFunc(metricfamily.SortMetrics))
+
+	cfg := forwarder.Config{
+		From:          from,
+		ToUpload:      toUpload,
+		FromToken:     fromToken,
+		FromTokenFile: fromTokenFile,
+		FromCAFile:    fromCAFile,
+
+		ToCAFile:             o.ToCAFile,
+		ToCertFile:           o.ToCertFile,
+		ToKeyFile:            o.ToKeyFile,
+		ToServerName:         o.ToServerName,
+		ToInsecureSkipVerify: o.ToInsecureSkipVerify,
+		ToToken:              o.ToToken,
+		ToTokenFile:          o.ToTokenFile,
+
+		AnonymizeLabels:   anonymizeLabels,
+		AnonymizeSalt:     anonymizeSalt,
+		AnonymizeSaltFile: anonymizeSaltFile,
+		Debug:             o.Verbose,
+		Interval:          interval,
+		LimitBytes:        limitBytes,
+		PartialResponses:  forwarder.PartialResponsePolicy(partialResponses),
+		Rules:             rules,
+		RecordingRules:    recordingRules,
+		RulesFile:         rulesFile,
+		DenyRules:         denyRules,
+		CardinalityLimits: cardinality,
+		Transformer:       transformer,
+
+		RecordingRuleConcurrency: ruleConcurrency,
+		RecordingRuleTimeout:     ruleTimeout,
+		LocalRecordingRules:      localRules,
+
+		Sources:     sources,
+		SourceLabel: sourceLabel,
+
+		Destinations:       destinations,
+		RemoteWriteVersion: version,
+		MetadataCycles:     metadataCycles,
+		DisableMetadata:    disableMetadata,
+
+		RemoteWriteTimeout:    writeTimeout,
+		RemoteWriteMinBackoff: minBackoff,
+		RemoteWriteMaxBackoff: maxBackoff,
+
+		RemoteWriteBatchSeries: batchSeries,
+		RemoteWriteBatchBytes:  batchBytes,
+		RemoteWriteConcurrency: writeConcurrency,
+
+		WALDir:      o.WALDir,
+		WALMaxBytes: o.WALMaxBytes,
+		WALMaxAge:   o.WALMaxAge,
+
+		Logger:                  o.Logger,
+		SimulatedTimeseriesFile: o.SimulatedTimeseriesFile,
+	}
+	return collectorConfig{
+		Config:         cfg,
+		Labels:         labels,
+		Renames:        renames,
+		RelabelConfigs: relabelConfigs,
+		ElideLabels:    elideLabels,
+		StrictMetrics:  strictMetrics,
+		MaxSampleAge:   maxSampleAge,
+		MaxFutureSkew:  maxFutureSkew,
+	}, nil
+}
+
+// parseSourceURL parses the URL of a Prometheus server, defaulting to its federation endpoint.
+func parseSourceURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	if len(u.Path) == 0 {
+		u.Path = "/federate"
+	}
+	return u, nil
+}
+
+func parseLabels(flags []string) (map[string]string, error) {
+	var labels map[string]string
+	for _, flag := range flags {
+		values := strings.SplitN(flag, "=", 2)
+		if len(values) != 2 {
+			return nil, fmt.Errorf("--label must be of the form key=value: %s", flag)
+		}
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels[values[0]] = values[1]
+	}
+	return labels, nil
+}
+
+func parseRenames(flags []string) (map[string]string, error) {
+	var renames map[string]string
+	for _, flag := range flags {
+		if len(flag) == 0 {
+			continue
+		}
+		values := strings.SplitN(flag, "=", 2)
+		if len(values) != 2 {
+			return nil, fmt.Errorf("--rename must be of the form OLD_NAME=NEW_NAME: %s", flag)
+		}
+		if renames == nil {
+			renames = make(map[string]string)
+		}
+		renames[values[0]] = values[1]
+	}
+	return renames, nil
+}
+
+func parseRecordingRules(flags []string) ([]forwarder.RecordingRule, error) {
+	var rules []forwarder.RecordingRule
+	for _, flag := range flags {
+		flag = strings.TrimSpace(flag)
+		if len(flag) == 0 {
+			continue
+		}
+		var rule forwarder.RecordingRule
+		if err := json.Unmarshal([]byte(flag), &rule); err != nil {
+			return nil, fmt.Errorf("--recordingrule must be a JSON object with name and query fields: %v", err)
+		}
+		if len(rule.Name) == 0 || len(rule.Query) == 0 {
+			return nil, fmt.Errorf("--recordingrule must have a name and a query: %s", flag)
+		}
+		if _, err := rule.MetricType(); err != nil {
+			return nil, fmt.Errorf("--recordingrule has an invalid type: %v", err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
@@ -8,14 +8,13 @@ import (
 	stdlog "log"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
 	"time"
 
 	"github.com/oklog/run"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/expfmt"
 	"github.com/spf13/cobra"
 
@@ -25,15 +24,42 @@ import (
 	"github.com/stolostron/metrics-collector/pkg/forwarder"
 	collectorhttp "github.com/stolostron/metrics-collector/pkg/http"
 	"github.com/stolostron/metrics-collector/pkg/logger"
-	"github.com/stolostron/metrics-collector/pkg/metricfamily"
+	"github.com/stolostron/metrics-collector/pkg/metricsclient"
 )
 
 func main() {
 	opt := &Options{
-		Listen:     "localhost:9002",
-		LimitBytes: 200 * 1024,
-		Rules:      []string{`{__name__="up"}`},
-		Interval:   4*time.Minute + 30*time.Second,
+		Listen:             "localhost:9002",
+		LimitBytes:         200 * 1024,
+		PartialResponses:   string(forwarder.PartialResponseFail),
+		RemoteWriteVersion: string(metricsclient.RemoteWriteV1),
+		Rules:              []string{`{__name__="up"}`},
+		Interval:           4*time.Minute + 30*time.Second,
+
+		LivenessIntervals: 3,
+
+		RecordingRuleConcurrency: 4,
+		RecordingRuleTimeout:     30 * time.Second,
+
+		MetadataCycles: 10,
+
+		RemoteWriteTimeout:    30 * time.Second,
+		RemoteWriteMinBackoff: 500 * time.Millisecond,
+		RemoteWriteMaxBackoff: time.Minute,
+
+		RemoteWriteBatchSeries: 10000,
+		RemoteWriteConcurrency: metricsclient.DefaultWriteConcurrency,
+
+		ToCAFile:   metricsclient.DefaultTLSOptions.CAFile,
+		ToCertFile: metricsclient.DefaultTLSOptions.CertFile,
+		ToKeyFile:  metricsclient.DefaultTLSOptions.KeyFile,
+
+		MaxSampleAge: 24 * time.Hour,
+
+		WALMaxBytes: 256 * 1024 * 1024,
+		WALMaxAge:   24 * time.Hour,
+
+		invalidSamples: forwarder.NewInvalidSamples(invalidSamplesKept),
 	}
 	cmd := &cobra.Command{
 		Short:         "Federate Prometheus via push",
@@ -49,14 +75,47 @@ func main() {
 	cmd.Flags().StringVar(&opt.FromToken, "from-token", opt.FromToken, "A bearer token to use when authenticating to the source Prometheus server.")
 	cmd.Flags().StringVar(&opt.FromCAFile, "from-ca-file", opt.FromCAFile, "A file containing the CA certificate to use to verify the --from URL in addition to the system roots certificates.")
 	cmd.Flags().StringVar(&opt.FromTokenFile, "from-token-file", opt.FromTokenFile, "A file containing a bearer token to use when authenticating to the source Prometheus server.")
+	cmd.Flags().StringVar(&opt.SourceLabel, "source-label", opt.SourceLabel, "The name of a label set to the name of the source Prometheus server on every federated series. No label is added if empty.")
 	cmd.Flags().StringVar(&opt.ToUpload, "to-upload", opt.ToUpload, "A server endpoint to push metrics to.")
 	cmd.Flags().DurationVar(&opt.Interval, "interval", opt.Interval, "The interval between scrapes. Prometheus returns the last 5 minutes of metrics when invoking the federation endpoint.")
+	cmd.Flags().IntVar(&opt.LivenessIntervals, "liveness-intervals", opt.LivenessIntervals, "The number of intervals without a completed federation after which /healthz fails. Disabled if 0.")
+	cmd.Flags().StringVar(&opt.ToCAFile, "to-ca-file", opt.ToCAFile, "A file containing the CA certificate to use to verify the --to-upload URL. The system roots certificates are used if empty.")
+	cmd.Flags().StringVar(&opt.ToCertFile, "to-cert-file", opt.ToCertFile, "A file containing the client certificate to authenticate to the --to-upload URL with mutual TLS. Mutual TLS is disabled if empty.")
+	cmd.Flags().StringVar(&opt.ToKeyFile, "to-key-file", opt.ToKeyFile, "A file containing the private key of the --to-cert-file client certificate.")
+	cmd.Flags().StringVar(&opt.ToServerName, "to-server-name", opt.ToServerName, "Override the server name used to verify the certificate of the --to-upload URL.")
+	cmd.Flags().BoolVar(&opt.ToInsecureSkipVerify, "to-insecure-skip-verify", opt.ToInsecureSkipVerify, "Skip the verification of the certificate of the --to-upload URL. Only use for testing.")
+	cmd.Flags().StringVar(&opt.ToToken, "to-token", opt.ToToken, "A bearer token to use when authenticating to the --to-upload URL.")
+	cmd.Flags().StringVar(&opt.ToTokenFile, "to-token-file", opt.ToTokenFile, "A file containing a bearer token to use when authenticating to the --to-upload URL.")
 	cmd.Flags().Int64Var(&opt.LimitBytes, "limit-bytes", opt.LimitBytes, "The maxiumum acceptable size of a response returned when scraping Prometheus.")
+	cmd.Flags().StringVar(&opt.RemoteWriteVersion, "remote-write-version", opt.RemoteWriteVersion, "The version of the remote write protocol used to push metrics, 1.0 or 2.0. With 2.0, an endpoint answering 415 Unsupported Media Type is sent 1.0 instead.")
+	cmd.Flags().DurationVar(&opt.RemoteWriteTimeout, "remote-write-timeout", opt.RemoteWriteTimeout, "The timeout of every attempt to send a remote write request.")
+	cmd.Flags().DurationVar(&opt.RemoteWriteMinBackoff, "remote-write-min-backoff", opt.RemoteWriteMinBackoff, "The initial delay before retrying a remote write request that failed with a 429, a 5xx or a transport error. A longer Retry-After is honoured.")
+	cmd.Flags().DurationVar(&opt.RemoteWriteMaxBackoff, "remote-write-max-backoff", opt.RemoteWriteMaxBackoff, "The maximum delay between two attempts to send a remote write request.")
+	cmd.Flags().IntVar(&opt.RemoteWriteBatchSeries, "remote-write-batch-series", opt.RemoteWriteBatchSeries, "The maximum number of series of a remote write request.")
+	cmd.Flags().IntVar(&opt.RemoteWriteBatchBytes, "remote-write-batch-bytes", opt.RemoteWriteBatchBytes, "The maximum uncompressed size of the series of a remote write request. A larger series is sent alone. Unbounded if 0.")
+	cmd.Flags().IntVar(&opt.RemoteWriteConcurrency, "remote-write-concurrency", opt.RemoteWriteConcurrency, fmt.Sprintf("The number of remote write requests sent at the same time to a destination, %d if 0.", metricsclient.DefaultWriteConcurrency))
+	cmd.Flags().IntVar(&opt.MetadataCycles, "metadata-cycles", opt.MetadataCycles, "The number of federation cycles between two sends of the type and help of the metrics with the samples.")
+	cmd.Flags().BoolVar(&opt.DisableMetadata, "disable-metadata", opt.DisableMetadata, "Never send the type and help of the metrics with remote write 1.0.")
+	cmd.Flags().StringVar(&opt.PartialResponses, "partial-responses", opt.PartialResponses, "What to do with the metrics of a response larger than --limit-bytes or malformed: 'fail' discards them as if the source was unreachable, 'forward' forwards the metrics decoded until then and reports the source as degraded.")
+
+	cmd.Flags().StringVar(&opt.WALDir, "wal-dir", opt.WALDir, "A directory where write requests that could not be sent are queued and replayed once the --to-upload endpoint recovers. Disabled if empty.")
+	cmd.Flags().Int64Var(&opt.WALMaxBytes, "wal-max-bytes", opt.WALMaxBytes, "The maximum size of the queued write requests. The oldest requests are dropped first.")
+	cmd.Flags().DurationVar(&opt.WALMaxAge, "wal-max-age", opt.WALMaxAge, "The maximum age of queued write requests before they are dropped.")
+
+	cmd.Flags().StringVar(&opt.ConfigFile, "config-file", opt.ConfigFile, "A YAML or JSON configuration file. Values set in the file take precedence over the corresponding flags. The file is re-read on SIGHUP and /-/reload.")
 
-	// TODO: more complex input definition, such as a JSON struct
 	cmd.Flags().StringArrayVar(&opt.Rules, "match", opt.Rules, "Match rules to federate.")
-	cmd.Flags().StringArrayVar(&opt.RecordingRules, "recordingrule", opt.RecordingRules, "Define recording rule is to generate new metrics based on specified query expression.")
+	cmd.Flags().StringArrayVar(&opt.RecordingRules, "recordingrule", opt.RecordingRules, "Define recording rule is to generate new metrics based on specified query expression, as a JSON object with name, query and optionally type fields. An invalid rule fails the startup.")
+	cmd.Flags().IntVar(&opt.RecordingRuleConcurrency, "recording-rule-concurrency", opt.RecordingRuleConcurrency, "The maximum number of recording rules of a source evaluated at the same time.")
+	cmd.Flags().BoolVar(&opt.LocalRecordingRules, "local-recording-rules", opt.LocalRecordingRules, "Evaluate the recording rules over the federated series with an embedded PromQL engine, instead of the query API of the source. Only the series matched by --match can be queried.")
+	cmd.Flags().DurationVar(&opt.RecordingRuleTimeout, "recording-rule-timeout", opt.RecordingRuleTimeout, "The maximum duration of the evaluation of a single recording rule. Only bounded by the interval if 0.")
 	cmd.Flags().StringVar(&opt.RulesFile, "match-file", opt.RulesFile, "A file containing match rules to federate, one rule per line.")
+	cmd.Flags().IntVar(&opt.MaxSeries, "max-series", opt.MaxSeries, "The maximum number of series forwarded per federation. Disabled if 0.")
+	cmd.Flags().IntVar(&opt.MaxSeriesPerMetric, "max-series-per-metric", opt.MaxSeriesPerMetric, "The maximum number of series of a single metric name forwarded per federation. Disabled if 0.")
+	cmd.Flags().DurationVar(&opt.MaxSampleAge, "max-sample-age", opt.MaxSampleAge, "Samples older than this are dropped and counted in federate_invalid_samples_total.")
+	cmd.Flags().DurationVar(&opt.MaxFutureSkew, "max-future-skew", opt.MaxFutureSkew, "Samples further in the future than this are dropped. Samples less far in the future are sent with the current time. Disabled if 0, in which case all samples in the future are sent with the current time.")
+	cmd.Flags().StringArrayVar(&opt.StrictMetrics, "strict-metric", opt.StrictMetrics, "A metric whose invalid samples fail the federation instead of being dropped. Invalid samples of other metrics are dropped, counted and listed at /debug/invalid-samples.")
+	cmd.Flags().StringArrayVar(&opt.DenyRules, "deny", opt.DenyRules, "Series selectors to drop before forwarding. The match rules are also enforced by the collector.")
 
 	cmd.Flags().StringSliceVar(&opt.LabelFlag, "label", opt.LabelFlag, "Labels to add to each outgoing metric, in key=value form.")
 	cmd.Flags().StringSliceVar(&opt.RenameFlag, "rename", opt.RenameFlag, "Rename metrics before sending by specifying OLD=NEW name pairs.")
@@ -69,6 +128,7 @@ func main() {
 	cmd.Flags().BoolVarP(&opt.Verbose, "verbose", "v", opt.Verbose, "Show verbose output.")
 
 	cmd.Flags().StringVar(&opt.LogLevel, "log-level", opt.LogLevel, "Log filtering level. e.g info, debug, warn, error")
+	cmd.Flags().BoolVar(&opt.LegacyMetrics, "legacy-metrics", opt.LegacyMetrics, "Also expose federate_errors, metricsclient_request_retrieve and metricsclient_request_send, the gauges replaced by the corresponding _total counters, for existing dashboards.")
 
 	// deprecated opt
 	cmd.Flags().StringVar(&opt.Identifier, "id", opt.Identifier, "The unique identifier for metrics sent with this client.")
@@ -97,16 +157,46 @@ func main() {
 type Options struct {
 	Listen     string
 	LimitBytes int64
-	Verbose    bool
+	// PartialResponses is the policy applied to truncated or malformed responses, fail or forward.
+	PartialResponses string
+	// RemoteWriteVersion is the version of the remote write protocol, 1.0 or 2.0.
+	RemoteWriteVersion string
+	// MetadataCycles is the number of cycles between two sends of the metadata,
+	// which is never sent with DisableMetadata.
+	MetadataCycles  int
+	DisableMetadata bool
+	// RemoteWriteTimeout bounds every attempt to send a write request, and
+	// RemoteWriteMinBackoff and RemoteWriteMaxBackoff the delay between two attempts.
+	RemoteWriteTimeout    time.Duration
+	RemoteWriteMinBackoff time.Duration
+	RemoteWriteMaxBackoff time.Duration
+	// RemoteWriteBatchSeries and RemoteWriteBatchBytes bound the write requests,
+	// and RemoteWriteConcurrency is the number of them sent at the same time.
+	RemoteWriteBatchSeries int
+	RemoteWriteBatchBytes  int
+	RemoteWriteConcurrency int
+	Verbose                bool
+
+	LivenessIntervals int
+
+	ConfigFile string
 
 	From          string
 	ToUpload      string
 	FromCAFile    string
 	FromToken     string
 	FromTokenFile string
+	SourceLabel   string
+
+	ToCAFile             string
+	ToCertFile           string
+	ToKeyFile            string
+	ToServerName         string
+	ToInsecureSkipVerify bool
+	ToToken              string
+	ToTokenFile          string
 
 	RenameFlag []string
-	Renames    map[string]string
 
 	ElideLabels []string
 
@@ -118,128 +208,62 @@ type Options struct {
 	RecordingRules []string
 	RulesFile      string
 
+	RecordingRuleConcurrency int
+	RecordingRuleTimeout     time.Duration
+	LocalRecordingRules      bool
+	DenyRules                []string
+	StrictMetrics            []string
+
+	MaxSampleAge  time.Duration
+	MaxFutureSkew time.Duration
+
+	MaxSeries          int
+	MaxSeriesPerMetric int
+
 	LabelFlag []string
-	Labels    map[string]string
 
 	Interval time.Duration
 
+	WALDir      string
+	WALMaxBytes int64
+	WALMaxAge   time.Duration
+
 	LogLevel string
 	Logger   log.Logger
 
+	LegacyMetrics bool
+
 	// deprecated
 	Identifier string
 
 	// simulation file
 	SimulatedTimeseriesFile string
+
+	// invalidSamples records the invalid samples across reloads. If nil, they are
+	// only counted.
+	invalidSamples *forwarder.InvalidSamples
 }
 
 func (o *Options) Run() error {
-	if len(o.From) == 0 {
-		return fmt.Errorf("you must specify a Prometheus server to federate from (e.g. http://localhost:9090)")
-	}
-
-	for _, flag := range o.LabelFlag {
-		values := strings.SplitN(flag, "=", 2)
-		if len(values) != 2 {
-			return fmt.Errorf("--label must be of the form key=value: %s", flag)
-		}
-		if o.Labels == nil {
-			o.Labels = make(map[string]string)
+	if o.LegacyMetrics {
+		if err := forwarder.RegisterLegacyMetrics(prometheus.DefaultRegisterer); err != nil {
+			return fmt.Errorf("failed to register legacy metrics: %v", err)
 		}
-		o.Labels[values[0]] = values[1]
 	}
 
-	for _, flag := range o.RenameFlag {
-		if len(flag) == 0 {
-			continue
-		}
-		values := strings.SplitN(flag, "=", 2)
-		if len(values) != 2 {
-			return fmt.Errorf("--rename must be of the form OLD_NAME=NEW_NAME: %s", flag)
-		}
-		if o.Renames == nil {
-			o.Renames = make(map[string]string)
-		}
-		o.Renames[values[0]] = values[1]
-	}
-
-	from, err := url.Parse(o.From)
+	cfg, err := o.config()
 	if err != nil {
-		return fmt.Errorf("--from is not a valid URL: %v", err)
-	}
-	from.Path = strings.TrimRight(from.Path, "/")
-	if len(from.Path) == 0 {
-		from.Path = "/federate"
+		return err
 	}
 
-	var toUpload *url.URL
-	if len(o.ToUpload) > 0 {
-		toUpload, err = url.Parse(o.ToUpload)
-		if err != nil {
-			return fmt.Errorf("--to-upload is not a valid URL: %v", err)
-		}
-	}
-
-	if toUpload == nil {
-		return fmt.Errorf("--to-upload must be specified")
-	}
-
-	var transformer metricfamily.MultiTransformer
-
-	if len(o.Labels) > 0 {
-		transformer.WithFunc(func() metricfamily.Transformer {
-			return metricfamily.NewLabel(o.Labels, nil)
-		})
-	}
-
-	if len(o.Renames) > 0 {
-		transformer.WithFunc(func() metricfamily.Transformer {
-			return metricfamily.RenameMetrics{Names: o.Renames}
-		})
-	}
-
-	if len(o.ElideLabels) == 0 {
-		o.ElideLabels = []string{"prometheus", "prometheus_replica"}
-	}
-	transformer.WithFunc(func() metricfamily.Transformer {
-		return metricfamily.NewElide(o.ElideLabels...)
-	})
-
-	transformer.WithFunc(func() metricfamily.Transformer {
-		return metricfamily.NewDropInvalidFederateSamples(time.Now().Add(-24 * time.Hour))
-	})
-
-	transformer.With(metricfamily.TransformerFunc(metricfamily.PackMetrics))
-	transformer.With(metricfamily.TransformerFunc(metricfamily.SortMetrics))
-
-	cfg := forwarder.Config{
-		From:          from,
-		ToUpload:      toUpload,
-		FromToken:     o.FromToken,
-		FromTokenFile: o.FromTokenFile,
-		FromCAFile:    o.FromCAFile,
-
-		AnonymizeLabels:   o.AnonymizeLabels,
-		AnonymizeSalt:     o.AnonymizeSalt,
-		AnonymizeSaltFile: o.AnonymizeSaltFile,
-		Debug:             o.Verbose,
-		Interval:          o.Interval,
-		LimitBytes:        o.LimitBytes,
-		Rules:             o.Rules,
-		RecordingRules:    o.RecordingRules,
-		RulesFile:         o.RulesFile,
-		Transformer:       transformer,
-
-		Logger:                  o.Logger,
-		SimulatedTimeseriesFile: o.SimulatedTimeseriesFile,
-	}
-
-	worker, err := forwarder.New(cfg)
+	worker, err := forwarder.New(cfg.Config)
 	if err != nil {
 		return fmt.Errorf("failed to configure metrics collector: %v", err)
 	}
 
-	logger.Log(o.Logger, logger.Info, "msg", "starting metrics collector", "from", o.From, "to", o.ToUpload, "listen", o.Listen)
+	logger.Log(o.Logger, logger.Info, "msg", "starting metrics collector", "from", cfg.From, "to", cfg.ToUpload, "listen", o.Listen)
+
+	reloader := newReloader(o, worker, cfg)
 
 	var g run.Group
 	{
@@ -259,17 +283,8 @@ func (o *Options) Run() error {
 		signal.Notify(hup, syscall.SIGHUP)
 		cancel := make(chan struct{})
 		g.Add(func() error {
-			for {
-				select {
-				case <-hup:
-					if err := worker.Reconfigure(cfg); err != nil {
-						logger.Log(o.Logger, logger.Error, "msg", "failed to reload config", "err", err)
-						return err
-					}
-				case <-cancel:
-					return nil
-				}
-			}
+			reloadOnSignal(hup, cancel, reloader.Reload)
+			return nil
 		}, func(error) {
 			close(cancel)
 		})
@@ -278,12 +293,18 @@ func (o *Options) Run() error {
 	if len(o.Listen) > 0 {
 		handlers := http.NewServeMux()
 		collectorhttp.DebugRoutes(handlers)
-		collectorhttp.HealthRoutes(handlers)
-		collectorhttp.MetricRoutes(handlers)
-		collectorhttp.ReloadRoutes(handlers, func() error {
-			return worker.Reconfigure(cfg)
+		collectorhttp.HealthRoutes(handlers, func() (bool, interface{}) {
+			h := worker.Health()
+			return h.Live(time.Now(), o.LivenessIntervals), h
+		}, func() (bool, interface{}) {
+			h := worker.Health()
+			return h.Ready(), h
 		})
+		collectorhttp.MetricRoutes(handlers)
+		collectorhttp.ReloadRoutes(handlers, reloader.Reload)
 		handlers.Handle("/federate", serveLastMetrics(o.Logger, worker))
+		handlers.Handle("/debug/invalid-samples", o.invalidSamples)
+		handlers.Handle("/status", serveStatus(o.Logger, worker, reloader.Configuration))
 		l, err := net.Listen("tcp", o.Listen)
 		if err != nil {
 			return fmt.Errorf("failed to listen: %v", err)
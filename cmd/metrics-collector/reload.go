@@ -0,0 +1,256 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/stolostron/metrics-collector/pkg/forwarder"
+	"github.com/stolostron/metrics-collector/pkg/logger"
+)
+
+// reloader re-derives the configuration from the flags and the files it is read from
+// and applies it to the worker. If the new configuration is invalid, the previous one
+// keeps running.
+type reloader struct {
+	opts   *Options
+	worker *forwarder.Worker
+	logger log.Logger
+
+	mu      sync.Mutex
+	current map[string]string
+}
+
+func newReloader(o *Options, worker *forwarder.Worker, cfg collectorConfig) *reloader {
+	return &reloader{
+		opts:    o,
+		worker:  worker,
+		logger:  log.With(o.Logger, "component", "reloader"),
+		current: cfg.describe(),
+	}
+}
+
+// Configuration returns the description of the configuration running, with secrets redacted.
+func (r *reloader) Configuration() map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d := make(map[string]string, len(r.current))
+	for k, v := range r.current {
+		d[k] = v
+	}
+	return d
+}
+
+// Reload applies the current content of the configuration sources to the worker.
+// It is safe to call concurrently.
+func (r *reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cfg, err := r.opts.config()
+	if err != nil {
+		logger.Log(r.logger, logger.Error, "msg", "invalid configuration, keeping the previous one", "err", err)
+		return fmt.Errorf("invalid configuration, keeping the previous one: %v", err)
+	}
+
+	next := cfg.describe()
+	changes := diffDescriptions(r.current, next)
+	for _, c := range changes {
+		logger.Log(r.logger, logger.Info, "msg", "configuration changed", "setting", c.key, "old", c.old, "new", c.new)
+	}
+	if len(changes) == 0 {
+		logger.Log(r.logger, logger.Info, "msg", "no configuration changes detected")
+	}
+
+	if err := r.worker.Reconfigure(cfg.Config); err != nil {
+		logger.Log(r.logger, logger.Error, "msg", "failed to apply configuration, keeping the previous one", "err", err)
+		return fmt.Errorf("failed to apply configuration, keeping the previous one: %v", err)
+	}
+	r.current = next
+	logger.Log(r.logger, logger.Info, "msg", "configuration reloaded", "changes", len(changes))
+	return nil
+}
+
+// reloadOnSignal calls reload for every signal received until cancel is closed.
+// A failed reload is logged by the reloader and keeps the previous configuration
+// running, it never stops the collector.
+func reloadOnSignal(signals <-chan os.Signal, cancel <-chan struct{}, reload func() error) {
+	for {
+		select {
+		case <-signals:
+			_ = reload()
+		case <-cancel:
+			return
+		}
+	}
+}
+
+// describe flattens the configuration into settings that can be compared and logged.
+// Secrets are never included, only a digest that changes along with them. Files are
+// described by their path and a digest of their content, so that rotated files are
+// reported as changes.
+func (c collectorConfig) describe() map[string]string {
+	d := map[string]string{
+		"interval":                   c.Interval.String(),
+		"limit-bytes":                fmt.Sprint(c.LimitBytes),
+		"partial-responses":          string(c.PartialResponses),
+		"remote-write-version":       string(c.RemoteWriteVersion),
+		"metadata-cycles":            fmt.Sprint(c.MetadataCycles),
+		"disable-metadata":           fmt.Sprint(c.DisableMetadata),
+		"remote-write-timeout":       c.RemoteWriteTimeout.String(),
+		"remote-write-min-backoff":   c.RemoteWriteMinBackoff.String(),
+		"remote-write-max-backoff":   c.RemoteWriteMaxBackoff.String(),
+		"remote-write-batch-series":  fmt.Sprint(c.RemoteWriteBatchSeries),
+		"remote-write-batch-bytes":   fmt.Sprint(c.RemoteWriteBatchBytes),
+		"remote-write-concurrency":   fmt.Sprint(c.RemoteWriteConcurrency),
+		"match":                      strings.Join(c.Rules, ","),
+		"match-file":                 describeFile(c.RulesFile),
+		"recording-rule-concurrency": fmt.Sprint(c.RecordingRuleConcurrency),
+		"recording-rule-timeout":     c.RecordingRuleTimeout.String(),
+		"local-recording-rules":      fmt.Sprint(c.LocalRecordingRules),
+		"deny":                       strings.Join(c.DenyRules, ","),
+		"strict-metric":              strings.Join(c.StrictMetrics, ","),
+		"max-sample-age":             c.MaxSampleAge.String(),
+		"max-future-skew":            c.MaxFutureSkew.String(),
+		"anonymize-labels":           strings.Join(c.AnonymizeLabels, ","),
+		"anonymize-salt":             describeSecret(c.AnonymizeSalt),
+		"anonymize-salt-file":        describeFile(c.AnonymizeSaltFile),
+		"elide-label":                strings.Join(c.ElideLabels, ","),
+		"from-token":                 describeSecret(c.FromToken),
+		"from-token-file":            describeFile(c.FromTokenFile),
+		"from-ca-file":               describeFile(c.FromCAFile),
+		"source-label":               c.SourceLabel,
+		"to-ca-file":                 describeFile(c.ToCAFile),
+		"to-cert-file":               describeFile(c.ToCertFile),
+		"to-key-file":                describeFile(c.ToKeyFile),
+		"to-server-name":             c.ToServerName,
+		"to-insecure-skip-verify":    fmt.Sprint(c.ToInsecureSkipVerify),
+		"to-token":                   describeSecret(c.ToToken),
+		"to-token-file":              describeFile(c.ToTokenFile),
+		"wal-dir":                    c.WALDir,
+		"wal-max-bytes":              fmt.Sprint(c.WALMaxBytes),
+		"wal-max-age":                c.WALMaxAge.String(),
+	}
+	if c.From != nil {
+		d["from"] = c.From.Redacted()
+	}
+	if c.ToUpload != nil {
+		d["to-upload"] = c.ToUpload.Redacted()
+	}
+	for k, v := range c.Labels {
+		d["label "+k] = v
+	}
+	for k, v := range c.Renames {
+		d["rename "+k] = v
+	}
+	d["max-series"] = fmt.Sprint(c.CardinalityLimits.MaxSeries)
+	d["max-series-per-metric"] = fmt.Sprint(c.CardinalityLimits.MaxSeriesPerMetric)
+	for name, limit := range c.CardinalityLimits.PerMetric {
+		d["max-series "+name] = fmt.Sprint(limit)
+	}
+	for i, r := range c.RelabelConfigs {
+		data, _ := json.Marshal(r)
+		d[fmt.Sprintf("relabel %d", i)] = string(data)
+	}
+	for _, r := range c.RecordingRules {
+		d["recordingrule "+r.Name] = describeRecordingRule(r)
+	}
+	for _, src := range c.Sources {
+		prefix := "source " + src.Name + " "
+		if src.URL != nil {
+			d[prefix+"url"] = src.URL.Redacted()
+		}
+		d[prefix+"token"] = describeSecret(src.Token)
+		d[prefix+"token-file"] = describeFile(src.TokenFile)
+		d[prefix+"ca-file"] = describeFile(src.CAFile)
+		d[prefix+"match"] = strings.Join(src.Rules, ",")
+		d[prefix+"match-file"] = describeFile(src.RulesFile)
+		for _, r := range src.RecordingRules {
+			d[prefix+"recordingrule "+r.Name] = describeRecordingRule(r)
+		}
+	}
+	for _, dest := range c.Destinations {
+		prefix := "destination " + dest.Name + " "
+		if dest.URL != nil {
+			d[prefix+"url"] = dest.URL.Redacted()
+		}
+		d[prefix+"ca-file"] = describeFile(dest.CAFile)
+		d[prefix+"cert-file"] = describeFile(dest.CertFile)
+		d[prefix+"key-file"] = describeFile(dest.KeyFile)
+		d[prefix+"server-name"] = dest.ServerName
+		d[prefix+"insecure-skip-verify"] = fmt.Sprint(dest.InsecureSkipVerify)
+		d[prefix+"token"] = describeSecret(dest.Token)
+		d[prefix+"token-file"] = describeFile(dest.TokenFile)
+		d[prefix+"match"] = strings.Join(dest.Match, ",")
+		d[prefix+"max-retry-duration"] = dest.MaxRetryDuration.String()
+		d[prefix+"remote-write-version"] = string(dest.RemoteWriteVersion)
+		d[prefix+"request-timeout"] = dest.RequestTimeout.String()
+		d[prefix+"min-backoff"] = dest.MinBackoff.String()
+		d[prefix+"max-backoff"] = dest.MaxBackoff.String()
+		for k, v := range dest.Headers {
+			d[prefix+"header "+k] = describeSecret(v)
+		}
+	}
+	return d
+}
+
+func describeRecordingRule(r forwarder.RecordingRule) string {
+	if len(r.Type) == 0 {
+		return r.Query
+	}
+	return r.Query + " (" + r.Type + ")"
+}
+
+func describeSecret(s string) string {
+	if len(s) == 0 {
+		return ""
+	}
+	return "<redacted> " + digest([]byte(s))
+}
+
+func describeFile(path string) string {
+	if len(path) == 0 {
+		return ""
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return path + " (unreadable)"
+	}
+	return path + " " + digest(data)
+}
+
+func digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])[:12]
+}
+
+type change struct {
+	key, old, new string
+}
+
+// diffDescriptions returns the settings that differ between two descriptions, sorted by name.
+func diffDescriptions(old, new map[string]string) []change {
+	var changes []change
+	for k, v := range new {
+		if o, ok := old[k]; !ok || o != v {
+			changes = append(changes, change{key: k, old: old[k], new: v})
+		}
+	}
+	for k, v := range old {
+		if _, ok := new[k]; !ok {
+			changes = append(changes, change{key: k, old: v})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].key < changes[j].key })
+	return changes
+}
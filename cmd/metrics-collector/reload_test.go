@@ -0,0 +1,178 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/stolostron/metrics-collector/pkg/forwarder"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadKeepsPreviousConfiguration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	writeFile(t, path, "version: v1\ninterval: 1m\n")
+
+	o := &Options{
+		From:             "http://prometheus:9090",
+		ToUpload:         "http://receiver/api/v1/receive",
+		PartialResponses: string(forwarder.PartialResponseFail),
+		ConfigFile:       path,
+		Logger:           log.NewNopLogger(),
+		invalidSamples:   forwarder.NewInvalidSamples(invalidSamplesKept),
+	}
+	cfg, err := o.config()
+	if err != nil {
+		t.Fatalf("invalid configuration: %v", err)
+	}
+	worker, err := forwarder.New(cfg.Config)
+	if err != nil {
+		t.Fatalf("failed to create worker: %v", err)
+	}
+	r := newReloader(o, worker, cfg)
+
+	writeFile(t, path, "version: v1\ninterval: 2m\n")
+	if err := r.Reload(); err != nil {
+		t.Fatalf("failed to reload: %v", err)
+	}
+	if got := r.Configuration()["interval"]; got != "2m0s" {
+		t.Errorf("expected the interval to be reloaded, got %q", got)
+	}
+
+	// An invalid file is rejected and the previous configuration keeps running.
+	for _, content := range []string{"version: v1\ninterval: [\n", "version: v1\nunknown: true\n"} {
+		writeFile(t, path, content)
+		if err := r.Reload(); err == nil {
+			t.Errorf("expected an error reloading %q", content)
+		}
+		if got := r.Configuration()["interval"]; got != "2m0s" {
+			t.Errorf("expected the previous configuration to be kept, got interval %q", got)
+		}
+	}
+}
+
+func TestConfigWithoutInvalidSamples(t *testing.T) {
+	o := &Options{
+		From:             "http://prometheus:9090",
+		ToUpload:         "http://receiver/api/v1/receive",
+		PartialResponses: string(forwarder.PartialResponseFail),
+		Logger:           log.NewNopLogger(),
+	}
+	cfg, err := o.config()
+	if err != nil {
+		t.Fatalf("invalid configuration: %v", err)
+	}
+
+	// A stale sample is dropped without a recorder of the invalid samples.
+	name, stale := "up", time.Now().Add(-48*time.Hour).Unix()*1000
+	family := &clientmodel.MetricFamily{
+		Name:   &name,
+		Type:   clientmodel.MetricType_GAUGE.Enum(),
+		Metric: []*clientmodel.Metric{{Gauge: &clientmodel.Gauge{Value: new(float64)}, TimestampMs: &stale}},
+	}
+	if _, err := cfg.Transformer.Transform(family); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, m := range family.Metric {
+		if m != nil {
+			t.Errorf("expected the stale sample to be dropped, got %v", m)
+		}
+	}
+}
+
+func TestReloadOnSignalKeepsRunning(t *testing.T) {
+	signals := make(chan os.Signal)
+	cancel := make(chan struct{})
+	reloads := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		reloadOnSignal(signals, cancel, func() error {
+			reloads <- struct{}{}
+			return errors.New("invalid configuration")
+		})
+	}()
+
+	// Failed reloads do not stop the loop.
+	for i := 0; i < 2; i++ {
+		signals <- syscall.SIGHUP
+		<-reloads
+	}
+	select {
+	case <-done:
+		t.Fatal("expected a failed reload to keep the collector running")
+	default:
+	}
+	close(cancel)
+	<-done
+}
+
+func TestDiffDescriptions(t *testing.T) {
+	old := map[string]string{"interval": "1m0s", "match": "up", "wal-dir": "/wal", "deny": ""}
+	new := map[string]string{"interval": "2m0s", "match": "up", "deny": "", "anonymize-labels": "instance"}
+	want := []change{
+		{key: "anonymize-labels", new: "instance"},
+		{key: "interval", old: "1m0s", new: "2m0s"},
+		{key: "wal-dir", old: "/wal"},
+	}
+	if got := diffDescriptions(old, new); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+	if got := diffDescriptions(new, new); len(got) != 0 {
+		t.Errorf("expected no changes, got %+v", got)
+	}
+}
+
+func TestDescribeDigests(t *testing.T) {
+	// Secrets are described by a digest that changes when they are rotated.
+	first, second := describeSecret("first-secret"), describeSecret("second-secret")
+	if first == second || strings.Contains(first, "first-secret") || strings.Contains(second, "second-secret") {
+		t.Errorf("expected distinct redacted digests, got %q and %q", first, second)
+	}
+	if describeSecret("") != "" {
+		t.Errorf("expected an unset secret to be described as empty")
+	}
+
+	// Files are described by their path and a digest of their content.
+	dir, err := ioutil.TempDir("", "describe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token")
+	writeFile(t, path, "first-token")
+	before := collectorConfig{Config: forwarder.Config{FromTokenFile: path}}.describe()["from-token-file"]
+	writeFile(t, path, "second-token")
+	after := collectorConfig{Config: forwarder.Config{FromTokenFile: path}}.describe()["from-token-file"]
+	if before == after || !strings.HasPrefix(before, path+" ") || !strings.HasPrefix(after, path+" ") {
+		t.Errorf("expected the digest of the file to change with its content, got %q and %q", before, after)
+	}
+	if strings.Contains(after, "second-token") {
+		t.Errorf("expected the content of the file not to be described, got %q", after)
+	}
+	if got := describeFile(filepath.Join(dir, "missing")); !strings.HasSuffix(got, "(unreadable)") {
+		t.Errorf("expected a missing file to be described as unreadable, got %q", got)
+	}
+}
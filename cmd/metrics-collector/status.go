@@ -0,0 +1,104 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/stolostron/metrics-collector/pkg/forwarder"
+	"github.com/stolostron/metrics-collector/pkg/logger"
+	"github.com/stolostron/metrics-collector/pkg/status"
+)
+
+// statusReport is served by the /status endpoint.
+type statusReport struct {
+	Condition     status.Condition  `json:"condition"`
+	Health        forwarder.Health  `json:"health"`
+	LastCycle     forwarder.Cycle   `json:"lastCycle"`
+	Configuration map[string]string `json:"configuration"`
+}
+
+// Settings returns the configuration sorted by name, for the HTML page.
+func (s statusReport) Settings() [][2]string {
+	var settings [][2]string
+	for k, v := range s.Configuration {
+		settings = append(settings, [2]string{k, v})
+	}
+	sort.Slice(settings, func(i, j int) bool { return settings[i][0] < settings[j][0] })
+	return settings
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Metrics collector status</title></head>
+<body>
+<h1>Metrics collector status</h1>
+<h2>Condition</h2>
+<p>{{.Condition.Type}} ({{.Condition.Reason}}): {{.Condition.Message}}, since {{.Condition.LastTransitionTime}}</p>
+<h2>Last cycle</h2>
+<table>
+<tr><th>Start</th><td>{{.LastCycle.Start}}</td></tr>
+<tr><th>End</th><td>{{.LastCycle.End}}</td></tr>
+<tr><th>Error</th><td>{{.LastCycle.Error}}</td></tr>
+<tr><th>Series fetched</th><td>{{.LastCycle.Fetched}}</td></tr>
+<tr><th>Series filtered</th><td>{{.LastCycle.Filtered}}</td></tr>
+<tr><th>Series sent</th><td>{{.LastCycle.Sent}}</td></tr>
+<tr><th>Consecutive failures</th><td>{{.Health.ConsecutiveFailures}}</td></tr>
+</table>
+<h2>Recording rules</h2>
+<table>
+<tr><th>Source</th><th>Name</th><th>Series</th><th>Duration</th><th>Error</th></tr>
+{{range .LastCycle.RecordingRules}}<tr><td>{{.Source}}</td><td>{{.Name}}</td><td>{{.Series}}</td><td>{{.Duration}}</td><td>{{.Error}}</td></tr>
+{{end}}</table>
+<h2>Destinations</h2>
+{{range .LastCycle.Destinations}}<h3>{{.Name}} ({{.URL}})</h3>
+<p>Last success: {{.LastSuccess}} {{.LastError}}</p>
+{{with .Summary}}<p>{{.Batches}} batches of {{.Series}} series: {{.Sent}} sent, {{.Retried}} retried, {{.Failed}} failed, {{.Rejected}} rejected</p>
+{{end}}<table>
+<tr><th>Time</th><th>Bytes</th><th>Attempts</th><th>Status code</th><th>Error</th></tr>
+{{range .Batches}}<tr><td>{{.Time}}</td><td>{{.Bytes}}</td><td>{{.Attempts}}</td><td>{{.StatusCode}}</td><td>{{.Error}}</td></tr>
+{{end}}</table>
+{{end}}
+<h2>Configuration</h2>
+<table>
+{{range .Settings}}<tr><th>{{index . 0}}</th><td>{{index . 1}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// serveStatus reports the details of the last cycle of the worker, along with
+// the running configuration. It answers with HTML to browsers and JSON otherwise.
+func serveStatus(l log.Logger, worker *forwarder.Worker, configuration func() map[string]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		report := statusReport{
+			Condition:     worker.Condition(),
+			Health:        worker.Health(),
+			LastCycle:     worker.LastCycle(),
+			Configuration: configuration(),
+		}
+
+		if req.URL.Query().Get("format") == "html" ||
+			(req.URL.Query().Get("format") == "" && strings.Contains(req.Header.Get("Accept"), "text/html")) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			if err := statusTemplate.Execute(w, report); err != nil {
+				logger.Log(l, logger.Error, "msg", "unable to write status", "err", err)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			logger.Log(l, logger.Error, "msg", "unable to write status", "err", err)
+		}
+	})
+}
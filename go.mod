@@ -16,6 +16,7 @@ require (
 	github.com/prometheus/prometheus v2.3.2+incompatible
 	github.com/spf13/cobra v1.1.3
 	github.com/stolostron/multicluster-observability-operator v0.0.0-20220114031559-df8784023909
+	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
 	k8s.io/apimachinery v0.21.1
 	k8s.io/client-go v13.0.0+incompatible
 	sigs.k8s.io/controller-runtime v0.9.0
@@ -65,7 +66,6 @@ require (
 	google.golang.org/protobuf v1.26.0 // indirect
 	gopkg.in/inf.v0 v0.9.1 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
-	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b // indirect
 	k8s.io/api v0.21.1 // indirect
 	k8s.io/apiextensions-apiserver v0.21.1 // indirect
 	k8s.io/component-base v0.21.1 // indirect
@@ -0,0 +1,480 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"gopkg.in/yaml.v3"
+
+	"github.com/stolostron/metrics-collector/pkg/metricfamily"
+)
+
+// Version is the only supported version of the configuration file schema.
+const Version = "v1"
+
+// File is the schema of the configuration file. It is YAML, and since YAML
+// is a superset of JSON, JSON documents are accepted as well.
+type File struct {
+	Version     string        `yaml:"version" json:"version"`
+	Interval    time.Duration `yaml:"interval,omitempty" json:"interval,omitempty"`
+	LimitBytes  int64         `yaml:"limitBytes,omitempty" json:"limitBytes,omitempty"`
+	Sources     []Source      `yaml:"sources,omitempty" json:"sources,omitempty"`
+	SourceLabel string        `yaml:"sourceLabel,omitempty" json:"sourceLabel,omitempty"`
+	// Deny lists series selectors dropped before forwarding.
+	Deny         []string          `yaml:"deny,omitempty" json:"deny,omitempty"`
+	Destinations []Destination     `yaml:"destinations,omitempty" json:"destinations,omitempty"`
+	Labels       map[string]string `yaml:"labels,omitempty" json:"labels,omitempty"`
+	Renames      map[string]string `yaml:"renames,omitempty" json:"renames,omitempty"`
+	// RelabelConfigs are applied to every series, with the semantics of the Prometheus relabel_configs.
+	RelabelConfigs []metricfamily.RelabelConfig `yaml:"relabelConfigs,omitempty" json:"relabelConfigs,omitempty"`
+	ElideLabels    []string                     `yaml:"elideLabels,omitempty" json:"elideLabels,omitempty"`
+	Anonymize      *Anonymize                   `yaml:"anonymize,omitempty" json:"anonymize,omitempty"`
+	Cardinality    *Cardinality                 `yaml:"cardinality,omitempty" json:"cardinality,omitempty"`
+	// MaxSampleAge and MaxFutureSkew bound the timestamps of the samples forwarded,
+	// relative to the time of the federation.
+	MaxSampleAge  time.Duration `yaml:"maxSampleAge,omitempty" json:"maxSampleAge,omitempty"`
+	MaxFutureSkew time.Duration `yaml:"maxFutureSkew,omitempty" json:"maxFutureSkew,omitempty"`
+	// StrictMetrics lists the metrics whose invalid samples fail the whole federation
+	// instead of being dropped and reported.
+	StrictMetrics []string `yaml:"strictMetrics,omitempty" json:"strictMetrics,omitempty"`
+	// RecordingRuleConcurrency bounds the number of recording rules of a source
+	// evaluated at the same time, and RecordingRuleTimeout each evaluation.
+	RecordingRuleConcurrency int           `yaml:"recordingRuleConcurrency,omitempty" json:"recordingRuleConcurrency,omitempty"`
+	RecordingRuleTimeout     time.Duration `yaml:"recordingRuleTimeout,omitempty" json:"recordingRuleTimeout,omitempty"`
+	// LocalRecordingRules evaluates the recording rules over the federated series
+	// instead of the query API of the sources.
+	LocalRecordingRules bool `yaml:"localRecordingRules,omitempty" json:"localRecordingRules,omitempty"`
+	// PartialResponses is what happens to truncated or malformed responses of the
+	// sources, either fail or forward.
+	PartialResponses string `yaml:"partialResponses,omitempty" json:"partialResponses,omitempty"`
+	// RemoteWriteVersion is the version of the remote write protocol used by the
+	// destinations, either 1.0 or 2.0.
+	RemoteWriteVersion string `yaml:"remoteWriteVersion,omitempty" json:"remoteWriteVersion,omitempty"`
+	// MetadataCycles is the number of cycles between two sends of the type and help
+	// of the metrics, which are never sent with DisableMetadata.
+	MetadataCycles  int  `yaml:"metadataCycles,omitempty" json:"metadataCycles,omitempty"`
+	DisableMetadata bool `yaml:"disableMetadata,omitempty" json:"disableMetadata,omitempty"`
+	// RemoteWriteTimeout bounds every attempt to send a write request, and
+	// RemoteWriteMinBackoff and RemoteWriteMaxBackoff the delay between two attempts.
+	RemoteWriteTimeout    time.Duration `yaml:"remoteWriteTimeout,omitempty" json:"remoteWriteTimeout,omitempty"`
+	RemoteWriteMinBackoff time.Duration `yaml:"remoteWriteMinBackoff,omitempty" json:"remoteWriteMinBackoff,omitempty"`
+	RemoteWriteMaxBackoff time.Duration `yaml:"remoteWriteMaxBackoff,omitempty" json:"remoteWriteMaxBackoff,omitempty"`
+	// RemoteWriteBatchSeries and RemoteWriteBatchBytes bound the number of series and
+	// the uncompressed size of a write request, and RemoteWriteConcurrency is the
+	// number of requests sent at the same time to a destination.
+	RemoteWriteBatchSeries int `yaml:"remoteWriteBatchSeries,omitempty" json:"remoteWriteBatchSeries,omitempty"`
+	RemoteWriteBatchBytes  int `yaml:"remoteWriteBatchBytes,omitempty" json:"remoteWriteBatchBytes,omitempty"`
+	RemoteWriteConcurrency int `yaml:"remoteWriteConcurrency,omitempty" json:"remoteWriteConcurrency,omitempty"`
+}
+
+// Cardinality bounds the number of series forwarded. A zero limit disables it.
+type Cardinality struct {
+	MaxSeries          int            `yaml:"maxSeries,omitempty" json:"maxSeries,omitempty"`
+	MaxSeriesPerMetric int            `yaml:"maxSeriesPerMetric,omitempty" json:"maxSeriesPerMetric,omitempty"`
+	PerMetric          map[string]int `yaml:"perMetric,omitempty" json:"perMetric,omitempty"`
+}
+
+// Source is a Prometheus server to federate from.
+type Source struct {
+	// Name identifies the source, it defaults to the host of the URL.
+	Name           string          `yaml:"name,omitempty" json:"name,omitempty"`
+	URL            string          `yaml:"url" json:"url"`
+	Token          string          `yaml:"token,omitempty" json:"token,omitempty"`
+	TokenFile      string          `yaml:"tokenFile,omitempty" json:"tokenFile,omitempty"`
+	CAFile         string          `yaml:"caFile,omitempty" json:"caFile,omitempty"`
+	Match          []string        `yaml:"match,omitempty" json:"match,omitempty"`
+	MatchFile      string          `yaml:"matchFile,omitempty" json:"matchFile,omitempty"`
+	RecordingRules []RecordingRule `yaml:"recordingRules,omitempty" json:"recordingRules,omitempty"`
+}
+
+// RecordingRule generates a new metric from the result of a query expression.
+type RecordingRule struct {
+	Name  string `yaml:"name" json:"name"`
+	Query string `yaml:"query" json:"query"`
+	// Type is the type of the generated metric: gauge, counter or untyped, the default.
+	Type string `yaml:"type,omitempty" json:"type,omitempty"`
+}
+
+// Destination is a remote write endpoint to push metrics to.
+type Destination struct {
+	// Name identifies the destination, it defaults to the host of the URL.
+	Name string `yaml:"name,omitempty" json:"name,omitempty"`
+	URL  string `yaml:"url" json:"url"`
+	// CAFile, CertFile and KeyFile default to the TLS material of the upload client
+	// when none of them is set. Set only CAFile for TLS without a client certificate.
+	CAFile             string            `yaml:"caFile,omitempty" json:"caFile,omitempty"`
+	CertFile           string            `yaml:"certFile,omitempty" json:"certFile,omitempty"`
+	KeyFile            string            `yaml:"keyFile,omitempty" json:"keyFile,omitempty"`
+	ServerName         string            `yaml:"serverName,omitempty" json:"serverName,omitempty"`
+	InsecureSkipVerify bool              `yaml:"insecureSkipVerify,omitempty" json:"insecureSkipVerify,omitempty"`
+	Token              string            `yaml:"token,omitempty" json:"token,omitempty"`
+	TokenFile          string            `yaml:"tokenFile,omitempty" json:"tokenFile,omitempty"`
+	Headers            map[string]string `yaml:"headers,omitempty" json:"headers,omitempty"`
+	// Match is an allow-list of series selectors sent to this destination.
+	Match            []string      `yaml:"match,omitempty" json:"match,omitempty"`
+	MaxRetryDuration time.Duration `yaml:"maxRetryDuration,omitempty" json:"maxRetryDuration,omitempty"`
+	// RemoteWriteVersion overrides the remote write protocol version of the file.
+	RemoteWriteVersion string `yaml:"remoteWriteVersion,omitempty" json:"remoteWriteVersion,omitempty"`
+	// RequestTimeout, MinBackoff and MaxBackoff override the remoteWriteTimeout,
+	// remoteWriteMinBackoff and remoteWriteMaxBackoff of the file.
+	RequestTimeout time.Duration `yaml:"requestTimeout,omitempty" json:"requestTimeout,omitempty"`
+	MinBackoff     time.Duration `yaml:"minBackoff,omitempty" json:"minBackoff,omitempty"`
+	MaxBackoff     time.Duration `yaml:"maxBackoff,omitempty" json:"maxBackoff,omitempty"`
+}
+
+// Anonymize configures the hashing of label values.
+type Anonymize struct {
+	Labels   []string `yaml:"labels,omitempty" json:"labels,omitempty"`
+	Salt     string   `yaml:"salt,omitempty" json:"salt,omitempty"`
+	SaltFile string   `yaml:"saltFile,omitempty" json:"saltFile,omitempty"`
+}
+
+// FieldError describes an invalid value in the configuration file.
+type FieldError struct {
+	Path   string
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e FieldError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%d:%d: %s: %s", e.Line, e.Column, e.Path, e.Msg)
+	}
+	return fmt.Sprintf("%s: %s", e.Path, e.Msg)
+}
+
+// ValidationError lists all invalid values found in a configuration file.
+type ValidationError []FieldError
+
+func (e ValidationError) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, fe := range e {
+		msgs = append(msgs, fe.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Load reads, parses and validates the configuration file at path.
+func Load(path string) (*File, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+	f, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %s:\n%v", path, err)
+	}
+	return f, nil
+}
+
+// Parse parses and validates the content of a configuration file.
+func Parse(data []byte) (*File, error) {
+	f := &File{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(f); err != nil {
+		return nil, err
+	}
+
+	// Decode a second time into a node tree to locate invalid values.
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	if err := f.validate(&root); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+type validator struct {
+	root *yaml.Node
+	errs ValidationError
+}
+
+// errorf records an error for the value at the given path, made of map keys and sequence indexes.
+func (v *validator) errorf(path []interface{}, format string, args ...interface{}) {
+	var sb strings.Builder
+	for _, p := range path {
+		switch p := p.(type) {
+		case int:
+			sb.WriteString("[" + strconv.Itoa(p) + "]")
+		default:
+			if sb.Len() > 0 {
+				sb.WriteString(".")
+			}
+			sb.WriteString(fmt.Sprint(p))
+		}
+	}
+	fe := FieldError{Path: sb.String(), Msg: fmt.Sprintf(format, args...)}
+	if n := locate(v.root, path); n != nil {
+		fe.Line, fe.Column = n.Line, n.Column
+	}
+	v.errs = append(v.errs, fe)
+}
+
+// locate returns the deepest node of the tree matching path.
+func locate(n *yaml.Node, path []interface{}) *yaml.Node {
+	if n == nil {
+		return nil
+	}
+	if n.Kind == yaml.DocumentNode && len(n.Content) > 0 {
+		n = n.Content[0]
+	}
+	for _, p := range path {
+		var next *yaml.Node
+		switch p := p.(type) {
+		case int:
+			if n.Kind == yaml.SequenceNode && p < len(n.Content) {
+				next = n.Content[p]
+			}
+		case string:
+			if n.Kind == yaml.MappingNode {
+				for i := 0; i+1 < len(n.Content); i += 2 {
+					if n.Content[i].Value == p {
+						next = n.Content[i+1]
+						break
+					}
+				}
+			}
+		}
+		if next == nil {
+			return n
+		}
+		n = next
+	}
+	return n
+}
+
+func (f *File) validate(root *yaml.Node) error {
+	v := &validator{root: root}
+
+	switch f.Version {
+	case Version:
+	case "":
+		v.errorf([]interface{}{"version"}, "must be set to %q", Version)
+	default:
+		v.errorf([]interface{}{"version"}, "unsupported version %q, must be %q", f.Version, Version)
+	}
+	if f.Interval < 0 {
+		v.errorf([]interface{}{"interval"}, "must not be negative")
+	}
+	if f.LimitBytes < 0 {
+		v.errorf([]interface{}{"limitBytes"}, "must not be negative")
+	}
+	if f.RecordingRuleConcurrency < 0 {
+		v.errorf([]interface{}{"recordingRuleConcurrency"}, "must not be negative")
+	}
+	if f.RecordingRuleTimeout < 0 {
+		v.errorf([]interface{}{"recordingRuleTimeout"}, "must not be negative")
+	}
+	switch f.PartialResponses {
+	case "", "fail", "forward":
+	default:
+		v.errorf([]interface{}{"partialResponses"}, "must be fail or forward, not %q", f.PartialResponses)
+	}
+	validateRemoteWriteVersion(v, []interface{}{"remoteWriteVersion"}, f.RemoteWriteVersion)
+	if f.MetadataCycles < 0 {
+		v.errorf([]interface{}{"metadataCycles"}, "must not be negative")
+	}
+	if f.RemoteWriteTimeout < 0 {
+		v.errorf([]interface{}{"remoteWriteTimeout"}, "must not be negative")
+	}
+	validateBackoff(v, nil, "remoteWriteMinBackoff", f.RemoteWriteMinBackoff, "remoteWriteMaxBackoff", f.RemoteWriteMaxBackoff)
+	if f.RemoteWriteBatchSeries < 0 {
+		v.errorf([]interface{}{"remoteWriteBatchSeries"}, "must not be negative")
+	}
+	if f.RemoteWriteBatchBytes < 0 {
+		v.errorf([]interface{}{"remoteWriteBatchBytes"}, "must not be negative")
+	}
+	if f.RemoteWriteConcurrency < 0 {
+		v.errorf([]interface{}{"remoteWriteConcurrency"}, "must not be negative")
+	}
+
+	sources := make(map[string]struct{})
+	for i, s := range f.Sources {
+		path := []interface{}{"sources", i}
+		validateURL(v, append(path, "url"), s.URL)
+		name := s.Name
+		if u, err := url.Parse(s.URL); len(name) == 0 && err == nil {
+			name = u.Host
+		}
+		if _, ok := sources[name]; ok {
+			v.errorf(append(path, "name"), "duplicate source name %q", name)
+		}
+		sources[name] = struct{}{}
+		if len(s.Token) > 0 && len(s.TokenFile) > 0 {
+			v.errorf(append(path, "tokenFile"), "token and tokenFile are mutually exclusive")
+		}
+		for j, rule := range s.Match {
+			if _, err := promql.ParseMetricSelector(rule); err != nil {
+				v.errorf(append(path, "match", j), "invalid match rule: %v", err)
+			}
+		}
+		names := make(map[string]struct{})
+		for j, rule := range s.RecordingRules {
+			rpath := append(path, "recordingRules", j)
+			if !model.IsValidMetricName(model.LabelValue(rule.Name)) {
+				v.errorf(append(rpath, "name"), "invalid metric name %q", rule.Name)
+			} else if _, ok := names[rule.Name]; ok {
+				v.errorf(append(rpath, "name"), "duplicate recording rule %q", rule.Name)
+			}
+			names[rule.Name] = struct{}{}
+			if _, err := promql.ParseExpr(rule.Query); err != nil {
+				v.errorf(append(rpath, "query"), "invalid query: %v", err)
+			}
+			switch rule.Type {
+			case "", "gauge", "counter", "untyped":
+			default:
+				v.errorf(append(rpath, "type"), "must be gauge, counter or untyped, not %q", rule.Type)
+			}
+		}
+	}
+
+	if len(f.SourceLabel) > 0 && !model.LabelName(f.SourceLabel).IsValid() {
+		v.errorf([]interface{}{"sourceLabel"}, "invalid label name %q", f.SourceLabel)
+	}
+
+	for i, rule := range f.Deny {
+		if _, err := promql.ParseMetricSelector(rule); err != nil {
+			v.errorf([]interface{}{"deny", i}, "invalid deny rule: %v", err)
+		}
+	}
+
+	destinations := make(map[string]struct{})
+	for i, d := range f.Destinations {
+		path := []interface{}{"destinations", i}
+		validateURL(v, append(path, "url"), d.URL)
+		name := d.Name
+		if u, err := url.Parse(d.URL); len(name) == 0 && err == nil {
+			name = u.Host
+		}
+		if name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			v.errorf(append(path, "name"), "invalid destination name %q, it must be a single path segment", name)
+		} else if _, ok := destinations[name]; ok {
+			v.errorf(append(path, "name"), "duplicate destination name %q", name)
+		}
+		destinations[name] = struct{}{}
+		if (len(d.CertFile) > 0) != (len(d.KeyFile) > 0) {
+			v.errorf(path, "certFile and keyFile must be set together")
+		}
+		if len(d.Token) > 0 && len(d.TokenFile) > 0 {
+			v.errorf(append(path, "tokenFile"), "token and tokenFile are mutually exclusive")
+		}
+		for j, rule := range d.Match {
+			if _, err := promql.ParseMetricSelector(rule); err != nil {
+				v.errorf(append(path, "match", j), "invalid match rule: %v", err)
+			}
+		}
+		if d.MaxRetryDuration < 0 {
+			v.errorf(append(path, "maxRetryDuration"), "must not be negative")
+		}
+		validateRemoteWriteVersion(v, append(path, "remoteWriteVersion"), d.RemoteWriteVersion)
+		if d.RequestTimeout < 0 {
+			v.errorf(append(path, "requestTimeout"), "must not be negative")
+		}
+		validateBackoff(v, path, "minBackoff", d.MinBackoff, "maxBackoff", d.MaxBackoff)
+	}
+
+	for k := range f.Labels {
+		if !model.LabelName(k).IsValid() {
+			v.errorf([]interface{}{"labels", k}, "invalid label name %q", k)
+		}
+	}
+	for k, n := range f.Renames {
+		if !model.IsValidMetricName(model.LabelValue(n)) {
+			v.errorf([]interface{}{"renames", k}, "invalid metric name %q", n)
+		}
+	}
+	for i, c := range f.RelabelConfigs {
+		if err := c.Validate(); err != nil {
+			v.errorf([]interface{}{"relabelConfigs", i}, "%v", err)
+		}
+	}
+	if c := f.Cardinality; c != nil {
+		if c.MaxSeries < 0 {
+			v.errorf([]interface{}{"cardinality", "maxSeries"}, "must not be negative")
+		}
+		if c.MaxSeriesPerMetric < 0 {
+			v.errorf([]interface{}{"cardinality", "maxSeriesPerMetric"}, "must not be negative")
+		}
+		for name, limit := range c.PerMetric {
+			if !model.IsValidMetricName(model.LabelValue(name)) {
+				v.errorf([]interface{}{"cardinality", "perMetric", name}, "invalid metric name %q", name)
+			}
+			if limit < 0 {
+				v.errorf([]interface{}{"cardinality", "perMetric", name}, "must not be negative")
+			}
+		}
+	}
+	if f.MaxSampleAge < 0 {
+		v.errorf([]interface{}{"maxSampleAge"}, "must not be negative")
+	}
+	if f.MaxFutureSkew < 0 {
+		v.errorf([]interface{}{"maxFutureSkew"}, "must not be negative")
+	}
+	for i, name := range f.StrictMetrics {
+		if !model.IsValidMetricName(model.LabelValue(name)) {
+			v.errorf([]interface{}{"strictMetrics", i}, "invalid metric name %q", name)
+		}
+	}
+	if a := f.Anonymize; a != nil {
+		if len(a.Labels) > 0 && len(a.Salt) == 0 && len(a.SaltFile) == 0 {
+			v.errorf([]interface{}{"anonymize"}, "salt or saltFile must be set if labels is set")
+		}
+		if len(a.Salt) > 0 && len(a.SaltFile) > 0 {
+			v.errorf([]interface{}{"anonymize", "saltFile"}, "salt and saltFile are mutually exclusive")
+		}
+	}
+
+	if len(v.errs) > 0 {
+		return v.errs
+	}
+	return nil
+}
+
+func validateURL(v *validator, path []interface{}, s string) {
+	if len(s) == 0 {
+		v.errorf(path, "must be set")
+		return
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		v.errorf(path, "is not a valid URL: %v", err)
+		return
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		v.errorf(path, "unsupported scheme %q, must be http or https", u.Scheme)
+	}
+}
+
+func validateRemoteWriteVersion(v *validator, path []interface{}, s string) {
+	switch s {
+	case "", "1.0", "2.0":
+	default:
+		v.errorf(path, "must be 1.0 or 2.0, not %q", s)
+	}
+}
+
+// validateBackoff checks that the back-off bounds are not negative and ordered.
+func validateBackoff(v *validator, path []interface{}, minKey string, min time.Duration, maxKey string, max time.Duration) {
+	if min < 0 {
+		v.errorf(append(path[:len(path):len(path)], minKey), "must not be negative")
+	}
+	if max < 0 {
+		v.errorf(append(path[:len(path):len(path)], maxKey), "must not be negative")
+	}
+	if min > 0 && max > 0 && min > max {
+		v.errorf(append(path[:len(path):len(path)], minKey), "must not exceed %s %s", maxKey, max)
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright Contributors to the Open Cluster Management project
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	f, err := Parse([]byte(`
+version: v1
+interval: 1m
+sources:
+- url: https://prometheus-k8s.openshift-monitoring.svc:9091
+  tokenFile: /var/run/secrets/kubernetes.io/serviceaccount/token
+  match:
+  - '{__name__="up"}'
+  recordingRules:
+  - name: cluster:usage
+    query: sum(up)
+destinations:
+- url: https://observatorium-api/api/metrics/v1/default/api/v1/receive
+- name: long-term
+  url: https://thanos-receive.example.com/api/v1/receive
+  headers:
+    THANOS-TENANT: fleet
+  match:
+  - '{__name__=~"cluster:.*"}'
+labels:
+  cluster: local-cluster
+elideLabels: [prometheus]
+relabelConfigs:
+- source_labels: [instance]
+  regex: '(.*):\d+'
+  target_label: node
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if f.Interval != time.Minute {
+		t.Errorf("got interval %v, want %v", f.Interval, time.Minute)
+	}
+	if len(f.Sources) != 1 || len(f.Sources[0].RecordingRules) != 1 || f.Sources[0].RecordingRules[0].Name != "cluster:usage" {
+		t.Errorf("unexpected sources: %+v", f.Sources)
+	}
+	if len(f.Destinations) != 2 || f.Destinations[1].Headers["THANOS-TENANT"] != "fleet" {
+		t.Errorf("unexpected destinations: %+v", f.Destinations)
+	}
+	if f.Labels["cluster"] != "local-cluster" {
+		t.Errorf("unexpected labels: %v", f.Labels)
+	}
+	if len(f.RelabelConfigs) != 1 || f.RelabelConfigs[0].TargetLabel != "node" || *f.RelabelConfigs[0].Regex != `(.*):\d+` {
+		t.Errorf("unexpected relabel configs: %+v", f.RelabelConfigs)
+	}
+
+	// JSON is accepted as well.
+	if _, err := Parse([]byte(`{"version": "v1", "sources": [{"url": "http://localhost:9090"}]}`)); err != nil {
+		t.Errorf("unexpected error parsing JSON: %v", err)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tc := []struct {
+		name string
+		in   string
+		want []string
+	}{
+		{
+			name: "missing version",
+			in:   `sources: []`,
+			want: []string{"version: must be set"},
+		},
+		{
+			name: "unknown field",
+			in:   "version: v1\nsource: []\n",
+			want: []string{"line 2: field source not found"},
+		},
+		{
+			name: "invalid values are located",
+			in: `version: v1
+sources:
+- url: ftp://localhost
+  match:
+  - 'up{'
+  recordingRules:
+  - name: "1bad"
+    query: sum(
+    type: summary
+destinations:
+- url: ""
+`,
+			want: []string{
+				"3:8: sources[0].url: unsupported scheme",
+				"5:5: sources[0].match[0]: invalid match rule",
+				"7:11: sources[0].recordingRules[0].name: invalid metric name",
+				"8:12: sources[0].recordingRules[0].query: invalid query",
+				"9:11: sources[0].recordingRules[0].type: must be gauge, counter or untyped",
+				"11:8: destinations[0].url: must be set",
+			},
+		},
+		{
+			name: "duplicate destinations",
+			in:   "version: v1\ndestinations:\n- url: http://a\n- url: http://a/other\n",
+			want: []string{"4:3: destinations[1].name: duplicate destination name \"a\""},
+		},
+		{
+			name: "invalid destination name",
+			in:   "version: v1\ndestinations:\n- name: ../x\n  url: http://a\n",
+			want: []string{"3:9: destinations[0].name: invalid destination name \"../x\", it must be a single path segment"},
+		},
+		{
+			name: "duplicate sources",
+			in:   "version: v1\nsources:\n- url: http://a\n- name: a\n  url: http://b\nsourceLabel: 'a-b'\n",
+			want: []string{
+				"4:9: sources[1].name: duplicate source name \"a\"",
+				"6:14: sourceLabel: invalid label name \"a-b\"",
+			},
+		},
+		{
+			name: "invalid deny rule",
+			in:   "version: v1\ndeny:\n- '{job=\"a\"}'\n- 'up{'\n",
+			want: []string{"4:3: deny[1]: invalid deny rule"},
+		},
+		{
+			name: "invalid relabel config",
+			in:   "version: v1\nrelabelConfigs:\n- source_labels: [job]\n  action: keep\n- action: hashmod\n  target_label: shard\n",
+			want: []string{"5:3: relabelConfigs[1]: modulus is required"},
+		},
+		{
+			name: "negative cardinality limit",
+			in:   "version: v1\ncardinality:\n  maxSeries: -1\n  perMetric:\n    up: -2\n",
+			want: []string{"3:14: cardinality.maxSeries: must not be negative", "5:9: cardinality.perMetric.up: must not be negative"},
+		},
+		{
+			name: "negative sample age",
+			in:   "version: v1\nmaxSampleAge: -1h\nmaxFutureSkew: -1m\n",
+			want: []string{"2:15: maxSampleAge: must not be negative", "3:16: maxFutureSkew: must not be negative"},
+		},
+		{
+			name: "invalid partial responses policy",
+			in:   "version: v1\npartialResponses: drop\n",
+			want: []string{"2:19: partialResponses: must be fail or forward, not \"drop\""},
+		},
+		{
+			name: "invalid remote write version",
+			in:   "version: v1\nremoteWriteVersion: 3.0\ndestinations:\n- url: http://a\n  remoteWriteVersion: 2.0\n- url: http://b\n  remoteWriteVersion: '2'\n",
+			want: []string{
+				"2:21: remoteWriteVersion: must be 1.0 or 2.0, not \"3.0\"",
+				"7:23: destinations[1].remoteWriteVersion: must be 1.0 or 2.0, not \"2\"",
+			},
+		},
+		{
+			name: "negative metadata cycles",
+			in:   "version: v1\nmetadataCycles: -1\n",
+			want: []string{"2:17: metadataCycles: must not be negative"},
+		},
+		{
+			name: "invalid remote write retries",
+			in:   "version: v1\nremoteWriteTimeout: -1s\ndestinations:\n- url: http://a\n  minBackoff: 2m\n  maxBackoff: 1m\n",
+			want: []string{
+				"2:21: remoteWriteTimeout: must not be negative",
+				"5:15: destinations[0].minBackoff: must not exceed maxBackoff 1m0s",
+			},
+		},
+		{
+			name: "negative remote write batches",
+			in:   "version: v1\nremoteWriteBatchBytes: -1\nremoteWriteConcurrency: -2\n",
+			want: []string{
+				"2:24: remoteWriteBatchBytes: must not be negative",
+				"3:25: remoteWriteConcurrency: must not be negative",
+			},
+		},
+		{
+			name: "invalid strict metric",
+			in:   "version: v1\nstrictMetrics: [up, 'a-b']\n",
+			want: []string{"2:21: strictMetrics[1]: invalid metric name \"a-b\""},
+		},
+		{
+			name: "anonymize without salt",
+			in:   "version: v1\nanonymize:\n  labels: [instance]\n",
+			want: []string{"3:3: anonymize: salt or saltFile must be set"},
+		},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.in))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not contain %q", err.Error(), want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package forwarder
+
+import (
+	"sync"
+	"time"
+)
+
+// Cycle describes a federation cycle of the worker.
+type Cycle struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Error string    `json:"error,omitempty"`
+	// Fetched is the number of series retrieved from the sources, Filtered the
+	// number dropped before sending, and Sent the number sent to at least one
+	// destination.
+	Fetched        int                 `json:"fetched"`
+	Filtered       int                 `json:"filtered"`
+	Sent           int                 `json:"sent"`
+	RecordingRules []RuleResult        `json:"recordingRules"`
+	Destinations   []DestinationStatus `json:"destinations"`
+}
+
+// lastCycle holds the last completed cycle. It has its own lock so that it can
+// be read while the next cycle is in progress.
+type lastCycle struct {
+	lock  sync.Mutex
+	cycle Cycle
+}
+
+func (l *lastCycle) set(c Cycle) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.cycle = c
+}
+
+func (l *lastCycle) get() Cycle {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.cycle
+}
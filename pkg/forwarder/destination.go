@@ -0,0 +1,413 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	clientmodel "github.com/prometheus/client_model/go"
+
+	metricshttp "github.com/stolostron/metrics-collector/pkg/http"
+	rlogger "github.com/stolostron/metrics-collector/pkg/logger"
+	"github.com/stolostron/metrics-collector/pkg/metricfamily"
+	"github.com/stolostron/metrics-collector/pkg/metricsclient"
+	"github.com/stolostron/metrics-collector/pkg/wal"
+)
+
+var (
+	counterDestinationPushes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "federate_destination_pushes_total",
+		Help: "The number of pushes to each destination, by result",
+	}, []string{"destination", "result"})
+	gaugeDestinationLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "federate_destination_last_success_timestamp_seconds",
+		Help: "The time of the last successful push to each destination",
+	}, []string{"destination"})
+	gaugeDestinationSamples = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "federate_destination_samples",
+		Help: "Tracks the number of samples pushed to each destination per federation",
+	}, []string{"destination"})
+	histogramPushDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "federate_destination_push_duration_seconds",
+		Help:    "The time spent pushing the metrics of a federation to each destination, retries included",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+	}, []string{"destination"})
+	counterDestinationBatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "federate_destination_batches_total",
+		Help: "The number of remote write requests sent to each destination, by result",
+	}, []string{"destination", "result"})
+	histogramBatchBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "federate_destination_batch_bytes",
+		Help:    "The compressed size of the remote write requests sent to each destination",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 9),
+	}, []string{"destination"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		counterDestinationPushes, gaugeDestinationLastSuccess, gaugeDestinationSamples,
+		histogramPushDuration, counterDestinationBatches, histogramBatchBytes,
+	)
+}
+
+// defaultMetadataCycles is the number of cycles between two sends of the metadata
+// of the families if not configured.
+const defaultMetadataCycles = 10
+
+// Destination is a remote write endpoint the collected metrics are pushed to.
+type Destination struct {
+	// Name identifies the destination in logs, metrics and status.
+	// It defaults to the host of the URL and must be unique.
+	Name string
+	URL  *url.URL
+
+	// CAFile is used to verify an https destination, it defaults to the system
+	// roots certificates. If CertFile and KeyFile are set, the client
+	// authenticates with mutual TLS.
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool
+
+	// Token or TokenFile is a bearer token sent to the destination.
+	Token     string
+	TokenFile string
+
+	// Headers are added to every request sent to the destination.
+	Headers map[string]string
+	// Match is an allow-list of series selectors. If set, only the series matching
+	// at least one of them are sent to the destination.
+	Match []string
+	// MaxRetryDuration bounds the time spent retrying a request.
+	// It defaults to a fraction of the interval.
+	MaxRetryDuration time.Duration
+	// RequestTimeout bounds every attempt to send a request, and MinBackoff and
+	// MaxBackoff the delay between two attempts. They default to the ones of the Config.
+	RequestTimeout time.Duration
+	MinBackoff     time.Duration
+	MaxBackoff     time.Duration
+	// RemoteWriteVersion is the version of the remote write protocol, it
+	// defaults to the one of the Config.
+	RemoteWriteVersion metricsclient.RemoteWriteVersion
+}
+
+// DestinationStatus reports the outcome of the pushes to a destination.
+type DestinationStatus struct {
+	Name        string    `json:"name"`
+	URL         string    `json:"url"`
+	LastSuccess time.Time `json:"lastSuccess"`
+	LastError   string    `json:"lastError,omitempty"`
+	// Batches are the outcomes of the write requests of the last push, and
+	// Summary sums them up.
+	Batches []metricsclient.BatchResult `json:"batches"`
+	Summary *metricsclient.WriteSummary `json:"summary,omitempty"`
+}
+
+type destination struct {
+	name        string
+	url         *url.URL
+	client      *metricsclient.Client
+	transformer metricfamily.Transformer
+	queue       *wal.Queue
+	// certificates is set for https destinations.
+	certificates *metricsclient.CertificateReloader
+	logger       log.Logger
+
+	mu          sync.Mutex
+	lastSuccess time.Time
+	lastErr     error
+	batches     []metricsclient.BatchResult
+	summary     *metricsclient.WriteSummary
+}
+
+func newDestination(cfg Config, d Destination, interval time.Duration, logger log.Logger) (*destination, error) {
+	if d.URL == nil {
+		return nil, fmt.Errorf("destination %q has no URL", d.Name)
+	}
+	version := d.RemoteWriteVersion
+	if len(version) == 0 {
+		version = cfg.RemoteWriteVersion
+	}
+	version, err := metricsclient.ParseRemoteWriteVersion(string(version))
+	if err != nil {
+		return nil, fmt.Errorf("destination %s: %v", d.Name, err)
+	}
+
+	transport := metricsclient.DefaultTransport(logger, false)
+	var certificates *metricsclient.CertificateReloader
+	if d.URL.Scheme == "https" {
+		var err error
+		certificates, err = metricsclient.NewCertificateReloader(logger, metricsclient.TLSOptions{
+			CAFile:             d.CAFile,
+			CertFile:           d.CertFile,
+			KeyFile:            d.KeyFile,
+			ServerName:         d.ServerName,
+			InsecureSkipVerify: d.InsecureSkipVerify,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("destination %s: %v", d.Name, err)
+		}
+		transport = certificates.Transport()
+	}
+	transport.Proxy = http.ProxyFromEnvironment
+	client := &http.Client{Transport: transport}
+	if cfg.Debug {
+		client.Transport = metricshttp.NewDebugRoundTripper(logger, client.Transport)
+	}
+	if len(d.Headers) > 0 {
+		client.Transport = metricshttp.NewHeaderRoundTripper(d.Headers, client.Transport)
+	}
+	token := d.Token
+	if len(token) == 0 && len(d.TokenFile) > 0 {
+		data, err := ioutil.ReadFile(d.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("destination %s: unable to read token file: %v", d.Name, err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if len(token) > 0 {
+		client.Transport = metricshttp.NewBearerRoundTripper(token, client.Transport)
+	}
+
+	policy := metricsclient.RetryPolicy{
+		MaxElapsedTime: d.MaxRetryDuration,
+		MinBackoff:     d.MinBackoff,
+		MaxBackoff:     d.MaxBackoff,
+		RequestTimeout: d.RequestTimeout,
+	}
+	if policy.MinBackoff == 0 {
+		policy.MinBackoff = cfg.RemoteWriteMinBackoff
+	}
+	if policy.MaxBackoff == 0 {
+		policy.MaxBackoff = cfg.RemoteWriteMaxBackoff
+	}
+	if policy.RequestTimeout == 0 {
+		policy.RequestTimeout = cfg.RemoteWriteTimeout
+	}
+
+	batch := metricsclient.BatchPolicy{
+		MaxSeries:   cfg.RemoteWriteBatchSeries,
+		MaxBytes:    cfg.RemoteWriteBatchBytes,
+		Concurrency: cfg.RemoteWriteConcurrency,
+	}
+
+	dest := &destination{
+		name: d.Name,
+		url:  d.URL,
+		client: metricsclient.New(logger, client, cfg.LimitBytes, interval, "federate_to").
+			WithRetryPolicy(policy).
+			WithBatchPolicy(batch).
+			WithRemoteWriteVersion(version),
+		certificates: certificates,
+		logger:       log.With(logger, "destination", d.Name),
+	}
+	dest.client.WithBatchObserver(dest.observeBatch).WithSummaryObserver(dest.observeSummary)
+	if !cfg.DisableMetadata {
+		cycles := cfg.MetadataCycles
+		if cycles <= 0 {
+			cycles = defaultMetadataCycles
+		}
+		dest.client.WithMetadata(cycles)
+	}
+
+	if len(d.Match) > 0 {
+		dest.transformer, err = metricfamily.NewWhitelist(d.Match)
+		if err != nil {
+			return nil, fmt.Errorf("destination %s: invalid match rule: %v", d.Name, err)
+		}
+	}
+
+	if len(cfg.WALDir) > 0 {
+		dest.queue, err = wal.New(logger, d.Name, filepath.Join(cfg.WALDir, d.Name), cfg.WALMaxBytes, cfg.WALMaxAge)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dest, nil
+}
+
+// destinations returns the configured destinations, including the one set with
+// ToUpload, with their names defaulted and checked for uniqueness.
+func destinations(cfg Config) ([]Destination, error) {
+	var ds []Destination
+	if cfg.ToUpload != nil {
+		ds = append(ds, Destination{
+			URL:                cfg.ToUpload,
+			CAFile:             cfg.ToCAFile,
+			CertFile:           cfg.ToCertFile,
+			KeyFile:            cfg.ToKeyFile,
+			ServerName:         cfg.ToServerName,
+			InsecureSkipVerify: cfg.ToInsecureSkipVerify,
+			Token:              cfg.ToToken,
+			TokenFile:          cfg.ToTokenFile,
+		})
+	}
+	ds = append(ds, cfg.Destinations...)
+
+	names := make(map[string]struct{})
+	for i := range ds {
+		if len(ds[i].Name) == 0 && ds[i].URL != nil {
+			ds[i].Name = ds[i].URL.Host
+		}
+		if !validDestinationName(ds[i].Name) {
+			return nil, fmt.Errorf("invalid destination name %q, destinations names must be a single path segment", ds[i].Name)
+		}
+		if _, ok := names[ds[i].Name]; ok {
+			return nil, fmt.Errorf("duplicate destination name %q, destinations must have unique names", ds[i].Name)
+		}
+		names[ds[i].Name] = struct{}{}
+	}
+	return ds, nil
+}
+
+// validDestinationName returns whether the name can be used as the directory of
+// the write-ahead queue of the destination.
+func validDestinationName(name string) bool {
+	return name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+// send pushes the families to the destination. When a write-ahead queue is
+// configured, previously queued requests are replayed first so that samples are
+// sent oldest-first, and any request that cannot be delivered is queued.
+func (d *destination) send(ctx context.Context, families []*clientmodel.MetricFamily, interval time.Duration) error {
+	d.mu.Lock()
+	d.batches = nil
+	d.summary = nil
+	d.mu.Unlock()
+	start := time.Now()
+	defer func() {
+		histogramPushDuration.WithLabelValues(d.name).Observe(time.Since(start).Seconds())
+	}()
+
+	if d.transformer != nil {
+		// Transformers modify the families in place, filter a copy shared by no other destination.
+		filtered := make([]*clientmodel.MetricFamily, 0, len(families))
+		for _, f := range families {
+			filtered = append(filtered, proto.Clone(f).(*clientmodel.MetricFamily))
+		}
+		if err := metricfamily.Filter(filtered, d.transformer); err != nil {
+			return d.record(err)
+		}
+		families = metricfamily.Pack(filtered)
+	}
+	gaugeDestinationSamples.WithLabelValues(d.name).Set(float64(metricfamily.MetricsCount(families)))
+
+	req := &http.Request{Method: "POST", URL: d.url}
+	if d.queue == nil {
+		return d.record(d.client.RemoteWrite(ctx, req, families, interval))
+	}
+
+	err := d.queue.Replay(func(data []byte) error {
+		err := d.client.SendBatch(ctx, req, data, interval/2)
+		var rejected *metricsclient.RejectedError
+		if errors.As(err, &rejected) {
+			// Replaying it again would fail the same way.
+			rlogger.Log(d.logger, rlogger.Warn, "msg", "dropping queued write request rejected by the receiver", "err", err)
+			return fmt.Errorf("%w: %v", wal.ErrRejected, err)
+		}
+		return err
+	})
+	if err == nil {
+		err = d.client.RemoteWrite(ctx, req, families, interval)
+	} else {
+		// The endpoint is still unavailable, queue the new requests behind the old ones.
+		rlogger.Log(d.logger, rlogger.Warn, "msg", "failed to replay queued write requests", "err", err)
+		batches, encodeErr := d.client.EncodeWriteRequests(families)
+		if encodeErr != nil {
+			return d.record(encodeErr)
+		}
+		err = &metricsclient.UnsentError{Batches: batches, Err: err}
+	}
+
+	var unsent *metricsclient.UnsentError
+	if errors.As(err, &unsent) {
+		for _, data := range unsent.Batches {
+			if queueErr := d.queue.Append(data); queueErr != nil {
+				rlogger.Log(d.logger, rlogger.Error, "msg", "failed to queue write request", "err", queueErr)
+			}
+		}
+		rlogger.Log(d.logger, rlogger.Warn, "msg", "queued write requests for replay", "count", len(unsent.Batches))
+	}
+	return d.record(err)
+}
+
+// certificateExpiry returns the expiry time of the client certificate if it
+// expires within the warning period, or the zero time otherwise.
+func (d *destination) certificateExpiry(now time.Time) time.Time {
+	if d.certificates == nil {
+		return time.Time{}
+	}
+	expiry := d.certificates.Expiry()
+	if expiry.IsZero() || expiry.Sub(now) >= metricsclient.CertificateExpiryWarning {
+		return time.Time{}
+	}
+	return expiry
+}
+
+// record keeps track of the outcome of a push.
+func (d *destination) record(err error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lastErr = err
+	if err != nil {
+		counterDestinationPushes.WithLabelValues(d.name, "failure").Inc()
+		rlogger.Log(d.logger, rlogger.Warn, "msg", "failed to send metrics", "err", err)
+		return err
+	}
+	d.lastSuccess = time.Now()
+	counterDestinationPushes.WithLabelValues(d.name, "success").Inc()
+	gaugeDestinationLastSuccess.WithLabelValues(d.name).Set(float64(d.lastSuccess.Unix()))
+	return nil
+}
+
+// observeBatch records the outcome of a write request of the current push.
+func (d *destination) observeBatch(r metricsclient.BatchResult) {
+	result := "success"
+	if r.Rejected {
+		result = "rejected"
+	} else if len(r.Error) > 0 {
+		result = "failure"
+	}
+	counterDestinationBatches.WithLabelValues(d.name, result).Inc()
+	histogramBatchBytes.WithLabelValues(d.name).Observe(float64(r.Bytes))
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.batches = append(d.batches, r)
+}
+
+// observeSummary records the outcome of the write requests of the current push.
+func (d *destination) observeSummary(s metricsclient.WriteSummary) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.summary = &s
+}
+
+func (d *destination) status() DestinationStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s := DestinationStatus{
+		Name:        d.name,
+		URL:         d.url.Redacted(),
+		LastSuccess: d.lastSuccess,
+		Batches:     append([]metricsclient.BatchResult(nil), d.batches...),
+		Summary:     d.summary,
+	}
+	if d.lastErr != nil {
+		s.LastError = d.lastErr.Error()
+	}
+	return s
+}
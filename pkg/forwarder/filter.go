@@ -0,0 +1,100 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package forwarder
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/stolostron/metrics-collector/pkg/metricfamily"
+)
+
+var (
+	// A series dropped by the allow-list matches none of its rules, so it is only
+	// counted against the source, while a denied series is counted against the
+	// deny rule matching it.
+	counterUnmatchedSeries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "federate_unmatched_series_total",
+		Help: "The number of series of each source dropped because they match none of its match rules",
+	}, []string{"source"})
+	counterDroppedSeries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "federate_dropped_series_total",
+		Help: "The number of series dropped by each deny rule",
+	}, []string{"rule"})
+)
+
+func init() {
+	prometheus.MustRegister(counterUnmatchedSeries, counterDroppedSeries)
+}
+
+// newAllowFilter returns a transformer enforcing locally the match rules of a
+// source, so that no series outside of them is forwarded even if the source
+// does not honour them. The metrics generated by its recording rules are allowed
+// by their name. It returns nil if the source has no match rules.
+func newAllowFilter(name string, rules []string, recordingRules []RecordingRule) (metricfamily.Transformer, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	allow := append([]string(nil), rules...)
+	for _, r := range recordingRules {
+		allow = append(allow, fmt.Sprintf("{__name__=%s}", strconv.Quote(r.Name)))
+	}
+	t, err := metricfamily.NewWhitelist(allow)
+	if err != nil {
+		return nil, fmt.Errorf("invalid match rule of source %q: %v", name, err)
+	}
+	var filter metricfamily.MultiTransformer
+	filter.With(countDropped{Transformer: t, counter: counterUnmatchedSeries.WithLabelValues(name)})
+	filter.With(metricfamily.TransformerFunc(metricfamily.PackMetrics))
+	return filter, nil
+}
+
+// newDenyFilter returns a transformer dropping the series matching any of the
+// deny rules, whichever source they come from.
+func newDenyFilter(denyRules []string) (metricfamily.Transformer, error) {
+	var filter metricfamily.MultiTransformer
+
+	// Each deny rule is a transformer of its own to count the series it drops.
+	for _, rule := range denyRules {
+		t, err := metricfamily.NewDenylist([]string{rule})
+		if err != nil {
+			return nil, fmt.Errorf("invalid deny rule %q: %v", rule, err)
+		}
+		filter.With(countDropped{Transformer: t, counter: counterDroppedSeries.WithLabelValues(rule)})
+	}
+	filter.With(metricfamily.TransformerFunc(metricfamily.PackMetrics))
+	return filter, nil
+}
+
+// countDropped counts the series dropped by the wrapped transformer.
+type countDropped struct {
+	metricfamily.Transformer
+	counter prometheus.Counter
+}
+
+func (t countDropped) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	before := countSeries(family)
+	ok, err := t.Transformer.Transform(family)
+	if err != nil {
+		return ok, err
+	}
+	after := 0
+	if ok {
+		after = countSeries(family)
+	}
+	t.counter.Add(float64(before - after))
+	return ok, nil
+}
+
+func countSeries(family *clientmodel.MetricFamily) int {
+	count := 0
+	for _, m := range family.Metric {
+		if m != nil {
+			count++
+		}
+	}
+	return count
+}
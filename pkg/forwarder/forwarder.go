@@ -4,15 +4,12 @@ package forwarder
 
 import (
 	"context"
-	"crypto/tls"
-	"crypto/x509"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -22,12 +19,12 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	clientmodel "github.com/prometheus/client_model/go"
 
-	metricshttp "github.com/stolostron/metrics-collector/pkg/http"
 	rlogger "github.com/stolostron/metrics-collector/pkg/logger"
 	"github.com/stolostron/metrics-collector/pkg/metricfamily"
 	"github.com/stolostron/metrics-collector/pkg/metricsclient"
 	"github.com/stolostron/metrics-collector/pkg/simulator"
 	"github.com/stolostron/metrics-collector/pkg/status"
+	"github.com/stolostron/metrics-collector/pkg/wal"
 )
 
 const (
@@ -43,9 +40,27 @@ var (
 		Name: "federate_filtered_samples",
 		Help: "Tracks the number of samples filtered per federation",
 	})
+	counterFederateErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "federate_errors_total",
+		Help: "The number of times forwarding federated metrics has failed",
+	})
+	// gaugeFederateErrors is only exposed if registered with RegisterLegacyMetrics.
 	gaugeFederateErrors = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "federate_errors",
-		Help: "The number of times forwarding federated metrics has failed",
+		Help: "The number of times forwarding federated metrics has failed. Deprecated, use federate_errors_total",
+	})
+	histogramTransformDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "federate_transform_duration_seconds",
+		Help:    "The time spent filtering and transforming the federated metrics",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+	})
+	counterCardinalityDroppedSeries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "federate_cardinality_dropped_series_total",
+		Help: "The number of series dropped by the cardinality limits, by metric and the label with the most values",
+	}, []string{"metric", "label"})
+	gaugeCardinalityViolations = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "federate_cardinality_violations",
+		Help: "The number of cardinality limits exceeded in the last federation",
 	})
 )
 
@@ -55,12 +70,44 @@ type RuleMatcher interface {
 
 func init() {
 	prometheus.MustRegister(
-		gaugeFederateErrors, gaugeFederateSamples, gaugeFederateFilteredSamples,
+		counterFederateErrors, gaugeFederateSamples, gaugeFederateFilteredSamples,
+		counterCardinalityDroppedSeries, gaugeCardinalityViolations, histogramTransformDuration,
 	)
 }
 
+// RegisterLegacyMetrics registers the metrics replaced by correctly typed ones,
+// for dashboards that still rely on them.
+func RegisterLegacyMetrics(r prometheus.Registerer) error {
+	if err := r.Register(gaugeFederateErrors); err != nil {
+		return err
+	}
+	return metricsclient.RegisterLegacyMetrics(r)
+}
+
+// RecordingRule generates a new metric named Name from the result of the Query expression.
+type RecordingRule struct {
+	Name  string `json:"name"`
+	Query string `json:"query"`
+	// Type is the type of the generated metric: gauge, counter or untyped, the default.
+	Type string `json:"type,omitempty"`
+}
+
+// MetricType returns the type of the metric generated by the rule.
+func (r RecordingRule) MetricType() (clientmodel.MetricType, error) {
+	switch r.Type {
+	case "", "untyped":
+		return clientmodel.MetricType_UNTYPED, nil
+	case "gauge":
+		return clientmodel.MetricType_GAUGE, nil
+	case "counter":
+		return clientmodel.MetricType_COUNTER, nil
+	default:
+		return 0, fmt.Errorf("unsupported type %q for recording rule %s, must be gauge, counter or untyped", r.Type, r.Name)
+	}
+}
+
 // Config defines the parameters that can be used to configure a worker.
-// The only required field is `From`.
+// At least one source is required, either `From` or one of `Sources`.
 type Config struct {
 	From          *url.URL
 	ToUpload      *url.URL
@@ -68,6 +115,19 @@ type Config struct {
 	FromTokenFile string
 	FromCAFile    string
 
+	// ToCAFile, ToCertFile and ToKeyFile are the TLS material used to connect to
+	// `ToUpload`. The client authenticates with mutual TLS if a certificate and a
+	// key are set, and the server is verified against the system roots
+	// certificates if no CA is set.
+	ToCAFile             string
+	ToCertFile           string
+	ToKeyFile            string
+	ToServerName         string
+	ToInsecureSkipVerify bool
+	// ToToken or ToTokenFile is a bearer token sent to `ToUpload`.
+	ToToken     string
+	ToTokenFile string
+
 	AnonymizeLabels   []string
 	AnonymizeSalt     string
 	AnonymizeSaltFile string
@@ -75,9 +135,65 @@ type Config struct {
 	Interval          time.Duration
 	LimitBytes        int64
 	Rules             []string
-	RecordingRules    []string
+	RecordingRules    []RecordingRule
 	RulesFile         string
-	Transformer       metricfamily.Transformer
+	// RecordingRuleConcurrency bounds the number of recording rules of a source
+	// evaluated at the same time, 4 if not set. RecordingRuleTimeout bounds each
+	// evaluation, which is otherwise only bounded by the interval.
+	RecordingRuleConcurrency int
+	RecordingRuleTimeout     time.Duration
+	// LocalRecordingRules evaluates the recording rules over the federated series
+	// with an embedded promql engine, instead of the query API of the sources.
+	LocalRecordingRules bool
+	// DenyRules are series selectors dropped before forwarding. The match rules
+	// of the sources are also enforced locally.
+	DenyRules []string
+	// Transformer is applied to the families of every source as they are
+	// decoded, so it must be safe for concurrent use.
+	Transformer metricfamily.Transformer
+	// CardinalityLimits bounds the number of series forwarded, globally and per metric name.
+	CardinalityLimits metricfamily.CardinalityLimits
+	// PartialResponses decides what happens to truncated or malformed responses
+	// of the sources. They are discarded by default.
+	PartialResponses PartialResponsePolicy
+
+	// Sources are the Prometheus servers metrics are federated from in addition to `From`.
+	Sources []Source
+	// SourceLabel is the name of a label set to the name of the source on every
+	// federated series. No label is added if empty.
+	SourceLabel string
+
+	// Destinations are the endpoints metrics are pushed to in addition to `ToUpload`.
+	Destinations []Destination
+	// RemoteWriteVersion is the version of the remote write protocol used by
+	// the destinations, 1.0 if not set. With 2.0, a destination falls back to
+	// 1.0 when it answers 415 Unsupported Media Type.
+	RemoteWriteVersion metricsclient.RemoteWriteVersion
+	// RemoteWriteTimeout bounds every attempt to send a write request, 30s if not
+	// set. RemoteWriteMinBackoff and RemoteWriteMaxBackoff bound the delay between
+	// two attempts, 500ms and 1m if not set.
+	RemoteWriteTimeout    time.Duration
+	RemoteWriteMinBackoff time.Duration
+	RemoteWriteMaxBackoff time.Duration
+	// RemoteWriteBatchSeries and RemoteWriteBatchBytes bound the number of series
+	// and the uncompressed size of a write request, 10000 series and unbounded if
+	// not set. RemoteWriteConcurrency is the number of requests sent at the same
+	// time to a destination, 4 if not set.
+	RemoteWriteBatchSeries int
+	RemoteWriteBatchBytes  int
+	RemoteWriteConcurrency int
+	// MetadataCycles is the number of cycles between two sends of the type and
+	// help of the metrics, 10 if not set. DisableMetadata never sends them with
+	// remote write 1.0.
+	MetadataCycles  int
+	DisableMetadata bool
+
+	// WALDir is the directory where write requests that could not be sent are
+	// queued until the endpoint recovers, in a sub-directory per destination.
+	// Queuing is disabled if empty.
+	WALDir      string
+	WALMaxBytes int64
+	WALMaxAge   time.Duration
 
 	Logger                  log.Logger
 	SimulatedTimeseriesFile string
@@ -87,15 +203,14 @@ type Config struct {
 // A Worker should be configured with a `Config` and instantiated with the `New` func.
 // Workers are thread safe; all access to shared fields are synchronized.
 type Worker struct {
-	fromClient *metricsclient.Client
-	toClient   *metricsclient.Client
-	from       *url.URL
-	to         *url.URL
+	sources      []*source
+	sourceLabel  string
+	destinations []*destination
 
-	interval       time.Duration
-	transformer    metricfamily.Transformer
-	rules          []string
-	recordingRules []string
+	interval    time.Duration
+	filter      metricfamily.Transformer
+	transformer metricfamily.Transformer
+	limiter     *metricfamily.CardinalityLimiter
 
 	lastMetrics []*clientmodel.MetricFamily
 	lock        sync.Mutex
@@ -106,10 +221,15 @@ type Worker struct {
 	simulatedTimeseriesFile string
 
 	status status.StatusReport
+	health *health
+
+	// current is the cycle in progress, last the last one completed.
+	current Cycle
+	last    *lastCycle
 }
 
 func createClients(cfg Config, interval time.Duration,
-	logger log.Logger) (*metricsclient.Client, *metricsclient.Client, metricfamily.MultiTransformer, error) {
+	logger log.Logger) ([]*source, []*destination, metricfamily.MultiTransformer, error) {
 
 	var transformer metricfamily.MultiTransformer
 
@@ -137,72 +257,58 @@ func createClients(cfg Config, interval time.Duration,
 		transformer.With(metricfamily.NewMetricsAnonymizer(anonymizeSalt, cfg.AnonymizeLabels, nil))
 	}
 
-	fromTransport := metricsclient.DefaultTransport(logger, false)
-	if len(cfg.FromCAFile) > 0 {
-		if fromTransport.TLSClientConfig == nil {
-			fromTransport.TLSClientConfig = &tls.Config{
-				MinVersion: tls.VersionTLS12,
-			}
-		}
-		pool, err := x509.SystemCertPool()
-		if err != nil {
-			return nil, nil, transformer, fmt.Errorf("failed to read system certificates: %v", err)
-		}
-		data, err := ioutil.ReadFile(cfg.FromCAFile)
-		if err != nil {
-			return nil, nil, transformer, fmt.Errorf("failed to read from-ca-file: %v", err)
-		}
-		if !pool.AppendCertsFromPEM(data) {
-			rlogger.Log(logger, rlogger.Warn, "msg", "no certs found in from-ca-file")
-		}
-		fromTransport.TLSClientConfig.RootCAs = pool
-	}
-
-	// Create the `fromClient`.
-	fromClient := &http.Client{Transport: fromTransport}
-	if cfg.Debug {
-		fromClient.Transport = metricshttp.NewDebugRoundTripper(logger, fromClient.Transport)
+	// Create a client per source.
+	ss, err := sources(cfg)
+	if err != nil {
+		return nil, nil, transformer, err
 	}
-	if len(cfg.FromToken) == 0 && len(cfg.FromTokenFile) > 0 {
-		data, err := ioutil.ReadFile(cfg.FromTokenFile)
+	var from []*source
+	for _, s := range ss {
+		src, err := newSource(cfg, s, interval, logger)
 		if err != nil {
-			return nil, nil, transformer, fmt.Errorf("unable to read from-token-file: %v", err)
+			return nil, nil, transformer, err
 		}
-		cfg.FromToken = strings.TrimSpace(string(data))
-	}
-	if len(cfg.FromToken) > 0 {
-		fromClient.Transport = metricshttp.NewBearerRoundTripper(cfg.FromToken, fromClient.Transport)
+		from = append(from, src)
 	}
-	from := metricsclient.New(logger, fromClient, cfg.LimitBytes, interval, "federate_from")
 
-	// Create the `toClient`.
-
-	toTransport, err := metricsclient.MTLSTransport(logger)
+	// Create a client per destination.
+	ds, err := destinations(cfg)
 	if err != nil {
-		return nil, nil, transformer, errors.New(err.Error())
+		return nil, nil, transformer, err
 	}
-	toTransport.Proxy = http.ProxyFromEnvironment
-	toClient := &http.Client{Transport: toTransport}
-	if cfg.Debug {
-		toClient.Transport = metricshttp.NewDebugRoundTripper(logger, toClient.Transport)
+	var to []*destination
+	for i, d := range ds {
+		// The queue of the first destination used to be at the root of the
+		// directory, when there was a single destination.
+		if i == 0 && len(cfg.WALDir) > 0 {
+			moved, err := wal.Migrate(cfg.WALDir, filepath.Join(cfg.WALDir, d.Name))
+			if err != nil {
+				return nil, nil, transformer, fmt.Errorf("destination %s: %v", d.Name, err)
+			}
+			if moved > 0 {
+				rlogger.Log(logger, rlogger.Info, "msg", "moved the queued write requests into the queue of the destination", "destination", d.Name, "batches", moved)
+			}
+		}
+		dest, err := newDestination(cfg, d, interval, logger)
+		if err != nil {
+			return nil, nil, transformer, err
+		}
+		to = append(to, dest)
 	}
-	to := metricsclient.New(logger, toClient, cfg.LimitBytes, interval, "federate_to")
 	return from, to, transformer, nil
 }
 
 // New creates a new Worker based on the provided Config. If the Config contains invalid
 // values, then an error is returned.
 func New(cfg Config) (*Worker, error) {
-	if cfg.From == nil {
+	if cfg.From == nil && len(cfg.Sources) == 0 {
 		return nil, errors.New("a URL from which to scrape is required")
 	}
 	logger := log.With(cfg.Logger, "component", "forwarder")
-	rlogger.Log(logger, rlogger.Warn, "msg", cfg.ToUpload)
 	w := Worker{
-		from:                    cfg.From,
+		sourceLabel:             cfg.SourceLabel,
 		interval:                cfg.Interval,
 		reconfigure:             make(chan struct{}),
-		to:                      cfg.ToUpload,
 		logger:                  log.With(cfg.Logger, "component", "forwarder/worker"),
 		simulatedTimeseriesFile: cfg.SimulatedTimeseriesFile,
 	}
@@ -211,52 +317,29 @@ func New(cfg Config) (*Worker, error) {
 		w.interval = 4*time.Minute + 30*time.Second
 	}
 
-	fromClient, toClient, transformer, err := createClients(cfg, w.interval, logger)
+	sources, destinations, transformer, err := createClients(cfg, w.interval, logger)
 	if err != nil {
 		return nil, err
 	}
-	w.fromClient = fromClient
-	w.toClient = toClient
+	w.sources = sources
+	w.destinations = destinations
 	w.transformer = transformer
 
-	// Configure the matching rules.
-	rules := cfg.Rules
-	if len(cfg.RulesFile) > 0 {
-		data, err := ioutil.ReadFile(cfg.RulesFile)
-		if err != nil {
-			return nil, fmt.Errorf("unable to read match-file: %v", err)
-		}
-		rules = append(rules, strings.Split(string(data), "\n")...)
+	w.filter, err = newDenyFilter(cfg.DenyRules)
+	if err != nil {
+		return nil, err
 	}
-	for i := 0; i < len(rules); {
-		s := strings.TrimSpace(rules[i])
-		if len(s) == 0 {
-			rules = append(rules[:i], rules[i+1:]...)
-			continue
-		}
-		rules[i] = s
-		i++
+	if cfg.CardinalityLimits.Enabled() {
+		w.limiter = metricfamily.NewCardinalityLimiter(cfg.CardinalityLimits)
 	}
-	w.rules = rules
-
-	// Configure the recording rules.
-	recordingRules := cfg.RecordingRules
-	for i := 0; i < len(recordingRules); {
-		s := strings.TrimSpace(recordingRules[i])
-		if len(s) == 0 {
-			recordingRules = append(recordingRules[:i], recordingRules[i+1:]...)
-			continue
-		}
-		recordingRules[i] = s
-		i++
-	}
-	w.recordingRules = recordingRules
 
 	s, err := status.New(logger)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create StatusReport: %v", err)
 	}
 	w.status = *s
+	w.health = &health{}
+	w.last = &lastCycle{}
 
 	return &w, nil
 }
@@ -272,14 +355,13 @@ func (w *Worker) Reconfigure(cfg Config) error {
 	w.lock.Lock()
 	defer w.lock.Unlock()
 
-	w.fromClient = worker.fromClient
-	w.toClient = worker.toClient
+	w.sources = worker.sources
+	w.sourceLabel = worker.sourceLabel
+	w.destinations = worker.destinations
 	w.interval = worker.interval
-	w.from = worker.from
-	w.to = worker.to
+	w.filter = worker.filter
 	w.transformer = worker.transformer
-	w.rules = worker.rules
-	w.recordingRules = worker.recordingRules
+	w.limiter = worker.limiter
 
 	// Signal a restart to Run func.
 	// Do this in a goroutine since we do not care if restarting the Run loop is asynchronous.
@@ -287,6 +369,34 @@ func (w *Worker) Reconfigure(cfg Config) error {
 	return nil
 }
 
+// Destinations reports the outcome of the last push to each destination.
+func (w *Worker) Destinations() []DestinationStatus {
+	w.lock.Lock()
+	destinations := w.destinations
+	w.lock.Unlock()
+
+	var statuses []DestinationStatus
+	for _, d := range destinations {
+		statuses = append(statuses, d.status())
+	}
+	return statuses
+}
+
+// LastCycle reports the last completed cycle.
+func (w *Worker) LastCycle() Cycle {
+	return w.last.get()
+}
+
+// Condition reports the last condition written to the addon status.
+func (w *Worker) Condition() status.Condition {
+	return w.status.Condition()
+}
+
+// Health reports the progress of the worker.
+func (w *Worker) Health() Health {
+	return w.health.get()
+}
+
 func (w *Worker) LastMetrics() []*clientmodel.MetricFamily {
 	w.lock.Lock()
 	defer w.lock.Unlock()
@@ -294,14 +404,20 @@ func (w *Worker) LastMetrics() []*clientmodel.MetricFamily {
 }
 
 func (w *Worker) Run(ctx context.Context) {
+	w.health.update(func(h *Health) { h.Started = time.Now() })
 	for {
 		// Ensure that the Worker does not access critical configuration during a reconfiguration.
 		w.lock.Lock()
 		wait := w.interval
 		// The critical section ends here.
 		w.lock.Unlock()
+		w.health.update(func(h *Health) { h.Interval = Duration(wait) })
 
-		if err := w.forward(ctx); err != nil {
+		err := w.forward(ctx)
+		w.health.cycle(time.Now(), err)
+		w.finishCycle(err)
+		if err != nil {
+			counterFederateErrors.Inc()
 			gaugeFederateErrors.Inc()
 			rlogger.Log(w.logger, rlogger.Error, "msg", "unable to forward results", "err", err)
 			wait = time.Minute
@@ -318,12 +434,32 @@ func (w *Worker) Run(ctx context.Context) {
 	}
 }
 
+// finishCycle publishes the cycle that just completed.
+func (w *Worker) finishCycle(err error) {
+	w.lock.Lock()
+	c := w.current
+	destinations := w.destinations
+	w.lock.Unlock()
+
+	c.End = time.Now()
+	if err != nil {
+		c.Error = err.Error()
+	}
+	for _, d := range destinations {
+		c.Destinations = append(c.Destinations, d.status())
+	}
+	w.last.set(c)
+}
+
 func (w *Worker) forward(ctx context.Context) error {
 	w.lock.Lock()
 	defer w.lock.Unlock()
+	w.current = Cycle{Start: time.Now()}
 
 	var families []*clientmodel.MetricFamily
+	var before int
 	var err error
+	transformStart := time.Now()
 	if w.simulatedTimeseriesFile != "" {
 		families, err = simulator.FetchSimulatedTimeseries(w.simulatedTimeseriesFile)
 		if err != nil {
@@ -331,41 +467,48 @@ func (w *Worker) forward(ctx context.Context) error {
 		}
 	} else if os.Getenv("SIMULATE") == "true" {
 		families = simulator.SimulateMetrics(w.logger)
+	}
+	if w.simulatedTimeseriesFile != "" || os.Getenv("SIMULATE") == "true" {
+		before = metricfamily.MetricsCount(families)
+		if err := w.transform(families); err != nil {
+			return err
+		}
 	} else {
-		families, err = w.getFederateMetrics(ctx)
+		// The families of the sources are transformed as they are decoded.
+		var transformed time.Duration
+		families, before, transformed, err = w.getSourceMetrics(ctx)
 		if err != nil {
-			statusErr := w.status.UpdateStatus("Degraded", "Degraded", "Failed to retrieve metrics")
-			if statusErr != nil {
-				rlogger.Log(w.logger, rlogger.Warn, "msg", failedStatusReportMsg, "err", statusErr)
-			}
 			return err
 		}
+		w.health.update(func(h *Health) { h.LastScrape = time.Now() })
+		transformStart = time.Now().Add(-transformed)
+	}
 
-		rfamilies, err := w.getRecordingMetrics(ctx)
-		if err != nil {
-			statusErr := w.status.UpdateStatus("Degraded", "Degraded", "Failed to retrieve recording metrics")
-			if statusErr != nil {
-				rlogger.Log(w.logger, rlogger.Warn, "msg", failedStatusReportMsg, "err", statusErr)
+	var violations []metricfamily.CardinalityViolation
+	if w.limiter != nil {
+		if violations, err = w.limiter.Limit(families); err != nil {
+			return err
+		}
+		for _, v := range violations {
+			for _, d := range v.Dropped {
+				counterCardinalityDroppedSeries.WithLabelValues(d.Metric, d.Label).Add(float64(d.Series))
 			}
-		} else {
-			families = append(families, rfamilies...)
+			rlogger.Log(w.logger, rlogger.Warn, "msg", "cardinality limit exceeded, dropping series",
+				"metric", v.Metric, "label", v.Label, "series", v.Series, "limit", v.Limit, "global", v.Global)
 		}
-	}
-
-	before := metricfamily.MetricsCount(families)
-	if err := metricfamily.Filter(families, w.transformer); err != nil {
-		statusErr := w.status.UpdateStatus("Degraded", "Degraded", "Failed to filter metrics")
-		if statusErr != nil {
-			rlogger.Log(w.logger, rlogger.Warn, "msg", failedStatusReportMsg, "err", statusErr)
+		gaugeCardinalityViolations.Set(float64(len(violations)))
+		if err := metricfamily.Filter(families, metricfamily.TransformerFunc(metricfamily.PackMetrics)); err != nil {
+			return err
 		}
-		return err
 	}
 
 	families = metricfamily.Pack(families)
 	after := metricfamily.MetricsCount(families)
+	histogramTransformDuration.Observe(time.Since(transformStart).Seconds())
 
 	gaugeFederateSamples.Set(float64(before))
 	gaugeFederateFilteredSamples.Set(float64(before - after))
+	w.current.Fetched, w.current.Filtered = before, before-after
 
 	w.lastMetrics = families
 
@@ -378,7 +521,7 @@ func (w *Worker) forward(ctx context.Context) error {
 		return nil
 	}
 
-	if w.to == nil {
+	if len(w.destinations) == 0 {
 		rlogger.Log(w.logger, rlogger.Warn, "msg", "to is nil, doing nothing")
 		statusErr := w.status.UpdateStatus("Available", "Available", "Metrics is not required to send")
 		if statusErr != nil {
@@ -387,85 +530,179 @@ func (w *Worker) forward(ctx context.Context) error {
 		return nil
 	}
 
-	req := &http.Request{Method: "POST", URL: w.to}
-	err = w.toClient.RemoteWrite(ctx, req, families, w.interval)
-	if err != nil {
+	// Push to every destination concurrently, so that a slow or failing one does not hold back the others.
+	errs := make([]error, len(w.destinations))
+	var wg sync.WaitGroup
+	for i, d := range w.destinations {
+		wg.Add(1)
+		go func(i int, d *destination) {
+			defer wg.Done()
+			errs[i] = d.send(ctx, families, w.interval)
+		}(i, d)
+	}
+	wg.Wait()
+
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, w.destinations[i].name)
+		}
+	}
+	if len(failed) < len(w.destinations) {
+		w.health.update(func(h *Health) { h.LastPush = time.Now() })
+		w.current.Sent = after
+	}
+	switch {
+	case len(failed) == len(w.destinations):
 		statusErr := w.status.UpdateStatus("Degraded", "Degraded", "Failed to send metrics")
 		if statusErr != nil {
 			rlogger.Log(w.logger, rlogger.Warn, "msg", failedStatusReportMsg, "err", statusErr)
 		}
-	} else if w.simulatedTimeseriesFile == "" {
-		statusErr := w.status.UpdateStatus("Available", "Available", "Cluster metrics sent successfully")
+		// Only fail the cycle when no destination could be reached.
+		if len(errs) == 1 {
+			return errs[0]
+		}
+		return fmt.Errorf("failed to send metrics to all destinations: %s", strings.Join(failed, ", "))
+	case len(failed) > 0:
+		statusErr := w.status.UpdateStatus("Degraded", "Degraded", "Failed to send metrics to "+strings.Join(failed, ", "))
+		if statusErr != nil {
+			rlogger.Log(w.logger, rlogger.Warn, "msg", failedStatusReportMsg, "err", statusErr)
+		}
+	case w.simulatedTimeseriesFile == "":
+		msg := "Cluster metrics sent successfully"
+		var expiring []string
+		for _, d := range w.destinations {
+			if expiry := d.certificateExpiry(time.Now()); !expiry.IsZero() {
+				expiring = append(expiring, fmt.Sprintf("%s on %s", d.name, expiry.UTC().Format(time.RFC3339)))
+			}
+		}
+		if len(expiring) > 0 {
+			msg += ", client certificate expires soon: " + strings.Join(expiring, ", ")
+		}
+		if len(violations) > 0 {
+			// Series are being dropped, report it even though the push succeeded.
+			statusErr := w.status.UpdateStatus("Degraded", "Degraded", msg+", but "+describeViolations(violations))
+			if statusErr != nil {
+				rlogger.Log(w.logger, rlogger.Warn, "msg", failedStatusReportMsg, "err", statusErr)
+			}
+			break
+		}
+		statusErr := w.status.UpdateStatus("Available", "Available", msg)
 		if statusErr != nil {
 			rlogger.Log(w.logger, rlogger.Warn, "msg", failedStatusReportMsg, "err", statusErr)
 		}
 	}
 
-	return err
+	return nil
 }
 
-func (w *Worker) getFederateMetrics(ctx context.Context) ([]*clientmodel.MetricFamily, error) {
-	var families []*clientmodel.MetricFamily
-	var err error
-
-	// reset query from last invocation, otherwise match rules will be appended
-	from := w.from
-	from.RawQuery = ""
-	v := from.Query()
-	for _, rule := range w.rules {
-		v.Add("match[]", rule)
+// transform applies the filter and the transformer to families that were not
+// retrieved from the sources, such as simulated ones.
+func (w *Worker) transform(families []*clientmodel.MetricFamily) error {
+	for _, t := range []metricfamily.Transformer{w.filter, w.transformer} {
+		if err := metricfamily.Filter(families, t); err != nil {
+			statusErr := w.status.UpdateStatus("Degraded", "Degraded", "Failed to filter metrics")
+			if statusErr != nil {
+				rlogger.Log(w.logger, rlogger.Warn, "msg", failedStatusReportMsg, "err", statusErr)
+			}
+			return err
+		}
 	}
-	from.RawQuery = v.Encode()
+	return nil
+}
 
-	req := &http.Request{Method: "GET", URL: from}
-	families, err = w.fromClient.Retrieve(ctx, req)
-	if err != nil {
-		rlogger.Log(w.logger, rlogger.Warn, "msg", "Failed to retrieve metrics", "err", err)
-		return families, err
+// getSourceMetrics scrapes every source concurrently, filtering and transforming
+// the families as they are decoded. It returns the remaining families, along with
+// the number of series retrieved and the time spent transforming them. An
+// unreachable source is reported in the status but only fails the cycle when no
+// source could be scraped.
+func (w *Worker) getSourceMetrics(ctx context.Context) ([]*clientmodel.MetricFamily, int, time.Duration, error) {
+	var transformer metricfamily.MultiTransformer
+	transformer.With(w.filter)
+	transformer.With(w.transformer)
+
+	results := make([]fetchResult, len(w.sources))
+	var wg sync.WaitGroup
+	for i, s := range w.sources {
+		wg.Add(1)
+		go func(i int, s *source) {
+			defer wg.Done()
+			results[i] = s.fetch(ctx, w.sourceLabel, transformer)
+		}(i, s)
 	}
+	wg.Wait()
 
-	return families, nil
-}
-
-func (w *Worker) getRecordingMetrics(ctx context.Context) ([]*clientmodel.MetricFamily, error) {
 	var families []*clientmodel.MetricFamily
-	var e error
-
-	from := w.from
-	originPath := from.Path
-	from.Path = "/api/v1/query"
-	// Path /api/v1/query is only used in getRecordingMetrics(), reset to origin path before return.
-	defer func() {
-		w.from.Path = originPath
-	}()
-
-	for _, rule := range w.recordingRules {
-		var r map[string]string
-		err := json.Unmarshal(([]byte)(rule), &r)
-		if err != nil {
-			rlogger.Log(w.logger, rlogger.Warn, "msg", "Input error", "err", err)
-			e = err
+	var fetched int
+	var transformed time.Duration
+	var failed, partial, recordingFailed []string
+	var lastErr error
+	for i, r := range results {
+		var terr *transformError
+		if errors.As(r.err, &terr) {
+			statusErr := w.status.UpdateStatus("Degraded", "Degraded", "Failed to filter metrics")
+			if statusErr != nil {
+				rlogger.Log(w.logger, rlogger.Warn, "msg", failedStatusReportMsg, "err", statusErr)
+			}
+			return nil, 0, 0, terr.err
+		}
+		if r.err != nil {
+			failed = append(failed, w.sources[i].name)
+			lastErr = r.err
 			continue
 		}
-		rname := r["name"]
-		rquery := r["query"]
+		w.current.RecordingRules = append(w.current.RecordingRules, r.rules...)
+		if r.partialErr != nil {
+			partial = append(partial, w.sources[i].name)
+		}
+		if r.recordingErr != nil {
+			recordingFailed = append(recordingFailed, w.sources[i].name)
+		}
+		families = append(families, r.families...)
+		fetched += r.fetched
+		transformed += r.transformed
+	}
 
-		// reset query from last invocation, otherwise match rules will be appended
-		from.RawQuery = ""
-		v := w.from.Query()
-		v.Add("query", rquery)
-		from.RawQuery = v.Encode()
+	switch {
+	case len(failed) == len(w.sources):
+		statusErr := w.status.UpdateStatus("Degraded", "Degraded", "Failed to retrieve metrics")
+		if statusErr != nil {
+			rlogger.Log(w.logger, rlogger.Warn, "msg", failedStatusReportMsg, "err", statusErr)
+		}
+		if len(failed) == 1 {
+			return nil, 0, 0, lastErr
+		}
+		return nil, 0, 0, fmt.Errorf("failed to retrieve metrics from all sources: %s", strings.Join(failed, ", "))
+	case len(failed) > 0:
+		statusErr := w.status.UpdateStatus("Degraded", "Degraded", "Failed to retrieve metrics from "+strings.Join(failed, ", "))
+		if statusErr != nil {
+			rlogger.Log(w.logger, rlogger.Warn, "msg", failedStatusReportMsg, "err", statusErr)
+		}
+	case len(partial) > 0:
+		statusErr := w.status.UpdateStatus("Degraded", "Degraded", "Partial metrics retrieved from "+strings.Join(partial, ", "))
+		if statusErr != nil {
+			rlogger.Log(w.logger, rlogger.Warn, "msg", failedStatusReportMsg, "err", statusErr)
+		}
+	case len(recordingFailed) > 0:
+		statusErr := w.status.UpdateStatus("Degraded", "Degraded", "Failed to retrieve recording metrics")
+		if statusErr != nil {
+			rlogger.Log(w.logger, rlogger.Warn, "msg", failedStatusReportMsg, "err", statusErr)
+		}
+	}
+	return families, fetched, transformed, nil
+}
 
-		req := &http.Request{Method: "GET", URL: from}
-		rfamilies, err := w.fromClient.RetrievRecordingMetrics(ctx, req, rname)
-		if err != nil {
-			rlogger.Log(w.logger, rlogger.Warn, "msg", "Failed to retrieve recording metrics", "err", err)
-			e = err
+// describeViolations summarizes the cardinality limits exceeded for the status.
+func describeViolations(violations []metricfamily.CardinalityViolation) string {
+	var msgs []string
+	for _, v := range violations {
+		if v.Global {
+			msgs = append(msgs, fmt.Sprintf("%d series over the global limit of %d, mostly from metric %s with the most values in label %q",
+				v.Series, v.Limit, v.Metric, v.Label))
 			continue
-		} else {
-			families = append(families, rfamilies...)
 		}
+		msgs = append(msgs, fmt.Sprintf("metric %s has %d series over the limit of %d, with the most values in label %q",
+			v.Metric, v.Series, v.Limit, v.Label))
 	}
-
-	return families, e
+	return "cardinality limits exceeded: " + strings.Join(msgs, "; ")
 }
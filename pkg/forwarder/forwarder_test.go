@@ -3,14 +3,25 @@ package forwarder
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/stolostron/metrics-collector/pkg/metricfamily"
 )
 
 func init() {
@@ -120,6 +131,15 @@ func TestNew(t *testing.T) {
 			},
 			err: true,
 		},
+		{
+			// A destination name that is not a single path segment should error.
+			c: Config{
+				From:         from,
+				Destinations: []Destination{{Name: "../x", URL: toUpload}},
+				Logger:       log.NewNopLogger(),
+			},
+			err: true,
+		},
 	}
 
 	for i := range tc {
@@ -133,6 +153,32 @@ func TestNew(t *testing.T) {
 	}
 }
 
+func TestMigrateQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// A request queued at the root of the directory, before destinations had their own queue.
+	batch := filepath.Join(dir, "00000000000000000001-0000000001.batch")
+	if err := ioutil.WriteFile(batch, []byte("queued"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	from, _ := url.Parse("https://redhat.com")
+	toUpload, _ := url.Parse("https://k8s.io")
+	if _, err := New(Config{From: from, ToUpload: toUpload, WALDir: dir, Logger: log.NewNopLogger()}); err != nil {
+		t.Fatalf("failed to create new worker: %v", err)
+	}
+	if _, err := os.Stat(batch); !os.IsNotExist(err) {
+		t.Errorf("expected the request to be moved out of the root of the directory: %v", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "k8s.io", filepath.Base(batch)))
+	if err != nil || string(data) != "queued" {
+		t.Errorf("expected the request in the queue of the destination, got %q: %v", data, err)
+	}
+}
+
 func TestReconfigure(t *testing.T) {
 	from, err := url.Parse("https://redhat.com")
 	if err != nil {
@@ -258,3 +304,558 @@ func TestRun(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestForwardMultipleDestinations(t *testing.T) {
+	from := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprintf(w, "up{job=\"a\"} 1 %d\nup{job=\"b\"} 1 %d\n", time.Now().Unix()*1000, time.Now().Unix()*1000)
+	}))
+	defer from.Close()
+
+	var received int32
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		atomic.AddInt32(&received, 1)
+	}))
+	defer ok.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	fromURL, _ := url.Parse(from.URL)
+	okURL, _ := url.Parse(ok.URL)
+	failingURL, _ := url.Parse(failing.URL)
+	w, err := New(Config{
+		From:       fromURL,
+		LimitBytes: 200 * 1024,
+		Logger:     log.NewNopLogger(),
+		Destinations: []Destination{
+			{Name: "ok", URL: okURL, Match: []string{`{job="a"}`}},
+			{Name: "failing", URL: failingURL, MaxRetryDuration: 10 * time.Millisecond},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create new worker: %v", err)
+	}
+
+	// A failing destination must not fail the cycle nor prevent the others from receiving metrics.
+	if err := w.forward(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if atomic.LoadInt32(&received) != 1 {
+		t.Errorf("expected one request to the healthy destination, got %d", received)
+	}
+
+	if h := w.Health(); h.LastScrape.IsZero() || h.LastPush.IsZero() {
+		t.Errorf("expected the scrape and the push to be recorded: %+v", h)
+	}
+
+	w.finishCycle(nil)
+	c := w.LastCycle()
+	if c.Fetched != 2 || c.Sent != 2 || len(c.Destinations) != 2 {
+		t.Fatalf("unexpected last cycle: %+v", c)
+	}
+	if b := c.Destinations[0].Batches; len(b) != 1 || b[0].StatusCode != http.StatusOK || b[0].Attempts != 1 {
+		t.Errorf("unexpected batches for destination %s: %+v", c.Destinations[0].Name, b)
+	}
+	if b := c.Destinations[1].Batches; len(b) != 1 || b[0].StatusCode != http.StatusInternalServerError || b[0].Error == "" {
+		t.Errorf("unexpected batches for destination %s: %+v", c.Destinations[1].Name, b)
+	}
+
+	statuses := w.Destinations()
+	if len(statuses) != 2 {
+		t.Fatalf("expected 2 destination statuses, got %d", len(statuses))
+	}
+	if statuses[0].LastError != "" || statuses[0].LastSuccess.IsZero() {
+		t.Errorf("expected destination %s to succeed: %+v", statuses[0].Name, statuses[0])
+	}
+	if statuses[1].LastError == "" {
+		t.Errorf("expected destination %s to fail: %+v", statuses[1].Name, statuses[1])
+	}
+
+	// Destination names must be unique.
+	if _, err := New(Config{
+		From:         fromURL,
+		Logger:       log.NewNopLogger(),
+		Destinations: []Destination{{URL: okURL}, {URL: okURL}},
+	}); err == nil {
+		t.Error("expected an error for duplicate destination names")
+	}
+}
+
+func TestForwardMultipleSources(t *testing.T) {
+	newSourceServer := func(job string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			fmt.Fprintf(w, "up{job=%q} 1 %d\n", job, time.Now().Unix()*1000)
+		}))
+	}
+	a := newSourceServer("a")
+	defer a.Close()
+	b := newSourceServer("b")
+	defer b.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	aURL, _ := url.Parse(a.URL)
+	bURL, _ := url.Parse(b.URL)
+	downURL, _ := url.Parse(down.URL)
+	w, err := New(Config{
+		LimitBytes:  200 * 1024,
+		Logger:      log.NewNopLogger(),
+		SourceLabel: "source",
+		Sources: []Source{
+			{Name: "a", URL: aURL},
+			{Name: "b", URL: bURL},
+			{Name: "down", URL: downURL},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create new worker: %v", err)
+	}
+
+	// An unreachable source must not fail the cycle nor prevent the others from being scraped.
+	if err := w.forward(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sources := make(map[string]bool)
+	for _, f := range w.LastMetrics() {
+		for _, m := range f.Metric {
+			for _, l := range m.Label {
+				if l.GetName() == "source" {
+					sources[l.GetValue()] = true
+				}
+			}
+		}
+	}
+	if len(sources) != 2 || !sources["a"] || !sources["b"] {
+		t.Errorf("expected series labelled with sources a and b, got %v", sources)
+	}
+
+	// The cycle fails when no source can be scraped.
+	w, err = New(Config{
+		Logger:  log.NewNopLogger(),
+		Sources: []Source{{URL: downURL}},
+	})
+	if err != nil {
+		t.Fatalf("failed to create new worker: %v", err)
+	}
+	if err := w.forward(context.Background()); err == nil {
+		t.Error("expected an error when all sources are down")
+	}
+
+	// Source names must be unique.
+	if _, err := New(Config{
+		From:    aURL,
+		Logger:  log.NewNopLogger(),
+		Sources: []Source{{URL: aURL}},
+	}); err == nil {
+		t.Error("expected an error for duplicate source names")
+	}
+}
+
+func TestForwardPartialResponses(t *testing.T) {
+	// The response holds a valid family followed by a truncated one.
+	from := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", string(expfmt.FmtProtoDelim))
+		name, value, ts := "up", 1.0, time.Now().Unix()*1000
+		family := &clientmodel.MetricFamily{
+			Name:   &name,
+			Type:   clientmodel.MetricType_GAUGE.Enum(),
+			Metric: []*clientmodel.Metric{{Gauge: &clientmodel.Gauge{Value: &value}, TimestampMs: &ts}},
+		}
+		if err := expfmt.NewEncoder(w, expfmt.FmtProtoDelim).Encode(family); err != nil {
+			t.Errorf("failed to encode family: %v", err)
+		}
+		_, _ = w.Write([]byte{0x10, 0x0a})
+	}))
+	defer from.Close()
+	fromURL, _ := url.Parse(from.URL)
+
+	for _, tc := range []struct {
+		policy PartialResponsePolicy
+		series int
+	}{
+		{policy: PartialResponseFail},
+		{policy: PartialResponseForward, series: 1},
+	} {
+		w, err := New(Config{
+			LimitBytes:       200 * 1024,
+			Logger:           log.NewNopLogger(),
+			PartialResponses: tc.policy,
+			Sources:          []Source{{Name: "a", URL: fromURL}},
+		})
+		if err != nil {
+			t.Fatalf("failed to create new worker: %v", err)
+		}
+		err = w.forward(context.Background())
+		if tc.policy == PartialResponseFail && err == nil {
+			t.Errorf("%s: expected the cycle to fail", tc.policy)
+		}
+		if got := metricfamily.MetricsCount(w.LastMetrics()); got != tc.series {
+			t.Errorf("%s: expected %d series, got %d", tc.policy, tc.series, got)
+		}
+	}
+}
+
+func TestRecordingRules(t *testing.T) {
+	var inFlight, maxInFlight int32
+	from := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/query" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		query := r.URL.Query().Get("query")
+		if query == "slow" {
+			<-r.Context().Done()
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"query":%q},"value":[%d,"1"]}]}}`,
+			query, time.Now().Unix())
+	}))
+	defer from.Close()
+	fromURL, _ := url.Parse(from.URL + "/federate")
+
+	rules := []RecordingRule{{Name: "slow", Query: "slow"}}
+	for i := 0; i < 6; i++ {
+		rules = append(rules, RecordingRule{Name: fmt.Sprintf("rule_%d", i), Query: fmt.Sprintf("q%d", i)})
+	}
+	w, err := New(Config{
+		Logger:                   log.NewNopLogger(),
+		Sources:                  []Source{{Name: "a", URL: fromURL, RecordingRules: rules}},
+		RecordingRuleConcurrency: 2,
+		RecordingRuleTimeout:     100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("failed to create new worker: %v", err)
+	}
+	s := w.sources[0]
+	families, results, err := s.getRecordingMetrics(context.Background(), nil)
+	if err == nil {
+		t.Error("expected an error for the rule that timed out")
+	}
+	if max := atomic.LoadInt32(&maxInFlight); max > 2 {
+		t.Errorf("expected at most 2 rules evaluated at the same time, got %d", max)
+	}
+	if len(families) != len(rules)-1 {
+		t.Errorf("expected %d families, got %d", len(rules)-1, len(families))
+	}
+	if len(results) != len(rules) || results[0].Error == "" {
+		t.Fatalf("expected the slow rule to fail, got %+v", results)
+	}
+	var slow struct {
+		Duration float64 `json:"duration"`
+	}
+	if b, err := json.Marshal(results[0]); err != nil || json.Unmarshal(b, &slow) != nil || slow.Duration < 0.1 || slow.Duration > 10 {
+		t.Errorf("expected the duration of the slow rule in seconds, got %v: %v", slow.Duration, err)
+	}
+	for i, f := range families {
+		if want := fmt.Sprintf("rule_%d", i); f.GetName() != want || results[i+1].Name != want || results[i+1].Series != 1 {
+			t.Errorf("expected the results of %s in order, got %s and %+v", want, f.GetName(), results[i+1])
+		}
+	}
+	if s.url.String() != fromURL.String() {
+		t.Errorf("expected the URL of the source to be left unchanged, got %s", s.url)
+	}
+}
+
+func TestLocalRecordingRules(t *testing.T) {
+	from := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/federate" {
+			t.Errorf("unexpected request to %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		now := time.Now().Unix() * 1000
+		fmt.Fprintf(w, "up{job=\"a\",instance=\"1\"} 1 %d\n", now)
+		fmt.Fprintf(w, "up{job=\"a\",instance=\"2\"} 0 %d\n", now)
+		fmt.Fprintf(w, "up{job=\"b\",instance=\"1\"} 1 %d\n", now)
+		// Too old to be returned by an instant query.
+		fmt.Fprintf(w, "up{job=\"c\",instance=\"1\"} 1 %d\n", now-int64(time.Hour/time.Millisecond))
+		// Outside of the match rules, the source does not honour them.
+		fmt.Fprintf(w, "ignored{job=\"a\"} 1 %d\n", now)
+	}))
+	defer from.Close()
+	fromURL, _ := url.Parse(from.URL + "/federate")
+
+	w, err := New(Config{
+		LimitBytes: 200 * 1024,
+		Logger:     log.NewNopLogger(),
+		Sources: []Source{{Name: "a", URL: fromURL, Rules: []string{`{__name__="up"}`}, RecordingRules: []RecordingRule{
+			{Name: "job:up:sum", Query: "sum by (job) (up)", Type: "gauge"},
+			{Name: "up:count", Query: "count(up)"},
+			{Name: "none", Query: "absent_metric"},
+			{Name: "invalid", Query: "rate(up)"},
+			{Name: "ignored:count", Query: "count(ignored)"},
+		}}},
+		LocalRecordingRules: true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create new worker: %v", err)
+	}
+	r := w.sources[0].fetch(context.Background(), "", nil)
+	if r.err != nil {
+		t.Fatalf("unexpected error: %v", r.err)
+	}
+	if r.recordingErr == nil {
+		t.Error("expected an error for the invalid rule")
+	}
+
+	got := make(map[string]float64)
+	for _, f := range r.families {
+		for _, m := range f.Metric {
+			key := f.GetName()
+			for _, l := range m.Label {
+				key += "," + l.GetName() + "=" + l.GetValue()
+			}
+			switch f.GetType() {
+			case clientmodel.MetricType_GAUGE:
+				got[key] = m.GetGauge().GetValue()
+			case clientmodel.MetricType_UNTYPED:
+				got[key] = m.GetUntyped().GetValue()
+			default:
+				t.Errorf("unexpected type %s for %s", f.GetType(), key)
+			}
+		}
+	}
+	for key, want := range map[string]float64{
+		"job:up:sum,job=a": 1,
+		"job:up:sum,job=b": 1,
+		"up:count":         3,
+	} {
+		if v, ok := got[key]; !ok || v != want {
+			t.Errorf("expected %s to be %v, got %v (%t)", key, want, v, ok)
+		}
+	}
+	if _, ok := got["job:up:sum,job=c"]; ok {
+		t.Error("expected the stale series to be ignored")
+	}
+	if _, ok := got["ignored,job=a"]; ok {
+		t.Error("expected the series outside of the match rules to be dropped")
+	}
+	// The rules only see the series allowed by the match rules.
+	if len(r.rules) != 5 || r.rules[2].Series != 0 || r.rules[3].Error == "" || r.rules[4].Series != 0 {
+		t.Errorf("unexpected rule results %+v", r.rules)
+	}
+}
+
+func TestDestinationAuthentication(t *testing.T) {
+	secure, _ := url.Parse("https://k8s.io")
+	tc := []struct {
+		name string
+		d    Destination
+		err  bool
+	}{
+		{
+			name: "plain TLS with the system roots certificates",
+			d:    Destination{URL: secure},
+		},
+		{
+			name: "mutual TLS",
+			d:    Destination{URL: secure, CAFile: "./testdata/ca.crt", CertFile: "./testdata/tls.crt", KeyFile: "./testdata/tls.key"},
+		},
+		{
+			name: "missing client certificate",
+			d:    Destination{URL: secure, CertFile: "./testdata/missing.crt", KeyFile: "./testdata/tls.key"},
+			err:  true,
+		},
+		{
+			name: "missing token file",
+			d:    Destination{URL: secure, TokenFile: "./testdata/missing"},
+			err:  true,
+		},
+	}
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newDestination(Config{}, tt.d, time.Minute, log.NewNopLogger())
+			if (err != nil) != tt.err {
+				t.Fatalf("expected error %t, got %v", tt.err, err)
+			}
+		})
+	}
+
+	// A bearer token is sent to destinations that are not protected by mutual TLS.
+	var auth atomic.Value
+	to := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth.Store(r.Header.Get("Authorization"))
+	}))
+	defer to.Close()
+	toURL, _ := url.Parse(to.URL)
+	d, err := newDestination(Config{}, Destination{Name: "to", URL: toURL, Token: "secret"}, time.Minute, log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("failed to create destination: %v", err)
+	}
+	name, value := "up", 1.0
+	families := []*clientmodel.MetricFamily{{
+		Name:   &name,
+		Type:   clientmodel.MetricType_GAUGE.Enum(),
+		Metric: []*clientmodel.Metric{{Gauge: &clientmodel.Gauge{Value: &value}}},
+	}}
+	if err := d.send(context.Background(), families, time.Minute); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	if got, _ := auth.Load().(string); got != "Bearer secret" {
+		t.Errorf("expected the bearer token to be sent, got %q", got)
+	}
+}
+
+func TestForwardEnforcesMatchRules(t *testing.T) {
+	// The source ignores match[] and returns every series.
+	from := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		now := time.Now().Unix() * 1000
+		fmt.Fprintf(w, "up{job=\"a\"} 1 %d\nup{job=\"b\"} 1 %d\nunexpected{job=\"a\"} 1 %d\n", now, now, now)
+	}))
+	defer from.Close()
+
+	fromURL, _ := url.Parse(from.URL)
+	w, err := New(Config{
+		From:       fromURL,
+		Rules:      []string{`{__name__="up"}`},
+		DenyRules:  []string{`{job="b"}`},
+		LimitBytes: 200 * 1024,
+		Logger:     log.NewNopLogger(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create new worker: %v", err)
+	}
+	denied := func() float64 {
+		var m clientmodel.Metric
+		if err := counterDroppedSeries.WithLabelValues(`{job="b"}`).Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetCounter().GetValue()
+	}
+	deniedBefore := denied()
+	if err := w.forward(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := denied() - deniedBefore; got != 1 {
+		t.Errorf("expected 1 series counted against the deny rule, got %v", got)
+	}
+
+	var series []string
+	for _, f := range w.LastMetrics() {
+		for _, m := range f.Metric {
+			series = append(series, fmt.Sprintf("%s%v", f.GetName(), m.Label))
+		}
+	}
+	if len(series) != 1 || series[0] != `up[name:"job" value:"a" ]` {
+		t.Errorf("expected only up{job=\"a\"} to be forwarded, got %v", series)
+	}
+
+	// The match rules of a source do not allow series from another one.
+	dropped := func() float64 {
+		var m clientmodel.Metric
+		if err := counterUnmatchedSeries.WithLabelValues("b").Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetCounter().GetValue()
+	}
+	before := dropped()
+	w, err = New(Config{
+		LimitBytes:  200 * 1024,
+		Logger:      log.NewNopLogger(),
+		SourceLabel: "source",
+		Sources: []Source{
+			{Name: "a", URL: fromURL, Rules: []string{`{__name__="up"}`}},
+			{Name: "b", URL: fromURL, Rules: []string{`{__name__="unexpected"}`}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create new worker: %v", err)
+	}
+	if err := w.forward(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	forwarded := make(map[string]int)
+	for _, f := range w.LastMetrics() {
+		for _, m := range f.Metric {
+			for _, l := range m.Label {
+				if l.GetName() == "source" {
+					forwarded[f.GetName()+"/"+l.GetValue()]++
+				}
+			}
+		}
+	}
+	if len(forwarded) != 2 || forwarded["up/a"] != 2 || forwarded["unexpected/b"] != 1 {
+		t.Errorf("expected up from a and unexpected from b only, got %v", forwarded)
+	}
+	if got := dropped() - before; got != 2 {
+		t.Errorf("expected 2 series dropped by the allow-list of b, got %v", got)
+	}
+
+	if _, err := New(Config{From: fromURL, DenyRules: []string{"up{"}, Logger: log.NewNopLogger()}); err == nil {
+		t.Error("expected an error for an invalid deny rule")
+	}
+}
+
+func TestForwardLimitsCardinality(t *testing.T) {
+	from := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		now := time.Now().Unix() * 1000
+		for i := 0; i < 10; i++ {
+			fmt.Fprintf(w, "requests{path=\"/%d\"} 1 %d\n", i, now)
+		}
+		fmt.Fprintf(w, "up{job=\"a\"} 1 %d\n", now)
+	}))
+	defer from.Close()
+
+	fromURL, _ := url.Parse(from.URL)
+	w, err := New(Config{
+		From:              fromURL,
+		LimitBytes:        200 * 1024,
+		Logger:            log.NewNopLogger(),
+		CardinalityLimits: metricfamily.CardinalityLimits{MaxSeriesPerMetric: 3},
+	})
+	if err != nil {
+		t.Fatalf("failed to create new worker: %v", err)
+	}
+	if err := w.forward(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	counts := make(map[string]int)
+	for _, f := range w.LastMetrics() {
+		for _, m := range f.Metric {
+			if m == nil {
+				t.Fatalf("unexpected nil metric in family %s", f.GetName())
+			}
+			counts[f.GetName()]++
+		}
+	}
+	if counts["requests"] != 3 || counts["up"] != 1 {
+		t.Errorf("expected 3 requests and 1 up series, got %v", counts)
+	}
+}
+
+func TestRegisterLegacyMetrics(t *testing.T) {
+	r := prometheus.NewRegistry()
+	if err := RegisterLegacyMetrics(r); err != nil {
+		t.Fatalf("failed to register legacy metrics: %v", err)
+	}
+	gaugeFederateErrors.Inc()
+	families, err := r.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, f := range families {
+		if f.GetName() == "federate_errors" && f.GetType() == clientmodel.MetricType_GAUGE {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected the legacy federate_errors gauge, got %v", families)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package forwarder
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Duration is a time.Duration serialized in JSON as a number of seconds.
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).Seconds())
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// Health describes the progress of the worker, as reported by the health probes.
+type Health struct {
+	// Started is the time the worker started running.
+	Started time.Time `json:"started"`
+	// Interval is the configured interval between two cycles, in seconds in JSON.
+	Interval Duration `json:"interval"`
+	// LastCycle is the time the last cycle completed, successfully or not.
+	LastCycle time.Time `json:"lastCycle"`
+	// LastSuccess is the time the last cycle completed successfully.
+	LastSuccess time.Time `json:"lastSuccess"`
+	// LastScrape is the time metrics were last retrieved from the sources.
+	LastScrape time.Time `json:"lastScrape"`
+	// LastPush is the time metrics were last sent to at least one destination.
+	LastPush time.Time `json:"lastPush"`
+	// LastError is the error of the last cycle, empty if it succeeded.
+	LastError string `json:"lastError,omitempty"`
+	// ConsecutiveFailures is the number of cycles that failed in a row.
+	ConsecutiveFailures int `json:"consecutiveFailures"`
+}
+
+// Ready reports whether a cycle has completed successfully, meaning that
+// metrics were retrieved and, unless there was nothing to send, sent.
+func (h Health) Ready() bool {
+	return !h.LastSuccess.IsZero()
+}
+
+// Live reports whether a cycle completed within the given number of intervals,
+// or since the worker started if none completed yet. A worker that is not
+// running yet is considered live.
+func (h Health) Live(now time.Time, intervals int) bool {
+	last := h.LastCycle
+	if last.IsZero() {
+		last = h.Started
+	}
+	if last.IsZero() || intervals <= 0 {
+		return true
+	}
+	return now.Sub(last) <= time.Duration(intervals)*time.Duration(h.Interval)
+}
+
+// health records the progress of the worker. It has its own lock so that the
+// probes are not blocked by a cycle in progress.
+type health struct {
+	lock  sync.Mutex
+	state Health
+}
+
+func (h *health) update(f func(*Health)) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	f(&h.state)
+}
+
+func (h *health) get() Health {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.state
+}
+
+// cycle records the outcome of a cycle.
+func (h *health) cycle(now time.Time, err error) {
+	h.update(func(s *Health) {
+		s.LastCycle = now
+		if err != nil {
+			s.LastError = err.Error()
+			s.ConsecutiveFailures++
+			return
+		}
+		s.LastError = ""
+		s.ConsecutiveFailures = 0
+		s.LastSuccess = now
+	})
+}
@@ -0,0 +1,49 @@
+// Copyright Contributors to the Open Cluster Management project
+package forwarder
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	start := time.Now()
+	h := &health{}
+	h.update(func(s *Health) { s.Started, s.Interval = start, Duration(time.Minute) })
+
+	if s := h.get(); s.Ready() || !s.Live(start.Add(3*time.Minute), 3) || s.Live(start.Add(4*time.Minute), 3) {
+		t.Errorf("expected a live but not ready worker until the first cycle is overdue: %+v", s)
+	}
+
+	h.cycle(start.Add(time.Minute), errors.New("unreachable"))
+	h.cycle(start.Add(2*time.Minute), errors.New("unreachable"))
+	s := h.get()
+	if s.Ready() || s.ConsecutiveFailures != 2 || s.LastError != "unreachable" {
+		t.Errorf("expected failed cycles to be recorded: %+v", s)
+	}
+	if !s.Live(start.Add(4*time.Minute), 3) {
+		t.Errorf("expected a worker completing cycles to be live, even if they fail: %+v", s)
+	}
+
+	h.cycle(start.Add(3*time.Minute), nil)
+	s = h.get()
+	if !s.Ready() || s.ConsecutiveFailures != 0 || s.LastError != "" {
+		t.Errorf("expected a successful cycle to make the worker ready: %+v", s)
+	}
+	if s.Live(start.Add(7*time.Minute), 3) || !s.Live(start.Add(7*time.Minute), 0) {
+		t.Errorf("expected the liveness to fail after 3 intervals without a cycle, unless disabled: %+v", s)
+	}
+}
+
+func TestHealthJSON(t *testing.T) {
+	b, err := json.Marshal(Health{Interval: Duration(90 * time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"interval":90,`) {
+		t.Errorf("expected the interval in seconds, got %s", b)
+	}
+}
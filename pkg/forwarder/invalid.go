@@ -0,0 +1,117 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package forwarder
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/stolostron/metrics-collector/pkg/metricfamily"
+)
+
+var counterInvalidSamples = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "federate_invalid_samples_total",
+	Help: "The number of series dropped, or labels removed, because they were invalid, by reason",
+}, []string{"reason"})
+
+func init() {
+	prometheus.MustRegister(counterInvalidSamples)
+}
+
+// InvalidSample is a series rejected because it was invalid.
+type InvalidSample struct {
+	Reason metricfamily.InvalidSampleReason `json:"reason"`
+	Series string                           `json:"series"`
+	Time   time.Time                        `json:"time"`
+}
+
+// InvalidSamples counts the invalid samples by reason and keeps the most
+// recently rejected series, so that the offending ones can be looked up
+// without enabling debug logging.
+type InvalidSamples struct {
+	lock    sync.Mutex
+	size    int
+	next    int
+	samples []InvalidSample
+	now     func() time.Time
+}
+
+// NewInvalidSamples returns a recorder keeping up to size rejected series.
+func NewInvalidSamples(size int) *InvalidSamples {
+	return &InvalidSamples{size: size, now: time.Now}
+}
+
+// Report implements metricfamily.InvalidSampleReporter. A nil recorder only counts
+// the invalid samples.
+func (r *InvalidSamples) Report(reason metricfamily.InvalidSampleReason, family *clientmodel.MetricFamily, m *clientmodel.Metric) {
+	counterInvalidSamples.WithLabelValues(string(reason)).Inc()
+	if r == nil || r.size <= 0 {
+		return
+	}
+	sample := InvalidSample{Reason: reason, Series: describeSeries(family, m), Time: r.now()}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.samples) < r.size {
+		r.samples = append(r.samples, sample)
+		return
+	}
+	r.samples[r.next] = sample
+	r.next = (r.next + 1) % r.size
+}
+
+// Samples returns the recorded series, most recent first.
+func (r *InvalidSamples) Samples() []InvalidSample {
+	if r == nil {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	samples := make([]InvalidSample, 0, len(r.samples))
+	for i := len(r.samples) - 1; i >= 0; i-- {
+		samples = append(samples, r.samples[(r.next+i)%len(r.samples)])
+	}
+	return samples
+}
+
+// ServeHTTP returns the recorded series as JSON.
+func (r *InvalidSamples) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(r.Samples())
+}
+
+// maxSeriesLength bounds the length of a recorded series, since labels may
+// have been rejected precisely because they are too long.
+const maxSeriesLength = 512
+
+// describeSeries formats a series as name{label="value",...}.
+func describeSeries(family *clientmodel.MetricFamily, m *clientmodel.Metric) string {
+	var b strings.Builder
+	b.WriteString(family.GetName())
+	if m != nil {
+		var pairs []string
+		for _, l := range m.Label {
+			if l != nil {
+				pairs = append(pairs, l.GetName()+"="+`"`+l.GetValue()+`"`)
+			}
+		}
+		sort.Strings(pairs)
+		b.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	s := b.String()
+	if len(s) > maxSeriesLength {
+		s = s[:maxSeriesLength] + "..."
+	}
+	return s
+}
@@ -0,0 +1,25 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package forwarder
+
+import (
+	"testing"
+
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/stolostron/metrics-collector/pkg/metricfamily"
+)
+
+func TestInvalidSamples(t *testing.T) {
+	name := func(s string) *string { return &s }
+	r := NewInvalidSamples(2)
+	for _, n := range []string{"a", "b", "c"} {
+		r.Report(metricfamily.ReasonStaleTimestamp, &clientmodel.MetricFamily{Name: name(n)}, &clientmodel.Metric{
+			Label: []*clientmodel.LabelPair{{Name: name("job"), Value: name(n)}},
+		})
+	}
+	samples := r.Samples()
+	if len(samples) != 2 || samples[0].Series != `c{job="c"}` || samples[1].Series != `b{job="b"}` {
+		t.Errorf("expected the two most recent series, got %+v", samples)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package forwarder
+
+import (
+	"context"
+	"sort"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// localStorage is a read-only storage over the series federated from a source,
+// so that recording rules can be evaluated by the promql engine without the
+// query API of the source. Only the federated series can be queried, with the
+// samples returned by the federation endpoint.
+type localStorage struct {
+	series []promql.Series
+}
+
+func newLocalStorage(series []promql.Series) *localStorage {
+	sort.Slice(series, func(i, j int) bool {
+		return labels.Compare(series[i].Metric, series[j].Metric) < 0
+	})
+	return &localStorage{series: series}
+}
+
+// Querier implements storage.Queryable.
+func (s *localStorage) Querier(_ context.Context, mint, maxt int64) (storage.Querier, error) {
+	return &localQuerier{series: s.series, mint: mint, maxt: maxt}, nil
+}
+
+type localQuerier struct {
+	series     []promql.Series
+	mint, maxt int64
+}
+
+// Select returns the series matching all the matchers, with their samples within the range of the querier.
+func (q *localQuerier) Select(_ *storage.SelectParams, matchers ...*labels.Matcher) (storage.SeriesSet, storage.Warnings, error) {
+	var selected []promql.Series
+	for _, s := range q.series {
+		if !matches(s.Metric, matchers) {
+			continue
+		}
+		var points []promql.Point
+		for _, p := range s.Points {
+			if p.T >= q.mint && p.T <= q.maxt {
+				points = append(points, p)
+			}
+		}
+		if len(points) > 0 {
+			selected = append(selected, promql.Series{Metric: s.Metric, Points: points})
+		}
+	}
+	return &localSeriesSet{series: selected, i: -1}, nil, nil
+}
+
+func matches(ls labels.Labels, matchers []*labels.Matcher) bool {
+	for _, m := range matchers {
+		if !m.Matches(ls.Get(m.Name)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (q *localQuerier) LabelValues(name string) ([]string, error) {
+	values := make(map[string]struct{})
+	for _, s := range q.series {
+		if v := s.Metric.Get(name); len(v) > 0 {
+			values[v] = struct{}{}
+		}
+	}
+	return sortedKeys(values), nil
+}
+
+func (q *localQuerier) LabelNames() ([]string, error) {
+	names := make(map[string]struct{})
+	for _, s := range q.series {
+		for _, l := range s.Metric {
+			names[l.Name] = struct{}{}
+		}
+	}
+	return sortedKeys(names), nil
+}
+
+func (q *localQuerier) Close() error {
+	return nil
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type localSeriesSet struct {
+	series []promql.Series
+	i      int
+}
+
+func (s *localSeriesSet) Next() bool {
+	s.i++
+	return s.i < len(s.series)
+}
+
+func (s *localSeriesSet) At() storage.Series {
+	return promql.NewStorageSeries(s.series[s.i])
+}
+
+func (s *localSeriesSet) Err() error {
+	return nil
+}
@@ -0,0 +1,528 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package forwarder
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage"
+
+	metricshttp "github.com/stolostron/metrics-collector/pkg/http"
+	rlogger "github.com/stolostron/metrics-collector/pkg/logger"
+	"github.com/stolostron/metrics-collector/pkg/metricfamily"
+	"github.com/stolostron/metrics-collector/pkg/metricsclient"
+)
+
+var (
+	counterSourceErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "federate_source_errors_total",
+		Help: "The number of times retrieving metrics from each source has failed",
+	}, []string{"source"})
+	gaugeSourceSamples = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "federate_source_samples",
+		Help: "Tracks the number of samples retrieved from each source per federation",
+	}, []string{"source"})
+	histogramScrapeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "federate_source_scrape_duration_seconds",
+		Help:    "The time spent retrieving the federated and recording metrics of each source",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"source"})
+	counterRuleEvaluations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "federate_recording_rule_evaluations_total",
+		Help: "The number of evaluations of each recording rule, by result",
+	}, []string{"source", "rule", "result"})
+	histogramRuleDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "federate_recording_rule_duration_seconds",
+		Help:    "The time spent evaluating each recording rule",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"source", "rule"})
+	gaugeRuleSeries = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "federate_recording_rule_series",
+		Help: "The number of series returned by the last successful evaluation of each recording rule",
+	}, []string{"source", "rule"})
+)
+
+// defaultRuleConcurrency is the number of recording rules of a source evaluated
+// at the same time if not configured.
+const defaultRuleConcurrency = 4
+
+// maxLocalSamples bounds the number of samples loaded by a recording rule
+// evaluated locally, as --query.max-samples does in Prometheus.
+const maxLocalSamples = 50000000
+
+func init() {
+	prometheus.MustRegister(counterSourceErrors, gaugeSourceSamples, histogramScrapeDuration,
+		counterRuleEvaluations, histogramRuleDuration, gaugeRuleSeries)
+}
+
+// Source is a Prometheus server the metrics are federated from.
+type Source struct {
+	// Name identifies the source in logs, metrics and in the source label.
+	// It defaults to the host of the URL and must be unique.
+	Name string
+	URL  *url.URL
+
+	// Token or TokenFile is the bearer token used to authenticate to the source.
+	Token     string
+	TokenFile string
+	// CAFile is used to verify the source in addition to the system roots certificates.
+	CAFile string
+
+	Rules          []string
+	RulesFile      string
+	RecordingRules []RecordingRule
+}
+
+// PartialResponsePolicy decides what happens to the metrics of a source whose
+// response was truncated or malformed.
+type PartialResponsePolicy string
+
+const (
+	// PartialResponseFail discards the metrics of the source, as if it was unreachable.
+	PartialResponseFail PartialResponsePolicy = "fail"
+	// PartialResponseForward forwards the metrics decoded before the error, and
+	// reports the source as degraded.
+	PartialResponseForward PartialResponsePolicy = "forward"
+)
+
+type source struct {
+	name           string
+	url            *url.URL
+	client         *metricsclient.Client
+	rules          []string
+	recordingRules []RecordingRule
+	// allow enforces the match rules locally, nil if there are none.
+	allow metricfamily.Transformer
+	// ruleConcurrency bounds the number of recording rules evaluated at the same
+	// time, and ruleTimeout the duration of each evaluation.
+	ruleConcurrency int
+	ruleTimeout     time.Duration
+	// engine evaluates the recording rules over the federated series, instead of
+	// the query API of the source. Nil unless enabled and rules are configured.
+	engine  *promql.Engine
+	partial PartialResponsePolicy
+	logger  log.Logger
+}
+
+func newSource(cfg Config, s Source, interval time.Duration, logger log.Logger) (*source, error) {
+	if s.URL == nil {
+		return nil, fmt.Errorf("source %q has no URL", s.Name)
+	}
+
+	transport := metricsclient.DefaultTransport(logger, false)
+	if len(s.CAFile) > 0 {
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{
+				MinVersion: tls.VersionTLS12,
+			}
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read system certificates: %v", err)
+		}
+		data, err := ioutil.ReadFile(s.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read from-ca-file: %v", err)
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			rlogger.Log(logger, rlogger.Warn, "msg", "no certs found in from-ca-file", "source", s.Name)
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+
+	client := &http.Client{Transport: transport}
+	if cfg.Debug {
+		client.Transport = metricshttp.NewDebugRoundTripper(logger, client.Transport)
+	}
+	token := s.Token
+	if len(token) == 0 && len(s.TokenFile) > 0 {
+		data, err := ioutil.ReadFile(s.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read from-token-file: %v", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if len(token) > 0 {
+		client.Transport = metricshttp.NewBearerRoundTripper(token, client.Transport)
+	}
+
+	// Configure the matching rules.
+	rules := append([]string(nil), s.Rules...)
+	if len(s.RulesFile) > 0 {
+		data, err := ioutil.ReadFile(s.RulesFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read match-file: %v", err)
+		}
+		rules = append(rules, strings.Split(string(data), "\n")...)
+	}
+	for i := 0; i < len(rules); {
+		r := strings.TrimSpace(rules[i])
+		if len(r) == 0 {
+			rules = append(rules[:i], rules[i+1:]...)
+			continue
+		}
+		rules[i] = r
+		i++
+	}
+
+	// Configure the recording rules.
+	var recordingRules []RecordingRule
+	for _, rule := range s.RecordingRules {
+		if len(strings.TrimSpace(rule.Query)) == 0 {
+			continue
+		}
+		if _, err := rule.MetricType(); err != nil {
+			return nil, err
+		}
+		recordingRules = append(recordingRules, rule)
+	}
+	allow, err := newAllowFilter(s.Name, rules, recordingRules)
+	if err != nil {
+		return nil, err
+	}
+
+	var engine *promql.Engine
+	if cfg.LocalRecordingRules && len(recordingRules) > 0 {
+		timeout := cfg.RecordingRuleTimeout
+		if timeout <= 0 {
+			timeout = interval
+		}
+		concurrency := cfg.RecordingRuleConcurrency
+		if concurrency <= 0 {
+			concurrency = defaultRuleConcurrency
+		}
+		engine = promql.NewEngine(promql.EngineOpts{
+			Logger:        log.With(logger, "source", s.Name, "component", "promql"),
+			MaxConcurrent: concurrency,
+			MaxSamples:    maxLocalSamples,
+			Timeout:       timeout,
+		})
+	}
+
+	// Each source gets its own copy of the URL, which is never modified afterwards.
+	u := *s.URL
+	return &source{
+		name:            s.Name,
+		url:             &u,
+		client:          metricsclient.New(logger, client, cfg.LimitBytes, interval, "federate_from"),
+		rules:           rules,
+		recordingRules:  recordingRules,
+		allow:           allow,
+		ruleConcurrency: cfg.RecordingRuleConcurrency,
+		ruleTimeout:     cfg.RecordingRuleTimeout,
+		engine:          engine,
+		partial:         cfg.PartialResponses,
+		logger:          log.With(logger, "source", s.Name),
+	}, nil
+}
+
+// sources returns the configured sources, including the one set with From,
+// with their names defaulted and checked for uniqueness.
+func sources(cfg Config) ([]Source, error) {
+	var ss []Source
+	if cfg.From != nil {
+		ss = append(ss, Source{
+			URL:            cfg.From,
+			Token:          cfg.FromToken,
+			TokenFile:      cfg.FromTokenFile,
+			CAFile:         cfg.FromCAFile,
+			Rules:          cfg.Rules,
+			RulesFile:      cfg.RulesFile,
+			RecordingRules: cfg.RecordingRules,
+		})
+	}
+	ss = append(ss, cfg.Sources...)
+
+	names := make(map[string]struct{})
+	for i := range ss {
+		if len(ss[i].Name) == 0 && ss[i].URL != nil {
+			ss[i].Name = ss[i].URL.Host
+		}
+		if _, ok := names[ss[i].Name]; ok {
+			return nil, fmt.Errorf("duplicate source name %q, sources must have unique names", ss[i].Name)
+		}
+		names[ss[i].Name] = struct{}{}
+	}
+	return ss, nil
+}
+
+// fetchResult is the outcome of retrieving the metrics of a source.
+type fetchResult struct {
+	// families are the families remaining once transformed.
+	families []*clientmodel.MetricFamily
+	// fetched is the number of series retrieved, before they were transformed.
+	fetched int
+	// transformed is the time spent transforming the families.
+	transformed time.Duration
+	// err is set when the federated metrics could not be retrieved or transformed.
+	err error
+	// partialErr is set when the response was truncated or malformed and the
+	// families decoded until then are forwarded nonetheless.
+	partialErr error
+	// recordingErr is set when a recording rule could not be evaluated, the
+	// federated metrics are returned nonetheless.
+	recordingErr error
+	// rules are the outcomes of the recording rules.
+	rules []RuleResult
+}
+
+// RuleResult is the outcome of the evaluation of a recording rule.
+type RuleResult struct {
+	Source string `json:"source"`
+	Name   string `json:"name"`
+	// Series is the number of series returned by the rule.
+	Series int `json:"series"`
+	// Duration is the time spent evaluating the rule, in seconds in JSON.
+	Duration Duration `json:"duration"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// transformError is returned when the families were retrieved but could not be transformed.
+type transformError struct {
+	err error
+}
+
+func (e *transformError) Error() string {
+	return e.err.Error()
+}
+
+func (e *transformError) Unwrap() error {
+	return e.err
+}
+
+// pipeline transforms the families one at a time as they are decoded, so that
+// only the series remaining once transformed are held in memory.
+type pipeline struct {
+	// allow drops the series outside of the match rules of the source, before
+	// they are copied for the recording rules.
+	allow        metricfamily.Transformer
+	transformers []metricfamily.Transformer
+	result       *fetchResult
+	// series, if set, receives a copy of the series of the families allowed by the
+	// match rules, before they are transformed, to evaluate the recording rules locally.
+	series *[]promql.Series
+}
+
+func (p pipeline) add(family *clientmodel.MetricFamily) error {
+	p.result.fetched += len(family.Metric)
+	if p.allow != nil {
+		ok, err := p.transform(family, p.allow)
+		if err != nil || !ok {
+			return err
+		}
+	}
+	if p.series != nil {
+		*p.series = append(*p.series, metricsclient.ToSeries([]*clientmodel.MetricFamily{family})...)
+	}
+	ok, err := p.transform(family, p.transformers...)
+	if err != nil || !ok {
+		return err
+	}
+	if len(family.Metric) > 0 {
+		p.result.families = append(p.result.families, family)
+	}
+	return nil
+}
+
+// transform applies the transformers to the family, and returns whether it is kept.
+func (p pipeline) transform(family *clientmodel.MetricFamily, transformers ...metricfamily.Transformer) (bool, error) {
+	start := time.Now()
+	defer func() { p.result.transformed += time.Since(start) }()
+	for _, t := range transformers {
+		ok, err := t.Transform(family)
+		if err != nil {
+			return false, &transformError{err: err}
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// fetch retrieves the federated and recording metrics of the source, and
+// applies the transformer to them as they are decoded. The series outside of the
+// match rules of the source are dropped first, then if label is set, the series
+// are labelled with the name of the source.
+func (s *source) fetch(ctx context.Context, label string, transformer metricfamily.Transformer) fetchResult {
+	start := time.Now()
+	defer func() {
+		histogramScrapeDuration.WithLabelValues(s.name).Observe(time.Since(start).Seconds())
+	}()
+
+	var r fetchResult
+	p := pipeline{allow: s.allow, result: &r}
+	if s.engine != nil {
+		p.series = &[]promql.Series{}
+	}
+	if len(label) > 0 {
+		p.transformers = append(p.transformers, metricfamily.NewLabel(map[string]string{label: s.name}, nil))
+	}
+	if transformer != nil {
+		p.transformers = append(p.transformers, transformer)
+	}
+
+	if err := s.getFederateMetrics(ctx, p.add); err != nil {
+		counterSourceErrors.WithLabelValues(s.name).Inc()
+		if s.partial != PartialResponseForward || !metricsclient.IsPartial(err) {
+			return fetchResult{err: err}
+		}
+		r.partialErr = err
+	}
+
+	var local storage.Queryable
+	if p.series != nil {
+		local = newLocalStorage(*p.series)
+		p.series = nil
+	}
+	rfamilies, rules, err := s.getRecordingMetrics(ctx, local)
+	r.rules = rules
+	if err != nil {
+		r.recordingErr = err
+	}
+	for _, family := range rfamilies {
+		if err := p.add(family); err != nil {
+			r.err = err
+			return r
+		}
+	}
+	gaugeSourceSamples.WithLabelValues(s.name).Set(float64(r.fetched))
+	return r
+}
+
+// getFederateMetrics retrieves the federated metrics and passes each family to fn.
+func (s *source) getFederateMetrics(ctx context.Context, fn func(*clientmodel.MetricFamily) error) error {
+	// Copy the URL, otherwise the match rules would be appended on every scrape.
+	from := *s.url
+	v := url.Values{}
+	for _, rule := range s.rules {
+		v.Add("match[]", rule)
+	}
+	from.RawQuery = v.Encode()
+
+	req := &http.Request{Method: "GET", URL: &from}
+	if err := s.client.RetrieveFunc(ctx, req, fn); err != nil {
+		rlogger.Log(s.logger, rlogger.Warn, "msg", "Failed to retrieve metrics", "err", err)
+		return err
+	}
+	return nil
+}
+
+// getRecordingMetrics evaluates the recording rules concurrently, each with its
+// own timeout, over the local storage if set or with the query API of the source
+// otherwise. The families are returned in the order of the rules, along with the
+// outcome of every rule and the last error.
+func (s *source) getRecordingMetrics(ctx context.Context, local storage.Queryable) ([]*clientmodel.MetricFamily, []RuleResult, error) {
+	if len(s.recordingRules) == 0 {
+		return nil, nil, nil
+	}
+	concurrency := s.ruleConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultRuleConcurrency
+	}
+
+	rfamilies := make([][]*clientmodel.MetricFamily, len(s.recordingRules))
+	results := make([]RuleResult, len(s.recordingRules))
+	errs := make([]error, len(s.recordingRules))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, rule := range s.recordingRules {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, rule RecordingRule) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			rfamilies[i], results[i], errs[i] = s.evaluateRule(ctx, rule, local)
+		}(i, rule)
+	}
+	wg.Wait()
+
+	var families []*clientmodel.MetricFamily
+	var e error
+	for i := range s.recordingRules {
+		families = append(families, rfamilies[i]...)
+		if errs[i] != nil {
+			e = errs[i]
+		}
+	}
+	return families, results, e
+}
+
+// evaluateRule evaluates a single recording rule over the local storage if set,
+// or with the query API of the source otherwise.
+func (s *source) evaluateRule(ctx context.Context, rule RecordingRule, local storage.Queryable) ([]*clientmodel.MetricFamily, RuleResult, error) {
+	start := time.Now()
+	result := RuleResult{Source: s.name, Name: rule.Name}
+	if s.ruleTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.ruleTimeout)
+		defer cancel()
+	}
+
+	// The type was validated when the source was created.
+	typ, _ := rule.MetricType()
+	var families []*clientmodel.MetricFamily
+	var err error
+	if local != nil {
+		families, err = s.evaluateLocally(ctx, rule, typ, local)
+	} else {
+		// The URL of the source is shared by the rules evaluated concurrently, so
+		// every request gets its own copy.
+		from := *s.url
+		from.Path = "/api/v1/query"
+		from.RawQuery = url.Values{"query": []string{rule.Query}}.Encode()
+
+		req := &http.Request{Method: "GET", URL: &from}
+		families, err = s.client.RetrieveQuery(ctx, req, rule.Name, typ)
+	}
+	elapsed := time.Since(start)
+	result.Duration = Duration(elapsed)
+	histogramRuleDuration.WithLabelValues(s.name, rule.Name).Observe(elapsed.Seconds())
+	if err != nil {
+		rlogger.Log(s.logger, rlogger.Warn, "msg", "Failed to retrieve recording metrics", "rule", rule.Name, "err", err)
+		counterRuleEvaluations.WithLabelValues(s.name, rule.Name, "error").Inc()
+		result.Error = err.Error()
+		return nil, result, err
+	}
+	counterRuleEvaluations.WithLabelValues(s.name, rule.Name, "success").Inc()
+	result.Series = metricfamily.MetricsCount(families)
+	gaugeRuleSeries.WithLabelValues(s.name, rule.Name).Set(float64(result.Series))
+	return families, result, nil
+}
+
+// evaluateLocally evaluates a recording rule with the embedded promql engine.
+func (s *source) evaluateLocally(ctx context.Context, rule RecordingRule, typ clientmodel.MetricType, local storage.Queryable) ([]*clientmodel.MetricFamily, error) {
+	q, err := s.engine.NewInstantQuery(local, rule.Query, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	// The points of the result are recycled once the query is closed.
+	defer q.Close()
+	res := q.Exec(ctx)
+	if res.Err != nil {
+		return nil, res.Err
+	}
+	for _, w := range res.Warnings {
+		rlogger.Log(s.logger, rlogger.Warn, "msg", "query returned a warning", "rule", rule.Name, "warning", w)
+	}
+	family, err := metricsclient.FamilyFromValue(rule.Name, typ, res.Value)
+	if err != nil || family == nil {
+		return nil, err
+	}
+	return []*clientmodel.MetricFamily{family}, nil
+}
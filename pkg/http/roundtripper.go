@@ -29,6 +29,23 @@ func (rt *bearerRoundTripper) RoundTrip(req *http.Request) (*http.Response, erro
 	return rt.wrapper.RoundTrip(req)
 }
 
+type headerRoundTripper struct {
+	headers map[string]string
+	wrapper http.RoundTripper
+}
+
+// NewHeaderRoundTripper sets the given headers on every request.
+func NewHeaderRoundTripper(headers map[string]string, rt http.RoundTripper) http.RoundTripper {
+	return &headerRoundTripper{headers: headers, wrapper: rt}
+}
+
+func (rt *headerRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	for k, v := range rt.headers {
+		req.Header.Set(k, v)
+	}
+	return rt.wrapper.RoundTrip(req)
+}
+
 type debugRoundTripper struct {
 	next   http.RoundTripper
 	logger log.Logger
@@ -1,7 +1,7 @@
 package http
 
 import (
-	"fmt"
+	"encoding/json"
 	"net/http"
 	"net/http/pprof"
 
@@ -19,13 +19,28 @@ func DebugRoutes(mux *http.ServeMux) *http.ServeMux {
 	return mux
 }
 
-// HealthRoutes adds the health checks to a mux.
-func HealthRoutes(mux *http.ServeMux) *http.ServeMux {
-	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) { fmt.Fprintln(w, "ok") })
-	mux.HandleFunc("/healthz/ready", func(w http.ResponseWriter, req *http.Request) { fmt.Fprintln(w, "ok") })
+// Probe reports whether a health check passes, along with details returned as JSON.
+type Probe func() (bool, interface{})
+
+// HealthRoutes adds the liveness and readiness checks to a mux. A failing
+// check answers with a 503 status code.
+func HealthRoutes(mux *http.ServeMux, live, ready Probe) *http.ServeMux {
+	mux.Handle("/healthz", probeHandler(live))
+	mux.Handle("/healthz/ready", probeHandler(ready))
 	return mux
 }
 
+func probeHandler(probe Probe) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ok, details := probe()
+		w.Header().Set("Content-Type", "application/json")
+		if !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(details)
+	})
+}
+
 // MetricRoutes adds the metrics endpoint to a mux.
 func MetricRoutes(mux *http.ServeMux) *http.ServeMux {
 	mux.Handle("/metrics", promhttp.Handler())
@@ -33,6 +48,7 @@ func MetricRoutes(mux *http.ServeMux) *http.ServeMux {
 }
 
 // ReloadRoutes adds the reload endpoint to a mux.
+// If reload fails, the error is reported in the response body.
 func ReloadRoutes(mux *http.ServeMux, reload func() error) *http.ServeMux {
 	mux.HandleFunc("/-/reload", func(w http.ResponseWriter, req *http.Request) {
 		if req.Method != http.MethodPost {
@@ -41,7 +57,7 @@ func ReloadRoutes(mux *http.ServeMux, reload func() error) *http.ServeMux {
 		}
 
 		if err := reload(); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		w.WriteHeader(http.StatusOK)
@@ -0,0 +1,261 @@
+package metricfamily
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+// CardinalityLimits bounds the number of series forwarded. A zero limit disables it.
+type CardinalityLimits struct {
+	// MaxSeries is the maximum number of series across all metrics.
+	MaxSeries int
+	// MaxSeriesPerMetric is the maximum number of series of a single metric name.
+	MaxSeriesPerMetric int
+	// PerMetric overrides MaxSeriesPerMetric for the given metric names.
+	PerMetric map[string]int
+}
+
+// Enabled reports whether any limit is set.
+func (l CardinalityLimits) Enabled() bool {
+	return l.MaxSeries > 0 || l.MaxSeriesPerMetric > 0 || len(l.PerMetric) > 0
+}
+
+func (l CardinalityLimits) forMetric(name string) int {
+	if limit, ok := l.PerMetric[name]; ok {
+		return limit
+	}
+	return l.MaxSeriesPerMetric
+}
+
+// CardinalityViolation describes a limit that was exceeded.
+type CardinalityViolation struct {
+	// Global is set when the limit across all metrics was exceeded.
+	Global bool
+	// Metric is the metric name whose limit was exceeded, or the one with the
+	// most series when the global limit was exceeded.
+	Metric string
+	// Label is the label with the most distinct values among the series of the
+	// metric, which is usually the one responsible for the explosion.
+	Label string
+	// Series is the number of series before limiting, Limit the number kept.
+	Series int
+	Limit  int
+	// Dropped are the series dropped of every metric trimmed, by metric name.
+	Dropped []CardinalityDrop
+}
+
+// CardinalityDrop is the number of series of a metric dropped by a limit.
+type CardinalityDrop struct {
+	Metric string
+	// Label is the label with the most distinct values among the series of the metric.
+	Label  string
+	Series int
+}
+
+// CardinalityLimiter is a Transformer dropping the series of the metrics that
+// exceed their limit. The series kept are the ones with the lowest hash of their
+// labels, so that the same series are kept from one cycle to the next as long
+// as they exist, rather than a random subset.
+type CardinalityLimiter struct {
+	limits CardinalityLimits
+
+	mu         sync.Mutex
+	violations []CardinalityViolation
+}
+
+// NewCardinalityLimiter returns a limiter enforcing the given limits.
+func NewCardinalityLimiter(limits CardinalityLimits) *CardinalityLimiter {
+	return &CardinalityLimiter{limits: limits}
+}
+
+// Transform implements the Transformer interface, enforcing the per-metric limit
+// on a single family. Limit enforces it across the families of the same name.
+func (t *CardinalityLimiter) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	t.limitMetric(family.GetName(), appendSeries(nil, family))
+	return true, nil
+}
+
+// limitMetric enforces the limit of the metric on its series, which may belong
+// to several families.
+func (t *CardinalityLimiter) limitMetric(name string, series []hashedSeries) {
+	limit := t.limits.forMetric(name)
+	if limit <= 0 || len(series) <= limit {
+		return
+	}
+
+	label := topLabel(series)
+	t.mu.Lock()
+	t.violations = append(t.violations, CardinalityViolation{
+		Metric:  name,
+		Label:   label,
+		Series:  len(series),
+		Limit:   limit,
+		Dropped: []CardinalityDrop{{Metric: name, Label: label, Series: len(series) - limit}},
+	})
+	t.mu.Unlock()
+	dropHighest(series, limit)
+}
+
+// Limit enforces the per-metric limits and then the global limit across all
+// families. It returns the limits exceeded by this call. Dropped series are set
+// to nil.
+func (t *CardinalityLimiter) Limit(families []*clientmodel.MetricFamily) ([]CardinalityViolation, error) {
+	t.mu.Lock()
+	t.violations = nil
+	t.mu.Unlock()
+
+	// The families of the different sources and recording rules are in the same
+	// list, the series of those sharing a name share the limit of the metric.
+	var names []string
+	byName := make(map[string][]hashedSeries)
+	for _, f := range families {
+		if f == nil {
+			continue
+		}
+		series, ok := byName[f.GetName()]
+		if !ok {
+			names = append(names, f.GetName())
+		}
+		byName[f.GetName()] = appendSeries(series, f)
+	}
+	for _, name := range names {
+		t.limitMetric(name, byName[name])
+	}
+
+	if t.limits.MaxSeries > 0 {
+		var series []hashedSeries
+		for _, f := range families {
+			if f != nil {
+				series = appendSeries(series, f)
+			}
+		}
+		if len(series) > t.limits.MaxSeries {
+			byMetric := make(map[string][]hashedSeries)
+			for _, s := range series {
+				byMetric[s.family.GetName()] = append(byMetric[s.family.GetName()], s)
+			}
+			// The labels are found before the series are dropped.
+			labels := make(map[string]string, len(byMetric))
+			for name, s := range byMetric {
+				labels[name] = topLabel(s)
+			}
+			// Report the metric contributing the most series as the offending one,
+			// but the dropped series against the metrics they belong to.
+			metric := largestMetric(series)
+			violation := CardinalityViolation{
+				Global: true,
+				Metric: metric,
+				Label:  labels[metric],
+				Series: len(series),
+				Limit:  t.limits.MaxSeries,
+			}
+			dropped := make(map[string]int)
+			for _, s := range dropHighest(series, t.limits.MaxSeries) {
+				dropped[s.family.GetName()]++
+			}
+			for name, n := range dropped {
+				violation.Dropped = append(violation.Dropped, CardinalityDrop{Metric: name, Label: labels[name], Series: n})
+			}
+			sort.Slice(violation.Dropped, func(i, j int) bool { return violation.Dropped[i].Metric < violation.Dropped[j].Metric })
+			t.mu.Lock()
+			t.violations = append(t.violations, violation)
+			t.mu.Unlock()
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.violations, nil
+}
+
+type hashedSeries struct {
+	family *clientmodel.MetricFamily
+	index  int
+	hash   uint64
+}
+
+func (s hashedSeries) metric() *clientmodel.Metric {
+	return s.family.Metric[s.index]
+}
+
+// appendSeries appends the series of the family that were not dropped.
+func appendSeries(series []hashedSeries, family *clientmodel.MetricFamily) []hashedSeries {
+	for i, m := range family.Metric {
+		if m != nil {
+			series = append(series, hashedSeries{family: family, index: i, hash: hashLabels(family.GetName(), m)})
+		}
+	}
+	return series
+}
+
+// dropHighest keeps the limit series with the lowest hashes, drops the others
+// and returns them.
+func dropHighest(series []hashedSeries, limit int) []hashedSeries {
+	sort.Slice(series, func(i, j int) bool { return series[i].hash < series[j].hash })
+	for _, s := range series[limit:] {
+		s.family.Metric[s.index] = nil
+	}
+	return series[limit:]
+}
+
+// hashLabels returns a hash of the metric name and labels, independent of the order of the labels.
+func hashLabels(name string, m *clientmodel.Metric) uint64 {
+	pairs := make([]*clientmodel.LabelPair, 0, len(m.Label))
+	for _, l := range m.Label {
+		if l != nil {
+			pairs = append(pairs, l)
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].GetName() < pairs[j].GetName() })
+
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	for _, l := range pairs {
+		h.Write([]byte{0xff})
+		h.Write([]byte(l.GetName()))
+		h.Write([]byte{0xff})
+		h.Write([]byte(l.GetValue()))
+	}
+	return h.Sum64()
+}
+
+// topLabel returns the label name with the most distinct values among the series.
+func topLabel(series []hashedSeries) string {
+	values := make(map[string]map[string]struct{})
+	for _, s := range series {
+		for _, l := range s.metric().Label {
+			if l == nil {
+				continue
+			}
+			if values[l.GetName()] == nil {
+				values[l.GetName()] = make(map[string]struct{})
+			}
+			values[l.GetName()][l.GetValue()] = struct{}{}
+		}
+	}
+	var top string
+	for name, v := range values {
+		if len(v) > len(values[top]) || (len(v) == len(values[top]) && name < top) {
+			top = name
+		}
+	}
+	return top
+}
+
+// largestMetric returns the metric name with the most series.
+func largestMetric(series []hashedSeries) string {
+	counts := make(map[string]int)
+	for _, s := range series {
+		counts[s.family.GetName()]++
+	}
+	var top string
+	for name, c := range counts {
+		if c > counts[top] || (c == counts[top] && name < top) {
+			top = name
+		}
+	}
+	return top
+}
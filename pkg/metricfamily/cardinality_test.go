@@ -0,0 +1,192 @@
+package metricfamily
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestCardinalityLimiter(t *testing.T) {
+	strPnt := func(str string) *string {
+		return &str
+	}
+	family := func(name string, pods int) *clientmodel.MetricFamily {
+		var labels [][]*clientmodel.LabelPair
+		for i := 0; i < pods; i++ {
+			labels = append(labels, []*clientmodel.LabelPair{
+				{Name: strPnt("namespace"), Value: strPnt("default")},
+				{Name: strPnt("pod"), Value: strPnt(fmt.Sprintf("pod-%d", i))},
+			})
+		}
+		return familyWithLabels(name, labels...)
+	}
+	kept := func(families []*clientmodel.MetricFamily) map[string][]string {
+		res := make(map[string][]string)
+		for _, f := range families {
+			for _, m := range f.Metric {
+				if m != nil {
+					res[f.GetName()] = append(res[f.GetName()], m.Label[1].GetValue())
+				}
+			}
+		}
+		return res
+	}
+
+	limiter := NewCardinalityLimiter(CardinalityLimits{
+		MaxSeries:          8,
+		MaxSeriesPerMetric: 5,
+		PerMetric:          map[string]int{"small": 1},
+	})
+	families := []*clientmodel.MetricFamily{family("a", 3), family("b", 10), family("small", 2)}
+	violations, err := limiter.Limit(families)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	first := kept(families)
+	total := 0
+	for _, pods := range first {
+		total += len(pods)
+	}
+	if total != 8 || len(first["small"]) != 1 || len(first["b"]) > 5 {
+		t.Errorf("unexpected series kept: %v", first)
+	}
+	// The series over the global limit are dropped from the metrics trimmed.
+	var global []CardinalityDrop
+	for _, name := range []string{"a", "b", "small"} {
+		before := map[string]int{"a": 3, "b": 5, "small": 1}[name]
+		if n := before - len(first[name]); n > 0 {
+			global = append(global, CardinalityDrop{Metric: name, Label: "pod", Series: n})
+		}
+	}
+	want := []CardinalityViolation{
+		{Metric: "b", Label: "pod", Series: 10, Limit: 5, Dropped: []CardinalityDrop{{Metric: "b", Label: "pod", Series: 5}}},
+		{Metric: "small", Label: "pod", Series: 2, Limit: 1, Dropped: []CardinalityDrop{{Metric: "small", Label: "pod", Series: 1}}},
+		{Global: true, Metric: "b", Label: "pod", Series: 9, Limit: 8, Dropped: global},
+	}
+	if !reflect.DeepEqual(violations, want) {
+		t.Errorf("want violations %+v, got %+v", want, violations)
+	}
+
+	// The same series are kept regardless of the order they are received in.
+	reversed := []*clientmodel.MetricFamily{family("small", 2), family("b", 10), family("a", 3)}
+	for _, f := range reversed {
+		for i, j := 0, len(f.Metric)-1; i < j; i, j = i+1, j-1 {
+			f.Metric[i], f.Metric[j] = f.Metric[j], f.Metric[i]
+		}
+	}
+	if _, err := limiter.Limit(reversed); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	second := kept(reversed)
+	for name, pods := range first {
+		if !sameElements(pods, second[name]) {
+			t.Errorf("metric %s: kept %v then %v", name, pods, second[name])
+		}
+	}
+
+	// No violation is reported once under the limits.
+	violations, _ = limiter.Limit([]*clientmodel.MetricFamily{family("a", 3)})
+	if len(violations) != 0 {
+		t.Errorf("expected no violations, got %+v", violations)
+	}
+}
+
+func TestCardinalityLimiterGlobalDrops(t *testing.T) {
+	strPnt := func(str string) *string {
+		return &str
+	}
+	family := func(name string, n int) *clientmodel.MetricFamily {
+		var labels [][]*clientmodel.LabelPair
+		for i := 0; i < n; i++ {
+			labels = append(labels, []*clientmodel.LabelPair{{Name: strPnt("pod"), Value: strPnt(fmt.Sprintf("pod-%d", i))}})
+		}
+		return familyWithLabels(name, labels...)
+	}
+	families := []*clientmodel.MetricFamily{family("a", 20), family("b", 20)}
+	violations, err := NewCardinalityLimiter(CardinalityLimits{MaxSeries: 20}).Limit(families)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(violations) != 1 || !violations[0].Global {
+		t.Fatalf("expected a global violation, got %+v", violations)
+	}
+
+	// Every dropped series is counted against its own metric, not the largest one.
+	var want []CardinalityDrop
+	for _, f := range families {
+		dropped := 0
+		for _, m := range f.Metric {
+			if m == nil {
+				dropped++
+			}
+		}
+		want = append(want, CardinalityDrop{Metric: f.GetName(), Label: "pod", Series: dropped})
+	}
+	if want[0].Series == 0 || want[1].Series == 0 || want[0].Series+want[1].Series != 20 {
+		t.Fatalf("expected 20 series dropped from both metrics, got %+v", want)
+	}
+	if !reflect.DeepEqual(violations[0].Dropped, want) {
+		t.Errorf("want dropped %+v, got %+v", want, violations[0].Dropped)
+	}
+}
+
+func TestCardinalityLimiterSameName(t *testing.T) {
+	strPnt := func(str string) *string {
+		return &str
+	}
+	family := func(name, source string, n int) *clientmodel.MetricFamily {
+		var labels [][]*clientmodel.LabelPair
+		for i := 0; i < n; i++ {
+			labels = append(labels, []*clientmodel.LabelPair{
+				{Name: strPnt("source"), Value: strPnt(source)},
+				{Name: strPnt("pod"), Value: strPnt(fmt.Sprintf("pod-%d", i))},
+			})
+		}
+		return familyWithLabels(name, labels...)
+	}
+
+	// The families of two sources with the same name share the limit of the metric.
+	families := []*clientmodel.MetricFamily{family("a", "first", 4), family("b", "first", 2), family("a", "second", 4)}
+	violations, err := NewCardinalityLimiter(CardinalityLimits{MaxSeriesPerMetric: 5}).Limit(families)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	kept := make(map[string]int)
+	for _, f := range families {
+		for _, m := range f.Metric {
+			if m != nil {
+				kept[f.GetName()]++
+			}
+		}
+	}
+	if kept["a"] != 5 || kept["b"] != 2 {
+		t.Errorf("expected 5 series of a and 2 of b to be kept, got %v", kept)
+	}
+	want := []CardinalityViolation{
+		{Metric: "a", Label: "pod", Series: 8, Limit: 5, Dropped: []CardinalityDrop{{Metric: "a", Label: "pod", Series: 3}}},
+	}
+	if !reflect.DeepEqual(violations, want) {
+		t.Errorf("want violations %+v, got %+v", want, violations)
+	}
+}
+
+func sameElements(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := make(map[string]int)
+	for _, s := range a {
+		set[s]++
+	}
+	for _, s := range b {
+		set[s]--
+	}
+	for _, c := range set {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,44 @@
+package metricfamily
+
+import (
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+)
+
+type denylist [][]*labels.Matcher
+
+// NewDenylist returns a Transformer that drops the metrics matching at least
+// one rule in the denylist. It is the opposite of NewWhitelist.
+// This Transformer will nil metrics within a metric family that match a rule.
+// Matchsets are OR-ed and individual matchers within a matchset are AND-ed, as in PromQL.
+func NewDenylist(rules []string) (Transformer, error) {
+	var ms [][]*labels.Matcher
+	for i := range rules {
+		matchers, err := promql.ParseMetricSelector(rules[i])
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, matchers)
+	}
+	return denylist(ms), nil
+}
+
+// Transform implements the Transformer interface.
+func (t denylist) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	var ok bool
+Metric:
+	for i, m := range family.Metric {
+		if m == nil {
+			continue
+		}
+		for _, matchset := range t {
+			if match(family.GetName(), m, matchset...) {
+				family.Metric[i] = nil
+				continue Metric
+			}
+		}
+		ok = true
+	}
+	return ok, nil
+}
@@ -0,0 +1,77 @@
+package metricfamily
+
+import (
+	"reflect"
+	"testing"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestDenylist(t *testing.T) {
+	strPnt := func(str string) *string {
+		return &str
+	}
+	pair := func(name, value string) *clientmodel.LabelPair {
+		return &clientmodel.LabelPair{Name: strPnt(name), Value: strPnt(value)}
+	}
+
+	c := familyWithLabels("C",
+		[]*clientmodel.LabelPair{pair("method", "POST"), pair("status", "200")},
+		[]*clientmodel.LabelPair{pair("method", "GET"), pair("status", "200")},
+		[]*clientmodel.LabelPair{pair("method", "POST"), pair("status", "500")},
+	)
+
+	for _, tc := range []struct {
+		name  string
+		rules []string
+		ok    bool
+		want  *clientmodel.MetricFamily
+	}{
+		{
+			name:  "keep C",
+			rules: []string{`{__name__="A"}`},
+			ok:    true,
+			want:  c,
+		},
+		{
+			name:  "drop C",
+			rules: []string{`{__name__="C"}`},
+			ok:    false,
+			want:  setNilMetric(c, 0, 1, 2),
+		},
+		{
+			name:  "drop parts of C",
+			rules: []string{`{method="POST"}`},
+			ok:    true,
+			want:  setNilMetric(c, 0, 2),
+		},
+		{
+			name:  "multiple rules",
+			rules: []string{`{method="GET"}`, `{status="500"}`},
+			ok:    true,
+			want:  setNilMetric(c, 1, 2),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			denylist, err := NewDenylist(tc.rules)
+			if err != nil {
+				t.Fatalf("failed to create denylist: %v", err)
+			}
+			f := copyMetric(c)
+			ok, err := denylist.Transform(f)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ok != tc.ok {
+				t.Errorf("want ok %t, got %t", tc.ok, ok)
+			}
+			if !reflect.DeepEqual(tc.want, f) {
+				t.Errorf("want metricfamily %v, got %v", tc.want, f)
+			}
+		})
+	}
+
+	if _, err := NewDenylist([]string{"up{"}); err == nil {
+		t.Error("expected an error for an invalid rule")
+	}
+}
@@ -9,6 +9,7 @@ import (
 
 type errorInvalidFederateSamples struct {
 	min int64
+	max int64
 }
 
 func NewErrorInvalidFederateSamples(min time.Time) Transformer {
@@ -56,6 +57,9 @@ func (t *errorInvalidFederateSamples) Transform(family *clientmodel.MetricFamily
 		if *m.TimestampMs < t.min {
 			return false, ErrTimestampTooOld
 		}
+		if t.max > 0 && *m.TimestampMs > t.max {
+			return false, ErrTimestampInFuture
+		}
 		switch t := *family.Type; t {
 		case clientmodel.MetricType_COUNTER:
 			if m.Counter == nil || m.Gauge != nil || m.Histogram != nil || m.Summary != nil || m.Untyped != nil {
@@ -82,34 +86,110 @@ func (t *errorInvalidFederateSamples) Transform(family *clientmodel.MetricFamily
 	return true, nil
 }
 
+// InvalidSampleReason is the reason an invalid sample was rejected.
+type InvalidSampleReason string
+
+const (
+	ReasonEmptyName        InvalidSampleReason = "empty_name"
+	ReasonNameTooLong      InvalidSampleReason = "name_too_long"
+	ReasonUnknownType      InvalidSampleReason = "unknown_type"
+	ReasonLabelTooLong     InvalidSampleReason = "label_too_long"
+	ReasonInvalidLabelName InvalidSampleReason = "invalid_label_name"
+	ReasonMissingTimestamp InvalidSampleReason = "missing_timestamp"
+	ReasonStaleTimestamp   InvalidSampleReason = "stale_timestamp"
+	ReasonFutureTimestamp  InvalidSampleReason = "future_timestamp"
+	ReasonTypeMismatch     InvalidSampleReason = "type_mismatch"
+)
+
+// InvalidSampleReporter is called for every series dropped, or label removed,
+// because it is invalid. The metric is nil when the whole family is rejected.
+type InvalidSampleReporter func(reason InvalidSampleReason, family *clientmodel.MetricFamily, metric *clientmodel.Metric)
+
 type dropInvalidFederateSamples struct {
-	min int64
+	min    int64
+	max    int64
+	report InvalidSampleReporter
+	strict map[string]struct{}
 }
 
 func NewDropInvalidFederateSamples(min time.Time) Transformer {
-	return &dropInvalidFederateSamples{
-		min: min.Unix() * 1000,
+	return NewReportInvalidFederateSamples(min, time.Time{}, nil, nil)
+}
+
+// NewReportInvalidFederateSamples drops invalid samples like NewDropInvalidFederateSamples
+// and reports each of them. Samples after max are dropped as well, unless max is zero.
+// The metrics listed in strictMetrics are checked like NewErrorInvalidFederateSamples
+// instead, failing the transformation if invalid.
+func NewReportInvalidFederateSamples(min, max time.Time, report InvalidSampleReporter, strictMetrics []string) Transformer {
+	t := &dropInvalidFederateSamples{
+		min:    min.Unix() * 1000,
+		report: report,
+	}
+	if !max.IsZero() {
+		t.max = max.Unix() * 1000
+	}
+	if len(strictMetrics) > 0 {
+		t.strict = make(map[string]struct{}, len(strictMetrics))
+		for _, name := range strictMetrics {
+			t.strict[name] = struct{}{}
+		}
+	}
+	return t
+}
+
+func (t *dropInvalidFederateSamples) reject(reason InvalidSampleReason, family *clientmodel.MetricFamily, m *clientmodel.Metric) {
+	if t.report != nil {
+		t.report(reason, family, m)
+	}
+}
+
+// rejectFamily reports every series of a family rejected as a whole.
+func (t *dropInvalidFederateSamples) rejectFamily(reason InvalidSampleReason, family *clientmodel.MetricFamily) {
+	if t.report == nil {
+		return
+	}
+	reported := false
+	for _, m := range family.Metric {
+		if m != nil {
+			t.report(reason, family, m)
+			reported = true
+		}
+	}
+	if !reported {
+		t.report(reason, family, nil)
 	}
 }
 
 func (t *dropInvalidFederateSamples) Transform(family *clientmodel.MetricFamily) (bool, error) {
 	name := family.GetName()
+	if _, ok := t.strict[name]; ok {
+		strict := errorInvalidFederateSamples{min: t.min, max: t.max}
+		ok, err := strict.Transform(family)
+		if err != nil {
+			return ok, fmt.Errorf("invalid sample for metric %s: %w", name, err)
+		}
+		return ok, nil
+	}
 	if len(name) == 0 {
+		t.rejectFamily(ReasonEmptyName, family)
 		return false, nil
 	}
 	if len(name) > 255 {
+		t.rejectFamily(ReasonNameTooLong, family)
 		return false, nil
 	}
 	if family.Type == nil {
+		t.rejectFamily(ReasonUnknownType, family)
 		return false, nil
 	}
-	switch t := *family.Type; t {
+	switch *family.Type {
 	case clientmodel.MetricType_COUNTER:
 	case clientmodel.MetricType_GAUGE:
 	case clientmodel.MetricType_HISTOGRAM:
 	case clientmodel.MetricType_SUMMARY:
 	case clientmodel.MetricType_UNTYPED:
 	default:
+		t.rejectFamily(ReasonUnknownType, family)
 		return false, nil
 	}
 
@@ -117,50 +197,71 @@ func (t *dropInvalidFederateSamples) Transform(family *clientmodel.MetricFamily)
 		if m == nil {
 			continue
 		}
-		packLabels := false
-		for j, label := range m.Label {
-			if label.Name == nil || len(*label.Name) == 0 || len(*label.Name) > 255 {
-				m.Label[j] = nil
-				packLabels = true
-			}
-			if label.Value == nil || len(*label.Value) > 255 {
-				m.Label[j] = nil
-				packLabels = true
+		if reason := invalidLabelReason(m); reason != "" {
+			// Report the series before removing the offending labels, so they can be identified.
+			t.reject(reason, family, m)
+			for j, label := range m.Label {
+				if !validLabel(label) {
+					m.Label[j] = nil
+				}
 			}
-		}
-		if packLabels {
 			m.Label = PackLabels(m.Label)
 		}
-		if m.TimestampMs == nil || *m.TimestampMs < t.min {
+		if m.TimestampMs == nil {
+			t.reject(ReasonMissingTimestamp, family, m)
 			family.Metric[i] = nil
 			continue
 		}
-		switch t := *family.Type; t {
+		if *m.TimestampMs < t.min {
+			t.reject(ReasonStaleTimestamp, family, m)
+			family.Metric[i] = nil
+			continue
+		}
+		if t.max > 0 && *m.TimestampMs > t.max {
+			t.reject(ReasonFutureTimestamp, family, m)
+			family.Metric[i] = nil
+			continue
+		}
+		mismatch := false
+		switch *family.Type {
 		case clientmodel.MetricType_COUNTER:
-			if m.Counter == nil || m.Gauge != nil || m.Histogram != nil || m.Summary != nil || m.Untyped != nil {
-				family.Metric[i] = nil
-			}
+			mismatch = m.Counter == nil || m.Gauge != nil || m.Histogram != nil || m.Summary != nil || m.Untyped != nil
 		case clientmodel.MetricType_GAUGE:
-			if m.Counter != nil || m.Gauge == nil || m.Histogram != nil || m.Summary != nil || m.Untyped != nil {
-				family.Metric[i] = nil
-			}
+			mismatch = m.Counter != nil || m.Gauge == nil || m.Histogram != nil || m.Summary != nil || m.Untyped != nil
 		case clientmodel.MetricType_HISTOGRAM:
-			if m.Counter != nil || m.Gauge != nil || m.Histogram == nil || m.Summary != nil || m.Untyped != nil {
-				family.Metric[i] = nil
-			}
+			mismatch = m.Counter != nil || m.Gauge != nil || m.Histogram == nil || m.Summary != nil || m.Untyped != nil
 		case clientmodel.MetricType_SUMMARY:
-			if m.Counter != nil || m.Gauge != nil || m.Histogram != nil || m.Summary == nil || m.Untyped != nil {
-				family.Metric[i] = nil
-			}
+			mismatch = m.Counter != nil || m.Gauge != nil || m.Histogram != nil || m.Summary == nil || m.Untyped != nil
 		case clientmodel.MetricType_UNTYPED:
-			if m.Counter != nil || m.Gauge != nil || m.Histogram != nil || m.Summary != nil || m.Untyped == nil {
-				family.Metric[i] = nil
-			}
+			mismatch = m.Counter != nil || m.Gauge != nil || m.Histogram != nil || m.Summary != nil || m.Untyped == nil
+		}
+		if mismatch {
+			t.reject(ReasonTypeMismatch, family, m)
+			family.Metric[i] = nil
 		}
 	}
 	return true, nil
 }
 
+func validLabel(label *clientmodel.LabelPair) bool {
+	return label != nil && label.Name != nil && len(*label.Name) > 0 && len(*label.Name) <= 255 &&
+		label.Value != nil && len(*label.Value) <= 255
+}
+
+// invalidLabelReason returns the reason the first invalid label of the metric
+// is rejected for, or an empty reason if all its labels are valid.
+func invalidLabelReason(m *clientmodel.Metric) InvalidSampleReason {
+	for _, label := range m.Label {
+		switch {
+		case label == nil || len(label.GetName()) == 0:
+			return ReasonInvalidLabelName
+		case !validLabel(label):
+			return ReasonLabelTooLong
+		}
+	}
+	return ""
+}
+
 // PackLabels fills holes in the label slice by shifting items towards the zero index.
 // It will modify the slice in place.
 func PackLabels(labels []*clientmodel.LabelPair) []*clientmodel.LabelPair {
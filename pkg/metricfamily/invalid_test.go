@@ -0,0 +1,80 @@
+package metricfamily
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestReportInvalidFederateSamples(t *testing.T) {
+	strPnt := func(str string) *string {
+		return &str
+	}
+	now := time.Now()
+	ts := func(t time.Time) *int64 {
+		ms := t.Unix() * 1000
+		return &ms
+	}
+	gauge := func(labels []*clientmodel.LabelPair, at time.Time) *clientmodel.Metric {
+		return &clientmodel.Metric{Label: labels, Gauge: &clientmodel.Gauge{Value: new(float64)}, TimestampMs: ts(at)}
+	}
+	family := func(name string, metrics ...*clientmodel.Metric) *clientmodel.MetricFamily {
+		return &clientmodel.MetricFamily{Name: strPnt(name), Type: clientmodel.MetricType_GAUGE.Enum(), Metric: metrics}
+	}
+	long := strings.Repeat("a", 256)
+
+	var reported []InvalidSampleReason
+	report := func(reason InvalidSampleReason, family *clientmodel.MetricFamily, m *clientmodel.Metric) {
+		reported = append(reported, reason)
+	}
+	transformer := NewReportInvalidFederateSamples(now.Add(-time.Hour), now.Add(time.Minute), report, []string{"strict"})
+
+	valid := gauge(nil, now)
+	mismatch := gauge(nil, now)
+	mismatch.Counter = &clientmodel.Counter{Value: new(float64)}
+	f := family("up",
+		valid,
+		gauge(nil, now.Add(-2*time.Hour)),
+		mismatch,
+		gauge(nil, now.Add(time.Hour)),
+		gauge([]*clientmodel.LabelPair{{Name: strPnt("a"), Value: strPnt(long)}, {Name: strPnt("b"), Value: strPnt("b")}}, now),
+		gauge([]*clientmodel.LabelPair{{Name: strPnt(""), Value: strPnt("a")}, {Value: strPnt("a")}, {Name: strPnt("b"), Value: strPnt("b")}}, now),
+	)
+	ok, err := transformer.Transform(f)
+	if !ok || err != nil {
+		t.Fatalf("unexpected result: %t, %v", ok, err)
+	}
+	if f.Metric[0] != valid || f.Metric[1] != nil || f.Metric[2] != nil || f.Metric[3] != nil {
+		t.Errorf("unexpected metrics kept: %v", f.Metric)
+	}
+	if len(f.Metric[4].Label) != 1 || f.Metric[4].Label[0].GetName() != "b" {
+		t.Errorf("expected the long label to be removed, got %v", f.Metric[4].Label)
+	}
+	if len(f.Metric[5].Label) != 1 || f.Metric[5].Label[0].GetName() != "b" {
+		t.Errorf("expected the unnamed labels to be removed, got %v", f.Metric[5].Label)
+	}
+
+	if ok, err := transformer.Transform(family(long, gauge(nil, now), gauge(nil, now))); ok || err != nil {
+		t.Errorf("unexpected result for a long name: %t, %v", ok, err)
+	}
+
+	want := []InvalidSampleReason{ReasonStaleTimestamp, ReasonTypeMismatch, ReasonFutureTimestamp, ReasonLabelTooLong, ReasonInvalidLabelName, ReasonNameTooLong, ReasonNameTooLong}
+	if !reflect.DeepEqual(reported, want) {
+		t.Errorf("expected reasons %v, got %v", want, reported)
+	}
+
+	// Strict metrics fail instead of being dropped.
+	if _, err := transformer.Transform(family("strict", gauge(nil, now.Add(-2*time.Hour)))); err == nil {
+		t.Error("expected an error for an invalid sample of a strict metric")
+	}
+	if _, err := transformer.Transform(family("strict", gauge(nil, now.Add(time.Hour)))); !errors.Is(err, ErrTimestampInFuture) {
+		t.Errorf("expected a future timestamp error for a strict metric, got %v", err)
+	}
+	if ok, err := transformer.Transform(family("strict", gauge(nil, now))); !ok || err != nil {
+		t.Errorf("unexpected result for a valid strict metric: %t, %v", ok, err)
+	}
+}
@@ -18,10 +18,31 @@ var (
 		Name: "metricscollector_overwritten_timestamps_total",
 		Help: "Number of timestamps that were in the past, present or future",
 	}, []string{"tense"})
+	clampedSamples = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "metricscollector_future_samples_clamped_total",
+		Help: "The number of samples with a timestamp in the future sent with the current time instead",
+	})
 )
 
 func init() {
-	prometheus.MustRegister(overwrittenMetrics)
+	prometheus.MustRegister(overwrittenMetrics, clampedSamples)
+}
+
+// ClampFutureTimestamps sets the timestamps after now to now, and counts them.
+// Samples too far in the future are expected to be dropped beforehand, see
+// NewReportInvalidFederateSamples.
+func ClampFutureTimestamps(now time.Time) TransformerFunc {
+	timestamp := now.UnixNano() / int64(time.Millisecond)
+	return func(family *client.MetricFamily) (bool, error) {
+		for _, m := range family.Metric {
+			if m != nil && m.GetTimestampMs() > timestamp {
+				t := timestamp
+				m.TimestampMs = &t
+				clampedSamples.Inc()
+			}
+		}
+		return true, nil
+	}
 }
 
 // OverwriteTimestamps sets all timestamps to the current time.
@@ -0,0 +1,43 @@
+package metricfamily
+
+import (
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestClampFutureTimestamps(t *testing.T) {
+	clamped := func() float64 {
+		var m clientmodel.Metric
+		if err := clampedSamples.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetCounter().GetValue()
+	}
+	now := time.Unix(1000, 0)
+	timestamp := func(ts int64) *int64 { return &ts }
+	family := &clientmodel.MetricFamily{Metric: []*clientmodel.Metric{
+		{TimestampMs: timestamp(999000)},
+		{TimestampMs: timestamp(1000000)},
+		nil,
+		{TimestampMs: timestamp(1060000)},
+	}}
+
+	before := clamped()
+	transform := ClampFutureTimestamps(now)
+	for i := 0; i < 2; i++ {
+		if ok, err := transform(family); !ok || err != nil {
+			t.Fatalf("unexpected result %t: %v", ok, err)
+		}
+	}
+	for i, want := range map[int]int64{0: 999000, 1: 1000000, 3: 1000000} {
+		if got := family.Metric[i].GetTimestampMs(); got != want {
+			t.Errorf("metric %d: want timestamp %d, got %d", i, want, got)
+		}
+	}
+	// Clamping the same samples again does not count them twice.
+	if got := clamped() - before; got != 1 {
+		t.Errorf("want 1 clamped sample, got %v", got)
+	}
+}
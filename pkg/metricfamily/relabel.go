@@ -0,0 +1,238 @@
+package metricfamily
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+// RelabelAction is the action performed by a relabeling rule.
+type RelabelAction string
+
+const (
+	RelabelReplace   RelabelAction = "replace"
+	RelabelKeep      RelabelAction = "keep"
+	RelabelDrop      RelabelAction = "drop"
+	RelabelHashMod   RelabelAction = "hashmod"
+	RelabelLabelMap  RelabelAction = "labelmap"
+	RelabelLabelDrop RelabelAction = "labeldrop"
+	RelabelLabelKeep RelabelAction = "labelkeep"
+	RelabelLowercase RelabelAction = "lowercase"
+	RelabelUppercase RelabelAction = "uppercase"
+)
+
+// RelabelConfig is a relabeling rule, with the same fields and semantics as the
+// relabel_configs of Prometheus. Empty fields take the Prometheus defaults.
+type RelabelConfig struct {
+	SourceLabels []string      `yaml:"source_labels,flow,omitempty" json:"source_labels,omitempty"`
+	Separator    *string       `yaml:"separator,omitempty" json:"separator,omitempty"`
+	Regex        *string       `yaml:"regex,omitempty" json:"regex,omitempty"`
+	Modulus      uint64        `yaml:"modulus,omitempty" json:"modulus,omitempty"`
+	TargetLabel  string        `yaml:"target_label,omitempty" json:"target_label,omitempty"`
+	Replacement  *string       `yaml:"replacement,omitempty" json:"replacement,omitempty"`
+	Action       RelabelAction `yaml:"action,omitempty" json:"action,omitempty"`
+}
+
+// Validate checks that the rule can be applied. The metric name cannot be
+// written, since a series cannot be moved to another family; use RenameMetrics
+// to rename metrics.
+func (c RelabelConfig) Validate() error {
+	_, err := c.compile()
+	return err
+}
+
+type relabelRule struct {
+	sourceLabels []string
+	separator    string
+	regex        *regexp.Regexp
+	modulus      uint64
+	targetLabel  string
+	replacement  string
+	action       RelabelAction
+}
+
+func (c RelabelConfig) compile() (relabelRule, error) {
+	r := relabelRule{
+		sourceLabels: c.SourceLabels,
+		separator:    ";",
+		modulus:      c.Modulus,
+		targetLabel:  c.TargetLabel,
+		replacement:  "$1",
+		action:       c.Action,
+	}
+	if c.Separator != nil {
+		r.separator = *c.Separator
+	}
+	if c.Replacement != nil {
+		r.replacement = *c.Replacement
+	}
+	if len(r.action) == 0 {
+		r.action = RelabelReplace
+	}
+	expr := "(.*)"
+	if c.Regex != nil {
+		expr = *c.Regex
+	}
+	regex, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return r, fmt.Errorf("invalid regex %q: %v", expr, err)
+	}
+	r.regex = regex
+
+	switch r.action {
+	case RelabelReplace, RelabelHashMod, RelabelLowercase, RelabelUppercase:
+		if len(r.targetLabel) == 0 {
+			return r, fmt.Errorf("target_label is required for action %q", r.action)
+		}
+		if r.targetLabel == model.MetricNameLabel {
+			return r, fmt.Errorf("target_label must not be %s", model.MetricNameLabel)
+		}
+		if r.action != RelabelReplace && !model.LabelName(r.targetLabel).IsValid() {
+			return r, fmt.Errorf("invalid target_label %q", r.targetLabel)
+		}
+		if r.action == RelabelHashMod && r.modulus == 0 {
+			return r, fmt.Errorf("modulus is required for action %q", r.action)
+		}
+	case RelabelKeep, RelabelDrop:
+		if len(r.sourceLabels) == 0 {
+			return r, fmt.Errorf("source_labels are required for action %q", r.action)
+		}
+	case RelabelLabelMap, RelabelLabelDrop, RelabelLabelKeep:
+	default:
+		return r, fmt.Errorf("unknown action %q", r.action)
+	}
+	return r, nil
+}
+
+type relabel struct {
+	rules []relabelRule
+}
+
+// NewRelabel returns a Transformer applying the relabeling rules to every metric,
+// in order. Metrics dropped by a keep or drop rule are set to nil. Labels
+// starting with __ are removed once all the rules are applied, so they can be
+// used as temporary labels.
+func NewRelabel(configs []RelabelConfig) (Transformer, error) {
+	t := &relabel{}
+	for i, c := range configs {
+		r, err := c.compile()
+		if err != nil {
+			return nil, fmt.Errorf("relabel config %d: %v", i, err)
+		}
+		t.rules = append(t.rules, r)
+	}
+	return t, nil
+}
+
+// Transform implements the Transformer interface.
+func (t *relabel) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	var ok bool
+	for i, m := range family.Metric {
+		if m == nil {
+			continue
+		}
+		lset := make(map[string]string, len(m.Label)+1)
+		for _, l := range m.Label {
+			lset[l.GetName()] = l.GetValue()
+		}
+		lset[model.MetricNameLabel] = family.GetName()
+
+		if !t.apply(lset) {
+			family.Metric[i] = nil
+			continue
+		}
+		ok = true
+
+		names := make([]string, 0, len(lset))
+		for name := range lset {
+			if strings.HasPrefix(name, model.ReservedLabelPrefix) {
+				continue
+			}
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		pairs := make([]*clientmodel.LabelPair, 0, len(names))
+		for _, name := range names {
+			name, value := name, lset[name]
+			pairs = append(pairs, &clientmodel.LabelPair{Name: &name, Value: &value})
+		}
+		m.Label = pairs
+	}
+	return ok, nil
+}
+
+// apply relabels the label set in place and reports whether the metric is kept.
+func (t *relabel) apply(lset map[string]string) bool {
+	name := lset[model.MetricNameLabel]
+	for _, r := range t.rules {
+		values := make([]string, 0, len(r.sourceLabels))
+		for _, l := range r.sourceLabels {
+			values = append(values, lset[l])
+		}
+		val := strings.Join(values, r.separator)
+
+		switch r.action {
+		case RelabelDrop:
+			if r.regex.MatchString(val) {
+				return false
+			}
+		case RelabelKeep:
+			if !r.regex.MatchString(val) {
+				return false
+			}
+		case RelabelReplace:
+			indexes := r.regex.FindStringSubmatchIndex(val)
+			if indexes == nil {
+				break
+			}
+			target := string(r.regex.ExpandString([]byte{}, r.targetLabel, val, indexes))
+			if !model.LabelName(target).IsValid() || target == model.MetricNameLabel {
+				break
+			}
+			res := r.regex.ExpandString([]byte{}, r.replacement, val, indexes)
+			if len(res) == 0 {
+				delete(lset, target)
+				break
+			}
+			lset[target] = string(res)
+		case RelabelHashMod:
+			sum := md5.Sum([]byte(val))
+			lset[r.targetLabel] = fmt.Sprint(binary.BigEndian.Uint64(sum[8:]) % r.modulus)
+		case RelabelLowercase:
+			lset[r.targetLabel] = strings.ToLower(val)
+		case RelabelUppercase:
+			lset[r.targetLabel] = strings.ToUpper(val)
+		case RelabelLabelMap:
+			mapped := make(map[string]string)
+			for l, v := range lset {
+				if r.regex.MatchString(l) {
+					mapped[r.regex.ReplaceAllString(l, r.replacement)] = v
+				}
+			}
+			for l, v := range mapped {
+				lset[l] = v
+			}
+		case RelabelLabelDrop:
+			for l := range lset {
+				if r.regex.MatchString(l) {
+					delete(lset, l)
+				}
+			}
+		case RelabelLabelKeep:
+			for l := range lset {
+				if !r.regex.MatchString(l) {
+					delete(lset, l)
+				}
+			}
+		}
+	}
+	// The metric name is defined by the family and cannot be relabeled.
+	lset[model.MetricNameLabel] = name
+	return true
+}
@@ -0,0 +1,123 @@
+package metricfamily
+
+import (
+	"reflect"
+	"testing"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestRelabel(t *testing.T) {
+	strPnt := func(str string) *string {
+		return &str
+	}
+	labels := func(pairs ...string) []*clientmodel.LabelPair {
+		ls := []*clientmodel.LabelPair{}
+		for i := 0; i < len(pairs); i += 2 {
+			ls = append(ls, &clientmodel.LabelPair{Name: strPnt(pairs[i]), Value: strPnt(pairs[i+1])})
+		}
+		return ls
+	}
+
+	for _, tc := range []struct {
+		name    string
+		configs []RelabelConfig
+		in      [][]*clientmodel.LabelPair
+		want    [][]*clientmodel.LabelPair
+	}{
+		{
+			name: "replace",
+			configs: []RelabelConfig{{
+				SourceLabels: []string{"__name__", "instance"},
+				Regex:        strPnt("up;(.*):.*"),
+				TargetLabel:  "host",
+			}},
+			in:   [][]*clientmodel.LabelPair{labels("instance", "node-1:9100")},
+			want: [][]*clientmodel.LabelPair{labels("host", "node-1", "instance", "node-1:9100")},
+		},
+		{
+			name: "replace with an empty value removes the label",
+			configs: []RelabelConfig{{
+				SourceLabels: []string{"nonexistent"},
+				TargetLabel:  "job",
+			}},
+			in:   [][]*clientmodel.LabelPair{labels("job", "a")},
+			want: [][]*clientmodel.LabelPair{labels()},
+		},
+		{
+			name: "keep and drop",
+			configs: []RelabelConfig{
+				{SourceLabels: []string{"job"}, Regex: strPnt("a|b"), Action: RelabelKeep},
+				{SourceLabels: []string{"job"}, Regex: strPnt("b"), Action: RelabelDrop},
+			},
+			in:   [][]*clientmodel.LabelPair{labels("job", "a"), labels("job", "b"), labels("job", "c")},
+			want: [][]*clientmodel.LabelPair{labels("job", "a"), nil, nil},
+		},
+		{
+			name: "labelmap, labeldrop and labelkeep",
+			configs: []RelabelConfig{
+				{Regex: strPnt("k8s_(.*)"), Action: RelabelLabelMap},
+				{Regex: strPnt("k8s_.*"), Action: RelabelLabelDrop},
+				{Regex: strPnt("__name__|namespace|pod"), Action: RelabelLabelKeep},
+			},
+			in:   [][]*clientmodel.LabelPair{labels("k8s_namespace", "default", "k8s_pod", "a", "other", "x")},
+			want: [][]*clientmodel.LabelPair{labels("namespace", "default", "pod", "a")},
+		},
+		{
+			name: "hashmod and case",
+			configs: []RelabelConfig{
+				{SourceLabels: []string{"instance"}, Modulus: 8, TargetLabel: "__tmp_hash", Action: RelabelHashMod},
+				{SourceLabels: []string{"__tmp_hash"}, TargetLabel: "shard"},
+				{SourceLabels: []string{"env"}, TargetLabel: "env", Action: RelabelUppercase},
+				{SourceLabels: []string{"env"}, TargetLabel: "env_lower", Action: RelabelLowercase},
+			},
+			in:   [][]*clientmodel.LabelPair{labels("env", "Prod", "instance", "a")},
+			want: [][]*clientmodel.LabelPair{labels("env", "PROD", "env_lower", "prod", "instance", "a", "shard", "1")},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			relabel, err := NewRelabel(tc.configs)
+			if err != nil {
+				t.Fatalf("failed to create relabel: %v", err)
+			}
+			f := familyWithLabels("up", tc.in...)
+			if _, err := relabel.Transform(f); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for i, m := range f.Metric {
+				if tc.want[i] == nil {
+					if m != nil {
+						t.Errorf("metric %d: expected to be dropped, got %v", i, m.Label)
+					}
+					continue
+				}
+				if m == nil {
+					t.Errorf("metric %d: unexpectedly dropped", i)
+					continue
+				}
+				if len(tc.want[i]) == 0 && len(m.Label) == 0 {
+					continue
+				}
+				if !reflect.DeepEqual(tc.want[i], m.Label) {
+					t.Errorf("metric %d: want labels %v, got %v", i, tc.want[i], m.Label)
+				}
+			}
+		})
+	}
+}
+
+func TestRelabelConfigValidate(t *testing.T) {
+	regex := "("
+	for _, c := range []RelabelConfig{
+		{Regex: &regex, TargetLabel: "a"},
+		{Action: "unknown"},
+		{Action: RelabelReplace},
+		{TargetLabel: "__name__"},
+		{Action: RelabelHashMod, TargetLabel: "a"},
+		{Action: RelabelKeep},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", c)
+		}
+	}
+}
@@ -29,6 +29,9 @@ func MetricsCount(families []*clientmodel.MetricFamily) int {
 
 func Filter(families []*clientmodel.MetricFamily, filter Transformer) error {
 	for i, family := range families {
+		if family == nil {
+			continue
+		}
 		ok, err := filter.Transform(family)
 		if err != nil {
 			return err
@@ -7,9 +7,10 @@ import (
 )
 
 var (
-	ErrUnsorted        = fmt.Errorf("metrics in provided family are not in increasing timestamp order")
-	ErrNoTimestamp     = fmt.Errorf("metrics in provided family do not have a timestamp")
-	ErrTimestampTooOld = fmt.Errorf("metrics in provided family have a timestamp that is too old, check clock skew")
+	ErrUnsorted          = fmt.Errorf("metrics in provided family are not in increasing timestamp order")
+	ErrNoTimestamp       = fmt.Errorf("metrics in provided family do not have a timestamp")
+	ErrTimestampTooOld   = fmt.Errorf("metrics in provided family have a timestamp that is too old, check clock skew")
+	ErrTimestampInFuture = fmt.Errorf("metrics in provided family have a timestamp in the future, check clock skew")
 )
 
 type errorOnUnsorted struct {
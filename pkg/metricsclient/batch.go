@@ -0,0 +1,154 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package metricsclient
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// DefaultWriteConcurrency is the number of write requests sent at the same time
+// if not configured.
+const DefaultWriteConcurrency = 4
+
+// BatchPolicy bounds the write requests of a RemoteWrite call and the number of
+// them sent at the same time.
+type BatchPolicy struct {
+	// MaxSeries is the maximum number of series of a request, 10000 if zero.
+	MaxSeries int
+	// MaxBytes bounds the size of the series of a request, before compression and
+	// as encoded by remote write 1.0. A larger series is sent alone. Requests are
+	// only bounded by MaxSeries if zero.
+	MaxBytes int
+	// Concurrency is the number of requests sent at the same time,
+	// DefaultWriteConcurrency if zero.
+	Concurrency int
+}
+
+func (p BatchPolicy) maxSeries() int {
+	if p.MaxSeries <= 0 {
+		return maxSeriesLength
+	}
+	return p.MaxSeries
+}
+
+func (p BatchPolicy) concurrency() int {
+	if p.Concurrency <= 0 {
+		return DefaultWriteConcurrency
+	}
+	return p.Concurrency
+}
+
+// WriteSummary is the outcome of the write requests of a RemoteWrite call.
+type WriteSummary struct {
+	Time time.Time `json:"time"`
+	// Series is the number of series of the requests.
+	Series  int `json:"series"`
+	Batches int `json:"batches"`
+	// Sent is the number of requests delivered and Failed the number of the other
+	// ones, including the Rejected ones but those answered with 409 Conflict, which
+	// are dropped without failing the push. Retried is the number of requests that
+	// needed more than one attempt, whether they were delivered or not.
+	Sent     int `json:"sent"`
+	Retried  int `json:"retried"`
+	Failed   int `json:"failed"`
+	Rejected int `json:"rejected"`
+}
+
+// splitSeries converts the families one at a time and calls fn with the series
+// of a request as soon as it is full, so that only the series of a single request
+// are held in memory next to the families. owners[i] is the family of series[i].
+// fn must not retain the slices. It returns the number of series.
+func splitSeries(families []*clientmodel.MetricFamily, timestamp int64, policy BatchPolicy,
+	fn func(series []prompb.TimeSeries, owners []*clientmodel.MetricFamily) error) (int, error) {
+	maxSeries := policy.maxSeries()
+	capacity := maxSeries
+	if capacity > maxSeriesLength {
+		capacity = maxSeriesLength
+	}
+	series := make([]prompb.TimeSeries, 0, capacity)
+	owners := make([]*clientmodel.MetricFamily, 0, capacity)
+	var size, total int
+	flush := func() error {
+		if len(series) == 0 {
+			return nil
+		}
+		if err := fn(series, owners); err != nil {
+			return err
+		}
+		total += len(series)
+		series, owners, size = series[:0], owners[:0], 0
+		return nil
+	}
+
+	var converted []prompb.TimeSeries
+	for _, f := range families {
+		converted = appendFamily(converted[:0], f, timestamp)
+		for _, ts := range converted {
+			var n int
+			if policy.MaxBytes > 0 {
+				n = ts.Size()
+			}
+			if len(series) >= maxSeries || (len(series) > 0 && policy.MaxBytes > 0 && size+n > policy.MaxBytes) {
+				if err := flush(); err != nil {
+					return 0, err
+				}
+			}
+			series = append(series, ts)
+			owners = append(owners, f)
+			size += n
+		}
+	}
+	if err := flush(); err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// sendBatches sends the batches with at most Concurrency requests at the same
+// time, and returns the outcome of each of them. A failed request does not
+// prevent the other ones from being sent. Once ctx is done, the batches not sent
+// yet fail with its error instead of waiting for a request in flight to finish.
+func (c *Client) sendBatches(ctx context.Context, req *http.Request, batches [][]byte,
+	maxElapsed time.Duration, version RemoteWriteVersion) ([]BatchResult, []error) {
+	results := make([]BatchResult, len(batches))
+	errs := make([]error, len(batches))
+	sem := make(chan struct{}, c.batch.concurrency())
+	var wg sync.WaitGroup
+	for i := range batches {
+		if err := acquire(ctx, sem); err != nil {
+			for j := i; j < len(batches); j++ {
+				results[j], errs[j] = BatchResult{Bytes: len(batches[j])}, err
+			}
+			break
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i], errs[i] = c.sendBatch(ctx, req, batches[i], maxElapsed, version)
+		}(i)
+	}
+	wg.Wait()
+	return results, errs
+}
+
+// acquire takes a slot of sem, unless ctx is done first.
+func acquire(ctx context.Context, sem chan struct{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
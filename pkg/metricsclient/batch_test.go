@@ -0,0 +1,183 @@
+// Copyright Contributors to the Open Cluster Management project
+package metricsclient
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestSplitSeries(t *testing.T) {
+	families := benchmarkFamilies(2, 4)
+	now := time.Now()
+	timestamp := now.UnixNano() / int64(time.Millisecond)
+	var size int
+	for _, f := range families {
+		for _, ts := range appendFamily(nil, f, timestamp) {
+			if ts.Size() > size {
+				size = ts.Size()
+			}
+		}
+	}
+	for _, tt := range []struct {
+		name   string
+		policy BatchPolicy
+		want   []int
+	}{
+		{name: "default", want: []int{8}},
+		{name: "series", policy: BatchPolicy{MaxSeries: 3}, want: []int{3, 3, 2}},
+		{name: "bytes", policy: BatchPolicy{MaxBytes: 2*size + 1}, want: []int{2, 2, 2, 2}},
+		{name: "larger series", policy: BatchPolicy{MaxBytes: 1}, want: []int{1, 1, 1, 1, 1, 1, 1, 1}},
+		{name: "both", policy: BatchPolicy{MaxSeries: 3, MaxBytes: 2*size + 1}, want: []int{2, 2, 2, 2}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []int
+			total, err := splitSeries(families, timestamp, tt.policy, func(series []prompb.TimeSeries, owners []*clientmodel.MetricFamily) error {
+				if len(owners) != len(series) {
+					t.Errorf("expected an owner per series, got %d for %d", len(owners), len(series))
+				}
+				got = append(got, len(series))
+				return nil
+			})
+			if err != nil || total != 8 {
+				t.Fatalf("expected 8 series, got %d: %v", total, err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("expected requests of %v series, got %v", tt.want, got)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("expected requests of %v series, got %v", tt.want, got)
+				}
+			}
+
+			// Both encodings must split the series the same way.
+			v1, _, err := encodeWriteRequests(families, now, tt.policy, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			v2, _, err := encodeWriteRequestsV2(families, now, tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(v1) != len(tt.want) || len(v2) != len(tt.want) {
+				t.Errorf("expected %d requests, got %d with 1.0 and %d with 2.0", len(tt.want), len(v1), len(v2))
+			}
+		})
+	}
+}
+
+func TestRemoteWriteConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	var inflight, maxInflight int
+	instance := func(compressed []byte) string {
+		data, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Error(err)
+			return ""
+		}
+		var wreq prompb.WriteRequest
+		if err := proto.Unmarshal(data, &wreq); err != nil || len(wreq.Timeseries) != 1 {
+			t.Errorf("expected a request with 1 series, got %d: %v", len(wreq.Timeseries), err)
+			return ""
+		}
+		for _, l := range wreq.Timeseries[0].Labels {
+			if l.Name == "instance" {
+				return l.Value
+			}
+		}
+		return ""
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		compressed, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		inflight++
+		if inflight > maxInflight {
+			maxInflight = inflight
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inflight--
+		mu.Unlock()
+		if instance(compressed) == "instance-2" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	var summary WriteSummary
+	client := New(log.NewNopLogger(), server.Client(), 0, time.Minute, "test").
+		WithRetryPolicy(RetryPolicy{MaxElapsedTime: time.Millisecond}).
+		WithBatchPolicy(BatchPolicy{MaxSeries: 1, Concurrency: 3}).
+		WithSummaryObserver(func(s WriteSummary) { summary = s })
+	req, _ := http.NewRequest(http.MethodPost, server.URL, nil)
+	err := client.RemoteWrite(context.Background(), req, benchmarkFamilies(1, 6), time.Minute)
+
+	// The requests after the failed one are still sent.
+	var unsent *UnsentError
+	if !errors.As(err, &unsent) || len(unsent.Batches) != 1 || instance(unsent.Batches[0]) != "instance-2" {
+		t.Fatalf("expected the request of instance-2 to be unsent, got %v", err)
+	}
+	want := WriteSummary{Time: summary.Time, Series: 6, Batches: 6, Sent: 5, Failed: 1}
+	if summary != want {
+		t.Errorf("expected summary %+v, got %+v", want, summary)
+	}
+	if maxInflight < 2 || maxInflight > 3 {
+		t.Errorf("expected at most 3 concurrent requests, got %d", maxInflight)
+	}
+}
+
+func TestSendBatchesCancelled(t *testing.T) {
+	var mu sync.Mutex
+	var requests int
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		started <- struct{}{}
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client := New(log.NewNopLogger(), server.Client(), 0, time.Minute, "test").
+		WithBatchPolicy(BatchPolicy{Concurrency: 1})
+	req, _ := http.NewRequest(http.MethodPost, server.URL, nil)
+	batches := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+
+	// The batches waiting for a slot are not sent once the context is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	results, errs := client.sendBatches(ctx, req, batches, time.Minute, RemoteWriteV1)
+	for i := 1; i < len(batches); i++ {
+		if results[i].Attempts != 0 || !errors.Is(errs[i], context.Canceled) {
+			t.Errorf("batch %d: expected no attempt and a cancelled error, got %d attempts: %v", i, results[i].Attempts, errs[i])
+		}
+	}
+	if errs[0] == nil {
+		t.Error("expected the request in flight to fail")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 1 {
+		t.Errorf("expected a single request, got %d", requests)
+	}
+}
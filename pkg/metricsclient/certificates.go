@@ -0,0 +1,236 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package metricsclient
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/stolostron/metrics-collector/pkg/logger"
+)
+
+const (
+	// certificateCheckInterval is the minimum time between two checks of the TLS files.
+	certificateCheckInterval = 10 * time.Second
+	// CertificateExpiryWarning is how long ahead of its expiry a client certificate is reported.
+	CertificateExpiryWarning = 7 * 24 * time.Hour
+	// expiryWarningInterval is the minimum time between two warnings about the same certificate.
+	expiryWarningInterval = time.Hour
+)
+
+var (
+	gaugeCertificateExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "metricsclient_client_certificate_expiry_timestamp_seconds",
+		Help: "The expiry time of the loaded client certificate",
+	}, []string{"cert_file"})
+	counterCertificateReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "metricsclient_certificate_reloads_total",
+		Help: "The number of times the TLS files were reloaded after a change, by result",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(gaugeCertificateExpiry, counterCertificateReloads)
+}
+
+// CertificateReloader serves the TLS material referenced by TLSOptions to a
+// TLS client, and reloads it when the files change so that rotated
+// certificates are picked up without restarting. The files are checked during
+// the TLS handshakes, at most once every 10 seconds. A new client certificate
+// or CA is only used once the whole material has been loaded successfully.
+// A client certificate close to its expiry is reported on every check, at
+// most once an hour, whether the files changed or not.
+type CertificateReloader struct {
+	opts   TLSOptions
+	logger log.Logger
+	now    func() time.Time
+
+	mu          sync.RWMutex
+	lastCheck   time.Time
+	lastWarning time.Time
+	loaded      bool
+	data        [3][]byte
+	cert        *tls.Certificate
+	roots       *x509.CertPool
+	expiry      time.Time
+}
+
+// NewCertificateReloader loads the TLS material referenced by opts.
+func NewCertificateReloader(l log.Logger, opts TLSOptions) (*CertificateReloader, error) {
+	r := &CertificateReloader{
+		opts:   opts,
+		logger: log.With(l, "component", "metricsclient/certificates"),
+		now:    time.Now,
+	}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	r.warnExpiry()
+	return r, nil
+}
+
+// TLSConfig returns a TLS configuration that always uses the latest loaded material.
+func (r *CertificateReloader) TLSConfig() *tls.Config {
+	tlsConfig := &tls.Config{
+		ServerName:         r.opts.ServerName,
+		InsecureSkipVerify: r.opts.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if r.opts.IsMutual() {
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			r.check()
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return r.cert, nil
+		}
+	}
+	if len(r.opts.CAFile) > 0 && !r.opts.InsecureSkipVerify {
+		// The default verification uses fixed roots, verify against the reloaded ones instead.
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = r.verifyConnection
+	}
+	return tlsConfig
+}
+
+// Transport returns a transport using the reloaded TLS material.
+func (r *CertificateReloader) Transport() *http.Transport {
+	if r.opts.InsecureSkipVerify {
+		logger.Log(r.logger, logger.Warn, "msg", "server certificate verification is disabled")
+	}
+	transport := DefaultTransport(r.logger, true)
+	transport.TLSClientConfig = r.TLSConfig()
+	return transport
+}
+
+// Expiry returns the expiry time of the loaded client certificate, or the zero
+// time if the client does not authenticate with a certificate.
+func (r *CertificateReloader) Expiry() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.expiry
+}
+
+func (r *CertificateReloader) verifyConnection(cs tls.ConnectionState) error {
+	r.check()
+	r.mu.RLock()
+	roots := r.roots
+	r.mu.RUnlock()
+
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("no server certificate presented")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       cs.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// check reloads the TLS material if the files changed since the last check.
+func (r *CertificateReloader) check() {
+	r.mu.Lock()
+	if r.now().Sub(r.lastCheck) < certificateCheckInterval {
+		r.mu.Unlock()
+		return
+	}
+	r.lastCheck = r.now()
+	r.mu.Unlock()
+
+	// The previous certificate is still in use when the reload fails, keep reporting its expiry.
+	defer r.warnExpiry()
+	changed, err := r.reload()
+	if err != nil {
+		counterCertificateReloads.WithLabelValues("failure").Inc()
+		logger.Log(r.logger, logger.Error, "msg", "failed to reload TLS files, keeping the previous ones", "err", err)
+		return
+	}
+	if changed {
+		counterCertificateReloads.WithLabelValues("success").Inc()
+		logger.Log(r.logger, logger.Info, "msg", "reloaded TLS files", "expiry", r.Expiry())
+	}
+}
+
+// warnExpiry logs a warning if the client certificate expires within
+// CertificateExpiryWarning, unless it was already reported in the last hour.
+func (r *CertificateReloader) warnExpiry() {
+	r.mu.Lock()
+	now, expiry := r.now(), r.expiry
+	if expiry.IsZero() || expiry.Sub(now) >= CertificateExpiryWarning ||
+		(!r.lastWarning.IsZero() && now.Sub(r.lastWarning) < expiryWarningInterval) {
+		r.mu.Unlock()
+		return
+	}
+	r.lastWarning = now
+	r.mu.Unlock()
+	logger.Log(r.logger, logger.Warn, "msg", "client certificate expires soon", "cert_file", r.opts.CertFile, "expiry", expiry)
+}
+
+// reload loads the files and swaps the material if any of them changed.
+func (r *CertificateReloader) reload() (bool, error) {
+	var data [3][]byte
+	for i, path := range []string{r.opts.CAFile, r.opts.CertFile, r.opts.KeyFile} {
+		if len(path) == 0 {
+			continue
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to read %s", path)
+		}
+		data[i] = b
+	}
+
+	r.mu.RLock()
+	unchanged := r.loaded
+	for i := range data {
+		unchanged = unchanged && bytes.Equal(r.data[i], data[i])
+	}
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	var roots *x509.CertPool
+	if len(r.opts.CAFile) > 0 {
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(data[0]) {
+			return false, errors.Errorf("no certificates found in %s", r.opts.CAFile)
+		}
+	}
+	var cert *tls.Certificate
+	var expiry time.Time
+	if r.opts.IsMutual() {
+		c, err := tls.X509KeyPair(data[1], data[2])
+		if err != nil {
+			return false, errors.Wrap(err, "failed to load client ca cert")
+		}
+		leaf, err := x509.ParseCertificate(c.Certificate[0])
+		if err != nil {
+			return false, errors.Wrap(err, "failed to parse client certificate")
+		}
+		c.Leaf = leaf
+		cert, expiry = &c, leaf.NotAfter
+		gaugeCertificateExpiry.WithLabelValues(r.opts.CertFile).Set(float64(expiry.Unix()))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.data, r.cert, r.roots, r.expiry = data, cert, roots, expiry
+	r.loaded = true
+	// A new certificate is reported right away if it expires soon too.
+	r.lastWarning = time.Time{}
+	return true, nil
+}
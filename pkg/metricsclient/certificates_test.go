@@ -0,0 +1,175 @@
+// Copyright Contributors to the Open Cluster Management project
+package metricsclient
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM encoded certificate and key signed by the CA.
+func (ca *testCA) issue(t *testing.T, serial int64, notAfter time.Time, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	opts := TLSOptions{
+		CAFile:     filepath.Join(dir, "ca.crt"),
+		CertFile:   filepath.Join(dir, "tls.crt"),
+		KeyFile:    filepath.Join(dir, "tls.key"),
+		ServerName: "localhost",
+	}
+	writeFile(t, opts.CAFile, ca.pem)
+	firstExpiry := time.Now().Add(12 * time.Hour).Truncate(time.Second)
+	crt, key := ca.issue(t, 2, firstExpiry, x509.ExtKeyUsageClientAuth)
+	writeFile(t, opts.CertFile, crt)
+	writeFile(t, opts.KeyFile, key)
+
+	r, err := NewCertificateReloader(log.NewNopLogger(), opts)
+	if err != nil {
+		t.Fatalf("failed to load certificates: %v", err)
+	}
+	now := time.Now()
+	r.now = func() time.Time { return now }
+	var logs bytes.Buffer
+	r.logger = log.NewLogfmtLogger(&logs)
+	if !r.Expiry().Equal(firstExpiry) {
+		t.Fatalf("expected expiry %v, got %v", firstExpiry, r.Expiry())
+	}
+
+	// The server requires a client certificate signed by the CA.
+	serverCrt, serverKey := ca.issue(t, 3, time.Now().Add(time.Hour), x509.ExtKeyUsageServerAuth)
+	serverCert, err := tls.X509KeyPair(serverCrt, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var serials []int64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		serials = append(serials, req.TLS.PeerCertificates[0].SerialNumber.Int64())
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    x509.NewCertPool(),
+	}
+	server.TLS.ClientCAs.AddCert(ca.cert)
+	server.StartTLS()
+	defer server.Close()
+
+	client := &http.Client{Transport: r.Transport()}
+	get := func() {
+		t.Helper()
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+	}
+	get()
+
+	// A rotated certificate is used once the check interval has elapsed.
+	secondExpiry := time.Now().Add(48 * time.Hour).Truncate(time.Second)
+	crt, key = ca.issue(t, 4, secondExpiry, x509.ExtKeyUsageClientAuth)
+	writeFile(t, opts.CertFile, crt)
+	writeFile(t, opts.KeyFile, key)
+	get()
+	now = now.Add(certificateCheckInterval)
+	get()
+	if len(serials) != 3 || serials[1] != 2 || serials[2] != 4 {
+		t.Errorf("expected the rotated certificate to be used after the check interval, got serials %v", serials)
+	}
+	if !r.Expiry().Equal(secondExpiry) {
+		t.Errorf("expected expiry %v, got %v", secondExpiry, r.Expiry())
+	}
+
+	// A partially written key pair is not loaded and the previous certificate is kept.
+	writeFile(t, opts.KeyFile, []byte("garbage"))
+	now = now.Add(certificateCheckInterval)
+	get()
+	if len(serials) != 4 || serials[3] != 4 {
+		t.Fatalf("expected the previous certificate to be kept, got serials %v", serials)
+	}
+
+	// The expiry is reported again an hour later, even though no certificate was loaded since.
+	now = now.Add(expiryWarningInterval)
+	get()
+	if n := strings.Count(logs.String(), "client certificate expires soon"); n != 2 {
+		t.Errorf("expected the expiry to be reported twice, got %d warnings:\n%s", n, logs.String())
+	}
+}
@@ -5,17 +5,16 @@ package metricsclient
 import (
 	"bytes"
 	"context"
-	"crypto/tls"
-	"crypto/x509"
-	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"net"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cenkalti/backoff"
@@ -26,42 +25,168 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	clientmodel "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
-	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/prompb"
-	"github.com/prometheus/prometheus/promql"
 
 	"github.com/stolostron/metrics-collector/pkg/logger"
 	"github.com/stolostron/metrics-collector/pkg/reader"
 )
 
 const (
-	nameLabelName   = "__name__"
-	maxSeriesLength = 10000
+	nameLabelName     = "__name__"
+	bucketLabelName   = "le"
+	quantileLabelName = "quantile"
+	maxSeriesLength   = 10000
+	// maxErrorBodyBytes bounds the part of an error response that is logged.
+	maxErrorBodyBytes = 1024
+	// defaultRequestTimeout bounds every attempt of a write request if not configured.
+	defaultRequestTimeout = 30 * time.Second
 )
 
 var (
+	counterRequestRetrieve = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "metricsclient_request_retrieve_total",
+		Help: "The number of metrics retrievals, by status code",
+	}, []string{"client", "status_code"})
+	counterRequestSend = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "metricsclient_request_send_total",
+		Help: "The number of metrics sends, by status code",
+	}, []string{"client", "status_code"})
+	// The legacy gauges are kept up to date for existing dashboards, but only
+	// exposed if registered with RegisterLegacyMetrics.
 	gaugeRequestRetrieve = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "metricsclient_request_retrieve",
-		Help: "Tracks the number of metrics retrievals",
+		Help: "Tracks the number of metrics retrievals. Deprecated, use metricsclient_request_retrieve_total",
 	}, []string{"client", "status_code"})
 	gaugeRequestSend = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "metricsclient_request_send",
-		Help: "Tracks the number of metrics sends",
+		Help: "Tracks the number of metrics sends. Deprecated, use metricsclient_request_send_total",
+	}, []string{"client", "status_code"})
+	counterSkippedFamilies = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "metricsclient_skipped_families_total",
+		Help: "The number of metric families not forwarded because their type is not supported",
+	}, []string{"type"})
+	counterTruncatedResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "metricsclient_truncated_responses_total",
+		Help: "The number of responses larger than the byte limit, by limit",
+	}, []string{"client", "limit_bytes"})
+	counterDecodeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "metricsclient_decode_errors_total",
+		Help: "The number of responses that could not be decoded",
+	}, []string{"client"})
+	counterRemoteWriteRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "metricsclient_remote_write_requests_total",
+		Help: "The number of remote write attempts, by outcome: success, rejected, throttled, server_error or transport_error",
+	}, []string{"client", "outcome"})
+	counterDroppedBatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "metricsclient_remote_write_dropped_batches_total",
+		Help: "The number of write requests dropped because the receiver rejected them, by status code",
 	}, []string{"client", "status_code"})
 )
 
 func init() {
 	prometheus.MustRegister(
-		gaugeRequestRetrieve, gaugeRequestSend,
+		counterRequestRetrieve, counterRequestSend, counterSkippedFamilies,
+		counterTruncatedResponses, counterDecodeErrors, counterRemoteWriteRequests, counterDroppedBatches,
 	)
 }
 
+// RegisterLegacyMetrics registers the metrics replaced by correctly typed ones,
+// for dashboards that still rely on them.
+func RegisterLegacyMetrics(r prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{gaugeRequestRetrieve, gaugeRequestSend} {
+		if err := r.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) countRetrieve(code string) {
+	counterRequestRetrieve.WithLabelValues(c.metricsName, code).Inc()
+	gaugeRequestRetrieve.WithLabelValues(c.metricsName, code).Inc()
+}
+
+func (c *Client) countSend(code string) {
+	counterRequestSend.WithLabelValues(c.metricsName, code).Inc()
+	gaugeRequestSend.WithLabelValues(c.metricsName, code).Inc()
+}
+
 type Client struct {
 	client      *http.Client
 	maxBytes    int64
 	timeout     time.Duration
 	metricsName string
 	logger      log.Logger
+	retry       RetryPolicy
+	batch       BatchPolicy
+	observer    func(BatchResult)
+	summary     func(WriteSummary)
+	version     RemoteWriteVersion
+	// fallback is set once the receiver rejected remote write 2.0.
+	fallback uint32
+
+	// metadataCycles is the number of RemoteWrite calls between two sends of the
+	// metadata of the families, metadata is not sent if zero. metadataSkipped is
+	// the number of calls left before the next send.
+	metadataCycles  int
+	metadataMu      sync.Mutex
+	metadataSkipped int
+}
+
+// BatchResult is the outcome of sending a single remote write request.
+type BatchResult struct {
+	Time time.Time `json:"time"`
+	// Bytes is the size of the compressed request.
+	Bytes int `json:"bytes"`
+	// Attempts is the number of times the request was sent.
+	Attempts int `json:"attempts"`
+	// StatusCode is the HTTP status code of the last attempt, 0 if no response was received.
+	StatusCode int    `json:"statusCode,omitempty"`
+	Error      string `json:"error,omitempty"`
+	// Rejected is set when the receiver rejected the request, which was dropped.
+	Rejected bool `json:"rejected,omitempty"`
+}
+
+// RetryPolicy bounds the retries of remote write requests. Requests rejected
+// with a client error other than 429 are never retried.
+type RetryPolicy struct {
+	// MaxElapsedTime is the maximum time spent retrying a single request.
+	// If zero, it is derived from the interval passed to RemoteWrite.
+	MaxElapsedTime time.Duration
+	// MinBackoff and MaxBackoff bound the exponential back-off between two
+	// attempts, 500ms and 1m if zero. A longer Retry-After is honoured.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// RequestTimeout bounds every attempt, 30s if zero.
+	RequestTimeout time.Duration
+}
+
+// TruncatedError is returned when a response is larger than the byte limit of
+// the client. The families decoded before the limit was hit are still returned.
+type TruncatedError struct {
+	Limit int64
+}
+
+func (e *TruncatedError) Error() string {
+	return fmt.Sprintf("the response exceeded the limit of %d bytes", e.Limit)
+}
+
+func (e *TruncatedError) Unwrap() error {
+	return reader.ErrTooLong
+}
+
+// DecodeError is returned when a response is malformed. The families decoded
+// before the malformed one are still returned.
+type DecodeError struct {
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("failed to decode the response: %v", e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
 }
 
 type PartitionedMetrics struct {
@@ -78,109 +203,106 @@ func New(logger log.Logger, client *http.Client, maxBytes int64, timeout time.Du
 	}
 }
 
-type MetricsJson struct {
-	Status string      `json:"status"`
-	Data   MetricsData `json:"data"`
+// WithRetryPolicy sets the policy used to retry remote write requests.
+func (c *Client) WithRetryPolicy(policy RetryPolicy) *Client {
+	c.retry = policy
+	return c
 }
 
-type MetricsData struct {
-	Type   string          `json:"resultType"`
-	Result []MetricsResult `json:"result"`
+// WithRemoteWriteVersion sets the version of the remote write protocol. With 2.0,
+// the client falls back to 1.0 for good as soon as the receiver answers 415.
+func (c *Client) WithRemoteWriteVersion(version RemoteWriteVersion) *Client {
+	c.version = version
+	return c
 }
 
-type MetricsResult struct {
-	Metric map[string]string `json:"metric"`
-	Value  []interface{}     `json:"value"`
+// remoteWriteVersion returns the version of the remote write protocol to use.
+func (c *Client) remoteWriteVersion() RemoteWriteVersion {
+	if c.version == RemoteWriteV2 && atomic.LoadUint32(&c.fallback) == 0 {
+		return RemoteWriteV2
+	}
+	return RemoteWriteV1
 }
 
-func (c *Client) RetrievRecordingMetrics(ctx context.Context, req *http.Request, name string) ([]*clientmodel.MetricFamily, error) {
+// WithMetadata sends the type and help of the families along with the samples of
+// one RemoteWrite call out of cycles, and of the next one if it fails. Remote write
+// 2.0 requests always carry them.
+func (c *Client) WithMetadata(cycles int) *Client {
+	c.metadataCycles = cycles
+	return c
+}
 
-	ctx, cancel := context.WithTimeout(ctx, c.timeout)
-	req = req.WithContext(ctx)
-	defer cancel()
-	families := make([]*clientmodel.MetricFamily, 0, 100)
-	err := withCancel(ctx, c.client, req, func(resp *http.Response) error {
-		switch resp.StatusCode {
-		case http.StatusOK:
-			gaugeRequestRetrieve.WithLabelValues(c.metricsName, "200").Inc()
-		case http.StatusUnauthorized:
-			gaugeRequestRetrieve.WithLabelValues(c.metricsName, "401").Inc()
-			return fmt.Errorf("Prometheus server requires authentication: %s", resp.Request.URL)
-		case http.StatusForbidden:
-			gaugeRequestRetrieve.WithLabelValues(c.metricsName, "403").Inc()
-			return fmt.Errorf("Prometheus server forbidden: %s", resp.Request.URL)
-		case http.StatusBadRequest:
-			gaugeRequestRetrieve.WithLabelValues(c.metricsName, "400").Inc()
-			return fmt.Errorf("bad request: %s", resp.Request.URL)
-		default:
-			gaugeRequestRetrieve.WithLabelValues(c.metricsName, strconv.Itoa(resp.StatusCode)).Inc()
-			return fmt.Errorf("Prometheus server reported unexpected error code: %d", resp.StatusCode)
-		}
+// metadataDue reports whether the metadata is sent with the current RemoteWrite call.
+func (c *Client) metadataDue() bool {
+	c.metadataMu.Lock()
+	defer c.metadataMu.Unlock()
+	return c.metadataCycles > 0 && c.metadataSkipped <= 0
+}
 
-		decoder := json.NewDecoder(resp.Body)
-		var data MetricsJson
-		err := decoder.Decode(&data)
-		if err != nil {
-			logger.Log(c.logger, logger.Error, "msg", "failed to decode", "err", err)
-			return nil
-		}
-		vec := make(promql.Vector, 0, 100)
-		for _, r := range data.Data.Result {
-			var t int64
-			var v float64
-			t = int64(r.Value[0].(float64) * 1000)
-			v, _ = strconv.ParseFloat(r.Value[1].(string), 64)
-			ls := []labels.Label{}
-			for k, v := range r.Metric {
-				l := &labels.Label{
-					Name:  k,
-					Value: v,
-				}
-				ls = append(ls, *l)
-			}
-			vec = append(vec, promql.Sample{
-				Metric: ls,
-				Point:  promql.Point{T: t, V: v},
-			})
-		}
+// metadataDone records the outcome of a RemoteWrite call.
+func (c *Client) metadataDone(sent, ok bool) {
+	c.metadataMu.Lock()
+	defer c.metadataMu.Unlock()
+	switch {
+	case sent && ok:
+		c.metadataSkipped = c.metadataCycles - 1
+	case !sent:
+		c.metadataSkipped--
+	}
+}
 
-		for _, s := range vec {
-			protMetric := &clientmodel.Metric{
-				Untyped: &clientmodel.Untyped{},
-			}
-			protMetricFam := &clientmodel.MetricFamily{
-				Type: clientmodel.MetricType_UNTYPED.Enum(),
-				Name: proto.String(name),
-			}
-			for _, l := range s.Metric {
-				if l.Value == "" {
-					// No value means unset. Never consider those labels.
-					// This is also important to protect against nameless metrics.
-					continue
-				}
-				protMetric.Label = append(protMetric.Label, &clientmodel.LabelPair{
-					Name:  proto.String(l.Name),
-					Value: proto.String(l.Value),
-				})
-			}
+// WithBatchPolicy sets the size of the remote write requests and the number of
+// them sent at the same time.
+func (c *Client) WithBatchPolicy(policy BatchPolicy) *Client {
+	c.batch = policy
+	return c
+}
 
-			protMetric.TimestampMs = proto.Int64(s.T)
-			protMetric.Untyped.Value = proto.Float64(s.V)
+// WithBatchObserver sets a function called with the outcome of every remote write
+// request. It is called concurrently when requests are sent concurrently.
+func (c *Client) WithBatchObserver(observer func(BatchResult)) *Client {
+	c.observer = observer
+	return c
+}
 
-			protMetricFam.Metric = append(protMetricFam.Metric, protMetric)
-			families = append(families, protMetricFam)
-		}
+// WithSummaryObserver sets a function called with the outcome of every RemoteWrite call.
+func (c *Client) WithSummaryObserver(observer func(WriteSummary)) *Client {
+	c.summary = observer
+	return c
+}
 
+// Retrieve retrieves the metrics. If the response is truncated or malformed, the
+// error is a *TruncatedError or a *DecodeError and the families decoded until then
+// are returned along with it.
+func (c *Client) Retrieve(ctx context.Context, req *http.Request) ([]*clientmodel.MetricFamily, error) {
+	families := make([]*clientmodel.MetricFamily, 0, 100)
+	err := c.RetrieveFunc(ctx, req, func(family *clientmodel.MetricFamily) error {
+		families = append(families, family)
 		return nil
 	})
 	if err != nil {
+		if IsPartial(err) {
+			return families, err
+		}
 		return nil, err
 	}
-
 	return families, nil
 }
 
-func (c *Client) Retrieve(ctx context.Context, req *http.Request) ([]*clientmodel.MetricFamily, error) {
+// IsPartial reports whether the error is a *TruncatedError or a *DecodeError,
+// meaning that some families may have been retrieved before it occurred.
+func IsPartial(err error) bool {
+	var truncated *TruncatedError
+	var decode *DecodeError
+	return errors.As(err, &truncated) || errors.As(err, &decode)
+}
+
+// RetrieveFunc retrieves the metrics and passes each family to fn as soon as it
+// is decoded, so that the whole response is never held in memory. It stops at
+// the first error returned by fn and returns it. If the response is truncated or
+// malformed, it returns a *TruncatedError or a *DecodeError once the families
+// decoded until then have been passed to fn.
+func (c *Client) RetrieveFunc(ctx context.Context, req *http.Request, fn func(*clientmodel.MetricFamily) error) error {
 	if req.Header == nil {
 		req.Header = make(http.Header)
 	}
@@ -190,47 +312,51 @@ func (c *Client) Retrieve(ctx context.Context, req *http.Request) ([]*clientmode
 	req = req.WithContext(ctx)
 	defer cancel()
 
-	families := make([]*clientmodel.MetricFamily, 0, 100)
-	err := withCancel(ctx, c.client, req, func(resp *http.Response) error {
+	return withCancel(ctx, c.client, req, func(resp *http.Response) error {
 		switch resp.StatusCode {
 		case http.StatusOK:
-			gaugeRequestRetrieve.WithLabelValues(c.metricsName, "200").Inc()
+			c.countRetrieve("200")
 		case http.StatusUnauthorized:
-			gaugeRequestRetrieve.WithLabelValues(c.metricsName, "401").Inc()
+			c.countRetrieve("401")
 			return fmt.Errorf("Prometheus server requires authentication: %s", resp.Request.URL)
 		case http.StatusForbidden:
-			gaugeRequestRetrieve.WithLabelValues(c.metricsName, "403").Inc()
+			c.countRetrieve("403")
 			return fmt.Errorf("Prometheus server forbidden: %s", resp.Request.URL)
 		case http.StatusBadRequest:
-			gaugeRequestRetrieve.WithLabelValues(c.metricsName, "400").Inc()
+			c.countRetrieve("400")
 			return fmt.Errorf("bad request: %s", resp.Request.URL)
 		default:
-			gaugeRequestRetrieve.WithLabelValues(c.metricsName, strconv.Itoa(resp.StatusCode)).Inc()
+			c.countRetrieve(strconv.Itoa(resp.StatusCode))
 			return fmt.Errorf("Prometheus server reported unexpected error code: %d", resp.StatusCode)
 		}
 
-		// read the response into memory
 		format := expfmt.ResponseFormat(resp.Header)
-		r := &reader.LimitedReader{R: resp.Body, N: c.maxBytes}
+		// The reader probes for one more byte once the limit is hit, so that a body
+		// of exactly the limit is not reported as truncated.
+		r := &reader.LimitedReader{R: resp.Body, N: c.maxBytes, Probe: true}
 		decoder := expfmt.NewDecoder(r, format)
 		for {
 			family := &clientmodel.MetricFamily{}
-			families = append(families, family)
 			if err := decoder.Decode(family); err != nil {
-				if err != io.EOF {
-					logger.Log(c.logger, logger.Error, "msg", "error reading body", "err", err)
+				if err == io.EOF {
+					return nil
 				}
-				break
+				// The limited reader found more bytes than the limit, whatever the
+				// decoder made of the truncated body.
+				if r.N < 0 || errors.Is(err, reader.ErrTooLong) {
+					counterTruncatedResponses.WithLabelValues(c.metricsName, strconv.FormatInt(c.maxBytes, 10)).Inc()
+					logger.Log(c.logger, logger.Error, "msg", "response truncated", "limit", c.maxBytes)
+					return &TruncatedError{Limit: c.maxBytes}
+				}
+				counterDecodeErrors.WithLabelValues(c.metricsName).Inc()
+				logger.Log(c.logger, logger.Error, "msg", "error reading body", "err", err)
+				return &DecodeError{Err: err}
+			}
+			if err := fn(family); err != nil {
+				return err
 			}
 		}
-
-		return nil
 	})
-	if err != nil {
-		return nil, err
-	}
-
-	return families, nil
 }
 
 func (c *Client) Send(ctx context.Context, req *http.Request, families []*clientmodel.MetricFamily) error {
@@ -262,19 +388,19 @@ func (c *Client) Send(ctx context.Context, req *http.Request, families []*client
 		logger.Log(c.logger, logger.Debug, "msg", resp.StatusCode)
 		switch resp.StatusCode {
 		case http.StatusOK:
-			gaugeRequestSend.WithLabelValues(c.metricsName, "200").Inc()
+			c.countSend("200")
 		case http.StatusUnauthorized:
-			gaugeRequestSend.WithLabelValues(c.metricsName, "401").Inc()
+			c.countSend("401")
 			return fmt.Errorf("gateway server requires authentication: %s", resp.Request.URL)
 		case http.StatusForbidden:
-			gaugeRequestSend.WithLabelValues(c.metricsName, "403").Inc()
+			c.countSend("403")
 			return fmt.Errorf("gateway server forbidden: %s", resp.Request.URL)
 		case http.StatusBadRequest:
-			gaugeRequestSend.WithLabelValues(c.metricsName, "400").Inc()
+			c.countSend("400")
 			logger.Log(c.logger, logger.Debug, "msg", resp.Body)
 			return fmt.Errorf("gateway server bad request: %s", resp.Request.URL)
 		default:
-			gaugeRequestSend.WithLabelValues(c.metricsName, strconv.Itoa(resp.StatusCode)).Inc()
+			c.countSend(strconv.Itoa(resp.StatusCode))
 			body, _ := ioutil.ReadAll(resp.Body)
 			if len(body) > 1024 {
 				body = body[:1024]
@@ -366,45 +492,42 @@ func withCancel(ctx context.Context, client *http.Client, req *http.Request, fn
 	return err
 }
 
-func MTLSTransport(logger log.Logger) (*http.Transport, error) {
-	testMode := os.Getenv("UNIT_TEST") != ""
-	caCertFile := "/tlscerts/ca/ca.crt"
-	tlsKeyFile := "/tlscerts/certs/tls.key"
-	tlsCrtFile := "/tlscerts/certs/tls.crt"
-	if testMode {
-		caCertFile = "./testdata/ca.crt"
-		tlsKeyFile = "./testdata/tls.key"
-		tlsCrtFile = "./testdata/tls.crt"
-	}
-	// Load Server CA cert
-	caCert, err := ioutil.ReadFile(caCertFile)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to load server ca cert file")
-	}
-	// Load client cert signed by Client CA
-	cert, err := tls.LoadX509KeyPair(tlsCrtFile, tlsKeyFile)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to load client ca cert")
-	}
+// TLSOptions configures how a client verifies a server and authenticates to it.
+// If CertFile and KeyFile are set, the client authenticates with mutual TLS,
+// otherwise only the server is verified. The server is verified against the CA
+// in CAFile, or against the system roots certificates if CAFile is empty.
+type TLSOptions struct {
+	CAFile   string
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the name used to verify the server certificate.
+	ServerName string
+	// InsecureSkipVerify disables the verification of the server certificate.
+	// It must only be used for testing.
+	InsecureSkipVerify bool
+}
 
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
-	// Setup HTTPS client
-	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		RootCAs:      caCertPool,
-		MinVersion:   tls.VersionTLS12,
-	}
-	return &http.Transport{
-		Dial: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).Dial,
-		TLSHandshakeTimeout: 10 * time.Second,
-		DisableKeepAlives:   true,
-		TLSClientConfig:     tlsConfig,
-	}, nil
+// DefaultTLSOptions are the locations where the mTLS material of the upload
+// client is mounted when the collector is deployed by the observability addon.
+var DefaultTLSOptions = TLSOptions{
+	CAFile:   "/tlscerts/ca/ca.crt",
+	CertFile: "/tlscerts/certs/tls.crt",
+	KeyFile:  "/tlscerts/certs/tls.key",
+}
 
+// IsMutual reports whether the options authenticate the client with a certificate.
+func (o TLSOptions) IsMutual() bool {
+	return len(o.CertFile) > 0 || len(o.KeyFile) > 0
+}
+
+// TLSTransport returns a transport verifying the server and, with mutual TLS,
+// authenticating the client as configured by opts. Rotated files are reloaded.
+func TLSTransport(l log.Logger, opts TLSOptions) (*http.Transport, error) {
+	r, err := NewCertificateReloader(l, opts)
+	if err != nil {
+		return nil, err
+	}
+	return r.Transport(), nil
 }
 
 func DefaultTransport(logger log.Logger, isTLS bool) *http.Transport {
@@ -418,147 +541,469 @@ func DefaultTransport(logger log.Logger, isTLS bool) *http.Transport {
 	}
 }
 
-func convertToTimeseries(p *PartitionedMetrics, now time.Time) ([]prompb.TimeSeries, error) {
+func convertToTimeseries(p *PartitionedMetrics, now time.Time) []prompb.TimeSeries {
 	var timeseries []prompb.TimeSeries
 
 	timestamp := now.UnixNano() / int64(time.Millisecond)
 	for _, f := range p.Families {
-		for _, m := range f.Metric {
-			var ts prompb.TimeSeries
-
-			labelpairs := []prompb.Label{{
-				Name:  nameLabelName,
-				Value: *f.Name,
-			}}
-
-			for _, l := range m.Label {
-				labelpairs = append(labelpairs, prompb.Label{
-					Name:  *l.Name,
-					Value: *l.Value,
-				})
-			}
+		timeseries = appendFamily(timeseries, f, timestamp)
+	}
+
+	return timeseries
+}
+
+// appendFamily converts the family to timeseries, appended to the given ones.
+// Samples after the timestamp now, in milliseconds, are sent at now instead.
+func appendFamily(timeseries []prompb.TimeSeries, f *clientmodel.MetricFamily, timestamp int64) []prompb.TimeSeries {
+	if f == nil {
+		return timeseries
+	}
+	name := f.GetName()
+	switch f.GetType() {
+	case clientmodel.MetricType_COUNTER, clientmodel.MetricType_GAUGE, clientmodel.MetricType_UNTYPED,
+		clientmodel.MetricType_HISTOGRAM, clientmodel.MetricType_SUMMARY:
+	default:
+		counterSkippedFamilies.WithLabelValues(f.GetType().String()).Inc()
+		return timeseries
+	}
+
+	for _, m := range f.Metric {
+		if m == nil {
+			continue
+		}
+
+		var labelpairs []prompb.Label
+		for _, l := range m.Label {
+			labelpairs = append(labelpairs, prompb.Label{
+				Name:  l.GetName(),
+				Value: l.GetValue(),
+			})
+		}
+
+		t := m.GetTimestampMs()
+		// If the sample is in the future, overwrite it. The forwarder clamps and
+		// counts them beforehand, see metricfamily.ClampFutureTimestamps.
+		if t > timestamp {
+			t = timestamp
+		}
 
-			s := prompb.Sample{
-				Timestamp: *m.TimestampMs,
+		switch f.GetType() {
+		case clientmodel.MetricType_COUNTER:
+			if m.Counter != nil {
+				timeseries = append(timeseries, newTimeSeries(name, labelpairs, m.Counter.GetValue(), t))
 			}
-			// If the sample is in the future, overwrite it.
-			if *m.TimestampMs > timestamp {
-				s.Timestamp = timestamp
+		case clientmodel.MetricType_GAUGE:
+			if m.Gauge != nil {
+				timeseries = append(timeseries, newTimeSeries(name, labelpairs, m.Gauge.GetValue(), t))
 			}
-
-			switch *f.Type {
-			case clientmodel.MetricType_COUNTER:
-				s.Value = *m.Counter.Value
-			case clientmodel.MetricType_GAUGE:
-				s.Value = *m.Gauge.Value
-			case clientmodel.MetricType_UNTYPED:
-				s.Value = *m.Untyped.Value
-			default:
-				return nil, fmt.Errorf("metric type %s not supported", f.Type.String())
+		case clientmodel.MetricType_UNTYPED:
+			if m.Untyped != nil {
+				timeseries = append(timeseries, newTimeSeries(name, labelpairs, m.Untyped.GetValue(), t))
 			}
+		case clientmodel.MetricType_HISTOGRAM:
+			if m.Histogram != nil {
+				timeseries = appendHistogram(timeseries, name, labelpairs, m.Histogram, t)
+			}
+		case clientmodel.MetricType_SUMMARY:
+			if m.Summary != nil {
+				timeseries = appendSummary(timeseries, name, labelpairs, m.Summary, t)
+			}
+		}
+	}
 
-			ts.Labels = append(ts.Labels, labelpairs...)
-			ts.Samples = append(ts.Samples, s)
+	return timeseries
+}
+
+// appendHistogram expands a histogram into its `_bucket`, `_sum` and `_count` series,
+// the same way Prometheus exposes them. A `+Inf` bucket is added if it is missing.
+func appendHistogram(timeseries []prompb.TimeSeries, name string, labelpairs []prompb.Label,
+	h *clientmodel.Histogram, t int64) []prompb.TimeSeries {
 
-			timeseries = append(timeseries, ts)
+	hasInf := false
+	for _, b := range h.Bucket {
+		if b == nil {
+			continue
 		}
+		if math.IsInf(b.GetUpperBound(), +1) {
+			hasInf = true
+		}
+		timeseries = append(timeseries, newTimeSeries(name+"_bucket", labelpairs, float64(b.GetCumulativeCount()), t,
+			prompb.Label{Name: bucketLabelName, Value: formatFloat(b.GetUpperBound())}))
+	}
+	if !hasInf {
+		timeseries = append(timeseries, newTimeSeries(name+"_bucket", labelpairs, float64(h.GetSampleCount()), t,
+			prompb.Label{Name: bucketLabelName, Value: formatFloat(math.Inf(+1))}))
+	}
+	timeseries = append(timeseries, newTimeSeries(name+"_sum", labelpairs, h.GetSampleSum(), t))
+	return append(timeseries, newTimeSeries(name+"_count", labelpairs, float64(h.GetSampleCount()), t))
+}
+
+// appendSummary expands a summary into its `quantile` labelled series plus the
+// `_sum` and `_count` series, the same way Prometheus exposes them.
+func appendSummary(timeseries []prompb.TimeSeries, name string, labelpairs []prompb.Label,
+	s *clientmodel.Summary, t int64) []prompb.TimeSeries {
+
+	for _, q := range s.Quantile {
+		if q == nil {
+			continue
+		}
+		timeseries = append(timeseries, newTimeSeries(name, labelpairs, q.GetValue(), t,
+			prompb.Label{Name: quantileLabelName, Value: formatFloat(q.GetQuantile())}))
 	}
+	timeseries = append(timeseries, newTimeSeries(name+"_sum", labelpairs, s.GetSampleSum(), t))
+	return append(timeseries, newTimeSeries(name+"_count", labelpairs, float64(s.GetSampleCount()), t))
+}
 
-	return timeseries, nil
+func newTimeSeries(name string, labelpairs []prompb.Label, value float64, t int64, extra ...prompb.Label) prompb.TimeSeries {
+	ls := make([]prompb.Label, 0, len(labelpairs)+len(extra)+1)
+	ls = append(ls, prompb.Label{Name: nameLabelName, Value: name})
+	ls = append(ls, labelpairs...)
+	ls = append(ls, extra...)
+	return prompb.TimeSeries{
+		Labels:  ls,
+		Samples: []prompb.Sample{{Value: value, Timestamp: t}},
+	}
 }
 
-// RemoteWrite is used to push the metrics to remote thanos endpoint
+// formatFloat formats bucket bounds and quantiles as in the Prometheus text format.
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, +1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+}
+
+// appendMetadata appends the metadata of the families to an encoded
+// prometheus.WriteRequest, as the field `repeated MetricMetadata metadata = 3`
+// which is not part of the prompb package vendored here:
+//
+//	MetricMetadata { MetricType type = 1; string metric_family_name = 2; string help = 4; string unit = 5; }
+//
+// The unit is left empty as the exposition format does not carry it.
+// Consecutive occurrences of a family are only described once.
+func appendMetadata(data []byte, families []*clientmodel.MetricFamily) []byte {
+	b := proto.NewBuffer(data)
+	var last *clientmodel.MetricFamily
+	for _, f := range families {
+		if f == last {
+			continue
+		}
+		last = f
+		m := proto.NewBuffer(nil)
+		if t := metadataType(f.GetType()); t != metadataUnspecified {
+			_ = m.EncodeVarint(1<<3 | proto.WireVarint)
+			_ = m.EncodeVarint(t)
+		}
+		_ = m.EncodeVarint(2<<3 | proto.WireBytes)
+		_ = m.EncodeStringBytes(f.GetName())
+		if len(f.GetHelp()) > 0 {
+			_ = m.EncodeVarint(4<<3 | proto.WireBytes)
+			_ = m.EncodeStringBytes(f.GetHelp())
+		}
+		_ = b.EncodeVarint(3<<3 | proto.WireBytes)
+		_ = b.EncodeRawBytes(m.Bytes())
+	}
+	return b.Bytes()
+}
+
+// UnsentError is returned by RemoteWrite when some write requests could not be delivered.
+// Batches holds the snappy compressed write requests that were not delivered, in order.
+type UnsentError struct {
+	Batches [][]byte
+	Err     error
+}
+
+func (e *UnsentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *UnsentError) Unwrap() error {
+	return e.Err
+}
+
+// EncodeWriteRequests converts the families to timeseries and encodes them as snappy
+// compressed remote write requests, ready to be sent with SendBatch.
+func EncodeWriteRequests(families []*clientmodel.MetricFamily) ([][]byte, error) {
+	batches, _, err := encodeWriteRequests(families, time.Now(), BatchPolicy{}, false)
+	return batches, err
+}
+
+// EncodeWriteRequests encodes the families as EncodeWriteRequests does, in requests
+// bounded by the batch policy of the client.
+func (c *Client) EncodeWriteRequests(families []*clientmodel.MetricFamily) ([][]byte, error) {
+	batches, _, err := encodeWriteRequests(families, time.Now(), c.batch, false)
+	return batches, err
+}
+
+// encodeWriteRequests encodes the series of the families in requests bounded by
+// the policy. It also returns the number of timeseries encoded. With metadata,
+// every request carries the metadata of the families of its series.
+func encodeWriteRequests(families []*clientmodel.MetricFamily, now time.Time, policy BatchPolicy, metadata bool) ([][]byte, int, error) {
+	var batches [][]byte
+	total, err := splitSeries(families, now.UnixNano()/int64(time.Millisecond), policy,
+		func(timeseries []prompb.TimeSeries, owners []*clientmodel.MetricFamily) error {
+			wreq := &prompb.WriteRequest{Timeseries: timeseries}
+			data, err := proto.Marshal(wreq)
+			if err != nil {
+				return errors.Wrap(err, "failed to marshal proto")
+			}
+			if metadata {
+				data = appendMetadata(data, owners)
+			}
+			batches = append(batches, snappy.Encode(nil, data))
+			return nil
+		})
+	if err != nil {
+		return nil, 0, err
+	}
+	return batches, total, nil
+}
+
+// RemoteWrite is used to push the metrics to remote thanos endpoint.
+// The write requests are sent concurrently as allowed by the batch policy, and
+// a failed request does not prevent the other ones from being sent. If some
+// requests cannot be delivered, the returned error is an *UnsentError carrying
+// them, in order. Requests rejected by the receiver are dropped, and the first
+// rejection is returned if all the other requests are delivered.
 func (c *Client) RemoteWrite(ctx context.Context, req *http.Request,
 	families []*clientmodel.MetricFamily, interval time.Duration) error {
 
-	timeseries, err := convertToTimeseries(&PartitionedMetrics{Families: families}, time.Now())
+	now := time.Now()
+	version := c.remoteWriteVersion()
+	metadata := c.metadataDue()
+	var batches [][]byte
+	var total int
+	var err error
+	delivered := false
+	defer func() {
+		c.metadataDone(metadata && total > 0, delivered)
+	}()
+	if version == RemoteWriteV2 {
+		batches, total, err = encodeWriteRequestsV2(families, now, c.batch)
+	} else {
+		batches, total, err = encodeWriteRequests(families, now, c.batch, metadata)
+	}
 	if err != nil {
-		msg := "failed to convert timeseries"
-		logger.Log(c.logger, logger.Warn, "msg", msg, "err", err)
-		return fmt.Errorf(msg)
+		logger.Log(c.logger, logger.Warn, "msg", "failed to encode write requests", "err", err)
+		return err
 	}
-
-	if len(timeseries) == 0 {
+	if total == 0 {
 		logger.Log(c.logger, logger.Info, "msg", "no time series to forward to receive endpoint")
 		return nil
 	}
-	logger.Log(c.logger, logger.Debug, "timeseries number", len(timeseries))
-
-	for i := 0; i < len(timeseries); i += maxSeriesLength {
-		length := len(timeseries)
-		if i+maxSeriesLength < length {
-			length = i + maxSeriesLength
+	logger.Log(c.logger, logger.Debug, "timeseries number", total)
+
+	maxElapsed := c.retry.MaxElapsedTime
+	if maxElapsed == 0 {
+		// Do not retry for more than half the scrape interval in total, the
+		// requests being sent in rounds of Concurrency requests.
+		concurrency := c.batch.concurrency()
+		rounds := (len(batches) + concurrency - 1) / concurrency
+		maxElapsed = interval / time.Duration(2*rounds)
+	}
+	results, errs := c.sendBatches(ctx, req, batches, maxElapsed, version)
+
+	if version == RemoteWriteV2 && hasUnsent(errs) {
+		// Both encodings split the series the same way, so the 1.0 requests
+		// replace the 2.0 ones one for one. Unsent requests are always returned
+		// as 1.0, which is what SendBatch replays.
+		if batches, _, err = encodeWriteRequests(families, now, c.batch, metadata); err != nil {
+			logger.Log(c.logger, logger.Warn, "msg", "failed to encode write requests", "err", err)
+			return err
 		}
-		subTimeseries := timeseries[i:length]
-
-		wreq := &prompb.WriteRequest{Timeseries: subTimeseries}
-		data, err := proto.Marshal(wreq)
-		if err != nil {
-			msg := "failed to marshal proto"
-			logger.Log(c.logger, logger.Warn, "msg", msg, "err", err)
-			return fmt.Errorf(msg)
+		var unsupported []int
+		for i, err := range errs {
+			if errors.Is(err, errUnsupportedVersion) {
+				unsupported = append(unsupported, i)
+			}
 		}
-		compressed := snappy.Encode(nil, data)
-
-		// retry RemoteWrite with exponential back-off
-		b := backoff.NewExponentialBackOff()
-		// Do not set max elapsed time more than half the scrape interval
-		halfInterval := len(timeseries) * 2 / maxSeriesLength
-		if halfInterval < 2 {
-			halfInterval = 2
+		if len(unsupported) > 0 {
+			logger.Log(c.logger, logger.Warn, "msg", "receiver does not support remote write 2.0, falling back to 1.0")
+			atomic.StoreUint32(&c.fallback, 1)
+			retry := make([][]byte, 0, len(unsupported))
+			for _, i := range unsupported {
+				retry = append(retry, batches[i])
+			}
+			retryResults, retryErrs := c.sendBatches(ctx, req, retry, maxElapsed, RemoteWriteV1)
+			for j, i := range unsupported {
+				retryResults[j].Attempts += results[i].Attempts
+				results[i], errs[i] = retryResults[j], retryErrs[j]
+			}
 		}
-		b.MaxElapsedTime = interval / time.Duration(halfInterval)
-		retryable := func() error {
-			return c.sendRequest(req.URL.String(), compressed)
+	}
+
+	summary := WriteSummary{Time: time.Now(), Series: total, Batches: len(batches)}
+	var unsent [][]byte
+	var unsentErr, rejectedErr error
+	for i, err := range errs {
+		if results[i].Attempts > 1 {
+			summary.Retried++
 		}
-		notify := func(err error, t time.Duration) {
-			msg := fmt.Sprintf("error: %v happened at time: %v", err, t)
-			logger.Log(c.logger, logger.Warn, "msg", msg)
+		if err == nil {
+			summary.Sent++
+			continue
 		}
-		err = backoff.RetryNotify(retryable, b, notify)
-		if err != nil {
-			return err
+		var rejected *RejectedError
+		if errors.As(err, &rejected) {
+			summary.Rejected++
+			if rejected.StatusCode == http.StatusConflict {
+				// Receivers answer 409 to samples they already have or that are
+				// out of order, such as ones sent again after a timeout. They are
+				// dropped without failing the push.
+				continue
+			}
+			summary.Failed++
+			if rejectedErr == nil {
+				rejectedErr = err
+			}
+			continue
+		}
+		summary.Failed++
+		unsent = append(unsent, batches[i])
+		if unsentErr == nil {
+			unsentErr = err
 		}
 	}
+	logger.Log(c.logger, logger.Info, "msg", "remote write summary", "series", summary.Series, "batches", summary.Batches,
+		"sent", summary.Sent, "retried", summary.Retried, "failed", summary.Failed, "rejected", summary.Rejected)
+	if c.summary != nil {
+		c.summary(summary)
+	}
+	if len(unsent) > 0 {
+		return &UnsentError{Batches: unsent, Err: unsentErr}
+	}
+	if rejectedErr != nil {
+		return rejectedErr
+	}
+	delivered = true
 	msg := fmt.Sprintf("Metrics pushed successfully")
 	logger.Log(c.logger, logger.Info, "msg", msg)
 	return nil
 }
 
-func (c *Client) sendRequest(serverURL string, body []byte) error {
+// hasUnsent reports whether a request failed for another reason than a rejection.
+func hasUnsent(errs []error) bool {
+	for _, err := range errs {
+		var rejected *RejectedError
+		if err != nil && !errors.As(err, &rejected) {
+			return true
+		}
+	}
+	return false
+}
+
+// SendBatch pushes a single snappy compressed write request, retrying with exponential
+// back-off for at most maxElapsed.
+func (c *Client) SendBatch(ctx context.Context, req *http.Request, compressed []byte, maxElapsed time.Duration) error {
+	_, err := c.sendBatch(ctx, req, compressed, maxElapsed, RemoteWriteV1)
+	return err
+}
+
+func (c *Client) sendBatch(ctx context.Context, req *http.Request, compressed []byte,
+	maxElapsed time.Duration, version RemoteWriteVersion) (BatchResult, error) {
+	// retry RemoteWrite with exponential back-off
+	b := &retryAfterBackOff{ExponentialBackOff: backoff.NewExponentialBackOff()}
+	b.MaxElapsedTime = maxElapsed
+	if c.retry.MinBackoff > 0 {
+		b.InitialInterval = c.retry.MinBackoff
+	}
+	if c.retry.MaxBackoff > 0 {
+		b.MaxInterval = c.retry.MaxBackoff
+	}
+	b.Reset()
+	result := BatchResult{Bytes: len(compressed)}
+	retryable := func() error {
+		result.Attempts++
+		var err error
+		result.StatusCode, err = c.sendRequest(ctx, req.URL.String(), compressed, version)
+		if s, ok := err.(*statusError); ok {
+			b.retryAfter = s.RetryAfter
+		}
+		return err
+	}
+	notify := func(err error, t time.Duration) {
+		msg := fmt.Sprintf("error: %v happened at time: %v", err, t)
+		logger.Log(c.logger, logger.Warn, "msg", msg)
+	}
+	err := backoff.RetryNotify(retryable, backoff.WithContext(b, ctx), notify)
+	var rejected *RejectedError
+	if errors.As(err, &rejected) {
+		result.Rejected = true
+		counterDroppedBatches.WithLabelValues(c.metricsName, strconv.Itoa(rejected.StatusCode)).Inc()
+	}
+	if c.observer != nil {
+		result.Time = time.Now()
+		if err != nil {
+			result.Error = err.Error()
+		}
+		c.observer(result)
+	}
+	return result, err
+}
+
+// sendRequest posts a write request and returns the status code of the response, if any.
+// Client errors other than 429 are returned as a permanent *RejectedError, and other
+// failures as retryable errors.
+func (c *Client) sendRequest(ctx context.Context, serverURL string, body []byte, version RemoteWriteVersion) (int, error) {
+	timeout := c.retry.RequestTimeout
+	if timeout <= 0 {
+		timeout = defaultRequestTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 	req1, err := http.NewRequest(http.MethodPost, serverURL, bytes.NewBuffer(body))
 	if err != nil {
 		msg := "failed to create forwarding request"
 		logger.Log(c.logger, logger.Warn, "msg", msg, "err", err)
-		return fmt.Errorf(msg)
+		return 0, backoff.Permanent(fmt.Errorf("%s: %v", msg, err))
 	}
-
-	//req.Header.Add("THANOS-TENANT", tenantID)
-
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
 	req1 = req1.WithContext(ctx)
+	contentType, versionValue := version.headers()
+	req1.Header.Set("Content-Type", contentType)
+	req1.Header.Set("Content-Encoding", "snappy")
+	req1.Header.Set(versionHeader, versionValue)
 
 	resp, err := c.client.Do(req1)
 	if err != nil {
 		msg := "failed to forward request"
 		logger.Log(c.logger, logger.Warn, "msg", msg, "err", err)
-		return fmt.Errorf(msg)
+		counterRemoteWriteRequests.WithLabelValues(c.metricsName, outcomeTransportError).Inc()
+		return 0, fmt.Errorf("%s: %v", msg, err)
+	}
+	defer func() {
+		// Drain the body so that the connection can be reused.
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+	c.countSend(strconv.Itoa(resp.StatusCode))
+	result := outcome(resp.StatusCode)
+	counterRemoteWriteRequests.WithLabelValues(c.metricsName, result).Inc()
+	if result == outcomeSuccess {
+		return resp.StatusCode, nil
 	}
 
-	if resp.StatusCode/100 != 2 {
-		// surfacing upstreams error to our users too
-		bodyBytes, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			logger.Log(c.logger, logger.Warn, err)
-		}
-		bodyString := string(bodyBytes)
-		msg := fmt.Sprintf("response status code is %s, response body is %s", resp.Status, bodyString)
-		logger.Log(c.logger, logger.Warn, msg)
-		if resp.StatusCode != http.StatusConflict {
-			return fmt.Errorf(msg)
-		}
+	// surfacing upstreams error to our users too
+	bodyBytes, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodyBytes))
+	if err != nil {
+		logger.Log(c.logger, logger.Warn, "msg", "failed to read response body", "err", err)
+	}
+	bodyString := string(bodyBytes)
+	logger.Log(c.logger, logger.Warn, "msg", "write request failed", "status", resp.Status, "body", bodyString)
+	if version == RemoteWriteV2 && resp.StatusCode == http.StatusUnsupportedMediaType {
+		return resp.StatusCode, backoff.Permanent(errUnsupportedVersion)
+	}
+	if result == outcomeRejected {
+		return resp.StatusCode, backoff.Permanent(&RejectedError{StatusCode: resp.StatusCode, Body: bodyString})
+	}
+	return resp.StatusCode, &statusError{
+		StatusCode: resp.StatusCode,
+		Body:       bodyString,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
 	}
-	return nil
 }
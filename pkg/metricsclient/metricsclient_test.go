@@ -2,15 +2,27 @@
 package metricsclient
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"runtime"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
 	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
 	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/stolostron/metrics-collector/pkg/reader"
 )
 
 func TestDefaultTransport(t *testing.T) {
@@ -30,6 +42,9 @@ func Test_convertToTimeseries(t *testing.T) {
 	counter := clientmodel.MetricType_COUNTER
 	untyped := clientmodel.MetricType_UNTYPED
 	gauge := clientmodel.MetricType_GAUGE
+	histogram := clientmodel.MetricType_HISTOGRAM
+	summary := clientmodel.MetricType_SUMMARY
+	unsupported := clientmodel.MetricType(42)
 
 	fooMetricName := "foo_metric"
 	fooHelp := "foo help text"
@@ -44,6 +59,12 @@ func Test_convertToTimeseries(t *testing.T) {
 
 	value42 := 42.0
 	value50 := 50.0
+	count10 := uint64(10)
+	count20 := uint64(20)
+	bound1 := 0.5
+	bound2 := 1.0
+	quantile1 := 0.5
+	quantile2 := 0.99
 	timestamp := int64(1596948588956) //15615582020000)
 	now := time.Now()
 	nowTimestamp := now.UnixNano() / int64(time.Millisecond)
@@ -165,13 +186,108 @@ func Test_convertToTimeseries(t *testing.T) {
 			Labels:  []prompb.Label{{Name: nameLabelName, Value: barMetricName}, {Name: barLabelName, Value: barLabelValue1}},
 			Samples: []prompb.Sample{{Value: value42, Timestamp: timestamp}},
 		}},
+	}, {
+		name: "histogram",
+		in: &PartitionedMetrics{
+			Families: []*clientmodel.MetricFamily{{
+				Name: &fooMetricName,
+				Help: &fooHelp,
+				Type: &histogram,
+				Metric: []*clientmodel.Metric{{
+					Label: []*clientmodel.LabelPair{{Name: &fooLabelName, Value: &fooLabelValue1}},
+					Histogram: &clientmodel.Histogram{
+						SampleCount: &count20,
+						SampleSum:   &value42,
+						Bucket: []*clientmodel.Bucket{
+							{UpperBound: &bound1, CumulativeCount: &count10},
+							{UpperBound: &bound2, CumulativeCount: &count20},
+						},
+					},
+					TimestampMs: &timestamp,
+				}},
+			}},
+		},
+		want: []prompb.TimeSeries{{
+			Labels:  []prompb.Label{{Name: nameLabelName, Value: fooMetricName + "_bucket"}, {Name: fooLabelName, Value: fooLabelValue1}, {Name: "le", Value: "0.5"}},
+			Samples: []prompb.Sample{{Value: 10, Timestamp: timestamp}},
+		}, {
+			Labels:  []prompb.Label{{Name: nameLabelName, Value: fooMetricName + "_bucket"}, {Name: fooLabelName, Value: fooLabelValue1}, {Name: "le", Value: "1"}},
+			Samples: []prompb.Sample{{Value: 20, Timestamp: timestamp}},
+		}, {
+			Labels:  []prompb.Label{{Name: nameLabelName, Value: fooMetricName + "_bucket"}, {Name: fooLabelName, Value: fooLabelValue1}, {Name: "le", Value: "+Inf"}},
+			Samples: []prompb.Sample{{Value: 20, Timestamp: timestamp}},
+		}, {
+			Labels:  []prompb.Label{{Name: nameLabelName, Value: fooMetricName + "_sum"}, {Name: fooLabelName, Value: fooLabelValue1}},
+			Samples: []prompb.Sample{{Value: value42, Timestamp: timestamp}},
+		}, {
+			Labels:  []prompb.Label{{Name: nameLabelName, Value: fooMetricName + "_count"}, {Name: fooLabelName, Value: fooLabelValue1}},
+			Samples: []prompb.Sample{{Value: 20, Timestamp: timestamp}},
+		}},
+	}, {
+		name: "summary",
+		in: &PartitionedMetrics{
+			Families: []*clientmodel.MetricFamily{{
+				Name: &fooMetricName,
+				Help: &fooHelp,
+				Type: &summary,
+				Metric: []*clientmodel.Metric{{
+					Label: []*clientmodel.LabelPair{{Name: &fooLabelName, Value: &fooLabelValue1}},
+					Summary: &clientmodel.Summary{
+						SampleCount: &count10,
+						SampleSum:   &value50,
+						Quantile: []*clientmodel.Quantile{
+							{Quantile: &quantile1, Value: &value42},
+							{Quantile: &quantile2, Value: &value50},
+						},
+					},
+					TimestampMs: &timestamp,
+				}},
+			}},
+		},
+		want: []prompb.TimeSeries{{
+			Labels:  []prompb.Label{{Name: nameLabelName, Value: fooMetricName}, {Name: fooLabelName, Value: fooLabelValue1}, {Name: "quantile", Value: "0.5"}},
+			Samples: []prompb.Sample{{Value: value42, Timestamp: timestamp}},
+		}, {
+			Labels:  []prompb.Label{{Name: nameLabelName, Value: fooMetricName}, {Name: fooLabelName, Value: fooLabelValue1}, {Name: "quantile", Value: "0.99"}},
+			Samples: []prompb.Sample{{Value: value50, Timestamp: timestamp}},
+		}, {
+			Labels:  []prompb.Label{{Name: nameLabelName, Value: fooMetricName + "_sum"}, {Name: fooLabelName, Value: fooLabelValue1}},
+			Samples: []prompb.Sample{{Value: value50, Timestamp: timestamp}},
+		}, {
+			Labels:  []prompb.Label{{Name: nameLabelName, Value: fooMetricName + "_count"}, {Name: fooLabelName, Value: fooLabelValue1}},
+			Samples: []prompb.Sample{{Value: 10, Timestamp: timestamp}},
+		}},
+	}, {
+		name: "unsupported type is skipped",
+		in: &PartitionedMetrics{
+			Families: []*clientmodel.MetricFamily{{
+				Name: &fooMetricName,
+				Help: &fooHelp,
+				Type: &unsupported,
+				Metric: []*clientmodel.Metric{{
+					Label:       []*clientmodel.LabelPair{{Name: &fooLabelName, Value: &fooLabelValue1}},
+					Untyped:     &clientmodel.Untyped{Value: &value42},
+					TimestampMs: &timestamp,
+				}},
+			}, {
+				Name: &barMetricName,
+				Help: &barHelp,
+				Type: &gauge,
+				Metric: []*clientmodel.Metric{{
+					Label:       []*clientmodel.LabelPair{{Name: &barLabelName, Value: &barLabelValue1}},
+					Gauge:       &clientmodel.Gauge{Value: &value42},
+					TimestampMs: &timestamp,
+				}},
+			}},
+		},
+		want: []prompb.TimeSeries{{
+			Labels:  []prompb.Label{{Name: nameLabelName, Value: barMetricName}, {Name: barLabelName, Value: barLabelValue1}},
+			Samples: []prompb.Sample{{Value: value42, Timestamp: timestamp}},
+		}},
 	}}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			out, err := convertToTimeseries(tt.in, now)
-			if err != nil {
-				t.Errorf("converting timeseries errored: %v", err)
-			}
+			out := convertToTimeseries(tt.in, now)
 			if ok, err := timeseriesEqual(tt.want, out); !ok {
 				// t.Error("want: ", tt.want)
 				// t.Error("out: ", out)
@@ -209,3 +325,298 @@ func timeseriesEqual(t1 []prompb.TimeSeries, t2 []prompb.TimeSeries) (bool, erro
 
 	return true, nil
 }
+
+func TestRetrieveErrors(t *testing.T) {
+	families := benchmarkFamilies(3, 2)
+	buf := &bytes.Buffer{}
+	encoder := expfmt.NewEncoder(buf, expfmt.FmtProtoDelim)
+	for _, family := range families {
+		if err := encoder.Encode(family); err != nil {
+			t.Fatal(err)
+		}
+	}
+	valid := buf.Bytes()
+	// The length prefix announces more bytes than are left.
+	malformed := append(append([]byte(nil), valid...), 0x10, 0x0a)
+
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", string(expfmt.FmtProtoDelim))
+		_, _ = w.Write(body)
+	}))
+	defer server.Close()
+	retrieve := func(limit int64) ([]*clientmodel.MetricFamily, error) {
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		return New(log.NewNopLogger(), server.Client(), limit, time.Minute, "test").Retrieve(context.Background(), req)
+	}
+
+	body = valid
+	got, err := retrieve(1 << 20)
+	if err != nil || len(got) != len(families) {
+		t.Errorf("expected %d families, got %d: %v", len(families), len(got), err)
+	}
+
+	// A body of exactly the limit is not truncated.
+	got, err = retrieve(int64(len(valid)))
+	if err != nil || len(got) != len(families) {
+		t.Errorf("expected %d families at exactly the limit, got %d: %v", len(families), len(got), err)
+	}
+
+	got, err = retrieve(int64(len(valid) - 1))
+	var truncated *TruncatedError
+	if !errors.As(err, &truncated) || truncated.Limit != int64(len(valid)-1) || !errors.Is(err, reader.ErrTooLong) {
+		t.Errorf("expected a truncated error, got %v", err)
+	}
+	if len(got) != len(families)-1 {
+		t.Errorf("expected the %d families before the limit, got %d", len(families)-1, len(got))
+	}
+
+	body = malformed
+	got, err = retrieve(1 << 20)
+	var decode *DecodeError
+	if !errors.As(err, &decode) || !IsPartial(err) {
+		t.Errorf("expected a decode error, got %v", err)
+	}
+	if len(got) != len(families) {
+		t.Errorf("expected the %d families before the malformed one, got %d", len(families), len(got))
+	}
+}
+
+func TestRemoteWriteMetadata(t *testing.T) {
+	var mu sync.Mutex
+	var metadata [][]string
+	fail := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		compressed, _ := ioutil.ReadAll(r.Body)
+		data, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Error(err)
+		}
+		var names []string
+		fields(t, data, func(field uint64, msg []byte, _ uint64) {
+			if field != 3 {
+				return
+			}
+			var name, help string
+			var typ uint64
+			fields(t, msg, func(field uint64, b []byte, v uint64) {
+				switch field {
+				case 1:
+					typ = v
+				case 2:
+					name = string(b)
+				case 4:
+					help = string(b)
+				}
+			})
+			names = append(names, fmt.Sprintf("%s %d %s", name, typ, help))
+		})
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		metadata = append(metadata, names)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	families := benchmarkFamilies(2, 1)
+	families[1].Help = proto.String("The second metric.")
+	client := New(log.NewNopLogger(), server.Client(), 0, time.Minute, "test").
+		WithRetryPolicy(RetryPolicy{MaxElapsedTime: time.Millisecond}).
+		WithMetadata(2)
+	req, _ := http.NewRequest(http.MethodPost, server.URL, nil)
+	for i := 0; i < 5; i++ {
+		mu.Lock()
+		fail = i == 2
+		mu.Unlock()
+		err := client.RemoteWrite(context.Background(), req, families, time.Minute)
+		if (err != nil) != fail {
+			t.Fatalf("push %d: unexpected error %v", i, err)
+		}
+	}
+
+	all := []string{"metric_0 2 ", "metric_1 2 The second metric."}
+	// The metadata is sent every other push, and again after the failed third one.
+	want := [][]string{all, nil, all, nil}
+	if !reflect.DeepEqual(metadata, want) {
+		t.Errorf("expected metadata %q, got %q", want, metadata)
+	}
+}
+
+// benchmarkFamilies returns n gauge families of m series each.
+func benchmarkFamilies(n, m int) []*clientmodel.MetricFamily {
+	str := func(s string) *string { return &s }
+	families := make([]*clientmodel.MetricFamily, 0, n)
+	for i := 0; i < n; i++ {
+		family := &clientmodel.MetricFamily{Name: str(fmt.Sprintf("metric_%d", i)), Type: clientmodel.MetricType_GAUGE.Enum()}
+		for j := 0; j < m; j++ {
+			value := float64(j)
+			ts := int64(1000 * j)
+			family.Metric = append(family.Metric, &clientmodel.Metric{
+				Label:       []*clientmodel.LabelPair{{Name: str("instance"), Value: str(fmt.Sprintf("instance-%d", j))}},
+				Gauge:       &clientmodel.Gauge{Value: &value},
+				TimestampMs: &ts,
+			})
+		}
+		families = append(families, family)
+	}
+	return families
+}
+
+// benchmarkServer serves the families in the delimited protobuf format, as the
+// federate endpoint does.
+func benchmarkServer(b *testing.B, families []*clientmodel.MetricFamily) *httptest.Server {
+	buf := &bytes.Buffer{}
+	encoder := expfmt.NewEncoder(buf, expfmt.FmtProtoDelim)
+	for _, family := range families {
+		if err := encoder.Encode(family); err != nil {
+			b.Fatal(err)
+		}
+	}
+	body := buf.Bytes()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", string(expfmt.FmtProtoDelim))
+		_, _ = w.Write(body)
+	}))
+}
+
+// BenchmarkRetrieve decodes the whole response before encoding the write requests.
+// benchmarkKept keeps 10 of the 1000 families of the benchmarks, as the
+// forwarder filters would.
+func benchmarkKept(family *clientmodel.MetricFamily) bool {
+	var i int
+	_, err := fmt.Sscanf(family.GetName(), "metric_%d", &i)
+	return err == nil && i%100 == 0
+}
+
+// reportPeakHeap runs fn once more outside of the timed loop and reports the
+// highest heap size sampled while it runs, above the heap size before it. fn
+// calls sample once the kept families are decoded, while they are all held in
+// memory, in addition to the periodic samples.
+func reportPeakHeap(b *testing.B, fn func(sample func())) {
+	b.StopTimer()
+	defer b.StartTimer()
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	base := stats.HeapAlloc
+
+	var mu sync.Mutex
+	var peak uint64
+	sample := func() {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		mu.Lock()
+		if stats.HeapAlloc > peak {
+			peak = stats.HeapAlloc
+		}
+		mu.Unlock()
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				sample()
+			}
+		}
+	}()
+	fn(sample)
+	close(done)
+	<-stopped
+
+	if peak < base {
+		peak = base
+	}
+	b.ReportMetric(float64(peak-base)/(1<<20), "peak-heap-MB")
+}
+
+// BenchmarkRetrieve decodes the whole response before dropping the families
+// that are not kept.
+func BenchmarkRetrieve(b *testing.B) {
+	server := benchmarkServer(b, benchmarkFamilies(1000, 100))
+	defer server.Close()
+	client := New(log.NewNopLogger(), server.Client(), 1<<30, time.Minute, "bench")
+	retrieve := func(sample func()) {
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		families, err := client.Retrieve(context.Background(), req)
+		if err != nil {
+			b.Fatal(err)
+		}
+		sample()
+		var kept []*clientmodel.MetricFamily
+		for _, family := range families {
+			if benchmarkKept(family) {
+				kept = append(kept, family)
+			}
+		}
+		if len(kept) != 10 {
+			b.Fatalf("expected 10 families, got %d", len(kept))
+		}
+		if _, err := EncodeWriteRequests(kept); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		retrieve(func() {})
+	}
+	reportPeakHeap(b, retrieve)
+}
+
+// BenchmarkRetrieveFunc drops the same families as BenchmarkRetrieve, but as
+// they are decoded, so that only the kept ones are held in memory.
+func BenchmarkRetrieveFunc(b *testing.B) {
+	server := benchmarkServer(b, benchmarkFamilies(1000, 100))
+	defer server.Close()
+	client := New(log.NewNopLogger(), server.Client(), 1<<30, time.Minute, "bench")
+	retrieve := func(sample func()) {
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		var kept []*clientmodel.MetricFamily
+		err := client.RetrieveFunc(context.Background(), req, func(family *clientmodel.MetricFamily) error {
+			if benchmarkKept(family) {
+				kept = append(kept, family)
+			}
+			return nil
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		sample()
+		if len(kept) != 10 {
+			b.Fatalf("expected 10 families, got %d", len(kept))
+		}
+		if _, err := EncodeWriteRequests(kept); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		retrieve(func() {})
+	}
+	reportPeakHeap(b, retrieve)
+}
+
+// BenchmarkEncodeWriteRequests encodes the requests without building the
+// timeseries of all the families first.
+func BenchmarkEncodeWriteRequests(b *testing.B) {
+	families := benchmarkFamilies(1000, 100)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := EncodeWriteRequests(families); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
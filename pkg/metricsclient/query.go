@@ -0,0 +1,273 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package metricsclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gogo/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql"
+
+	"github.com/stolostron/metrics-collector/pkg/logger"
+)
+
+// MetricsJson is the response of the Prometheus query API.
+type MetricsJson struct {
+	Status    string      `json:"status"`
+	Data      MetricsData `json:"data"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	Warnings  []string    `json:"warnings,omitempty"`
+}
+
+// MetricsData is the result of a query, decoded according to its type.
+type MetricsData struct {
+	Type   string          `json:"resultType"`
+	Result json.RawMessage `json:"result"`
+}
+
+// MetricsResult is a series of a vector or matrix result.
+type MetricsResult struct {
+	Metric map[string]string `json:"metric"`
+	// Value is the sample of a vector result.
+	Value []interface{} `json:"value,omitempty"`
+	// Values are the samples of a matrix result.
+	Values [][]interface{} `json:"values,omitempty"`
+}
+
+// querySample is a sample of a query result.
+type querySample struct {
+	labels map[string]string
+	t      int64
+	v      float64
+}
+
+// RetrievRecordingMetrics evaluates a query and returns its result as an untyped family.
+func (c *Client) RetrievRecordingMetrics(ctx context.Context, req *http.Request, name string) ([]*clientmodel.MetricFamily, error) {
+	return c.RetrieveQuery(ctx, req, name, clientmodel.MetricType_UNTYPED)
+}
+
+// RetrieveQuery evaluates a query with the Prometheus query API and returns its
+// result as a single family of the given name and type. Vector and scalar results
+// are returned as is, and the most recent sample of every series of a matrix
+// result. Warnings are logged, and an error returned by the API fails the query.
+func (c *Client) RetrieveQuery(ctx context.Context, req *http.Request, name string, typ clientmodel.MetricType) ([]*clientmodel.MetricFamily, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	req = req.WithContext(ctx)
+	defer cancel()
+	var families []*clientmodel.MetricFamily
+	err := withCancel(ctx, c.client, req, func(resp *http.Response) error {
+		switch resp.StatusCode {
+		case http.StatusOK:
+			c.countRetrieve("200")
+		case http.StatusUnauthorized:
+			c.countRetrieve("401")
+			return fmt.Errorf("Prometheus server requires authentication: %s", resp.Request.URL)
+		case http.StatusForbidden:
+			c.countRetrieve("403")
+			return fmt.Errorf("Prometheus server forbidden: %s", resp.Request.URL)
+		case http.StatusBadRequest, http.StatusUnprocessableEntity, http.StatusServiceUnavailable:
+			// The query API describes these errors in the body.
+			c.countRetrieve(strconv.Itoa(resp.StatusCode))
+		default:
+			c.countRetrieve(strconv.Itoa(resp.StatusCode))
+			return fmt.Errorf("Prometheus server reported unexpected error code: %d", resp.StatusCode)
+		}
+
+		var data MetricsJson
+		if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+			return &DecodeError{Err: err}
+		}
+		if data.Status != "success" {
+			if len(data.Error) == 0 {
+				return fmt.Errorf("query failed with status %q and code %d", data.Status, resp.StatusCode)
+			}
+			return fmt.Errorf("query failed: %s: %s", data.ErrorType, data.Error)
+		}
+		for _, w := range data.Warnings {
+			logger.Log(c.logger, logger.Warn, "msg", "query returned a warning", "metric", name, "warning", w)
+		}
+
+		samples, err := parseQueryResult(data.Data)
+		if err != nil {
+			return &DecodeError{Err: err}
+		}
+		if len(samples) == 0 {
+			return nil
+		}
+		families = append(families, queryFamily(name, typ, samples))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return families, nil
+}
+
+// FamilyFromValue converts the result of a query evaluated with the promql engine
+// to a family the same way RetrieveQuery does, or returns nil if it is empty.
+func FamilyFromValue(name string, typ clientmodel.MetricType, v promql.Value) (*clientmodel.MetricFamily, error) {
+	var samples []querySample
+	switch v := v.(type) {
+	case promql.Vector:
+		for _, s := range v {
+			samples = append(samples, querySample{labels: s.Metric.Map(), t: s.T, v: s.V})
+		}
+	case promql.Scalar:
+		samples = append(samples, querySample{t: v.T, v: v.V})
+	case promql.Matrix:
+		for _, s := range v {
+			if len(s.Points) == 0 {
+				continue
+			}
+			p := s.Points[len(s.Points)-1]
+			samples = append(samples, querySample{labels: s.Metric.Map(), t: p.T, v: p.V})
+		}
+	default:
+		return nil, fmt.Errorf("unsupported result type %q", v.Type())
+	}
+	if len(samples) == 0 {
+		return nil, nil
+	}
+	return queryFamily(name, typ, samples), nil
+}
+
+// ToSeries expands the families to the series they are made of, the way they are
+// sent with remote write, but keeping the timestamps of the samples as they are.
+func ToSeries(families []*clientmodel.MetricFamily) []promql.Series {
+	timeseries := make([]prompb.TimeSeries, 0, len(families))
+	for _, f := range families {
+		timeseries = appendFamily(timeseries, f, math.MaxInt64)
+	}
+	series := make([]promql.Series, 0, len(timeseries))
+	for _, ts := range timeseries {
+		ls := make(labels.Labels, 0, len(ts.Labels))
+		for _, l := range ts.Labels {
+			ls = append(ls, labels.Label{Name: l.Name, Value: l.Value})
+		}
+		sort.Sort(ls)
+		points := make([]promql.Point, 0, len(ts.Samples))
+		for _, s := range ts.Samples {
+			points = append(points, promql.Point{T: s.Timestamp, V: s.Value})
+		}
+		series = append(series, promql.Series{Metric: ls, Points: points})
+	}
+	return series
+}
+
+// parseQueryResult returns the samples of a vector, scalar or matrix result.
+func parseQueryResult(data MetricsData) ([]querySample, error) {
+	switch data.Type {
+	case "vector":
+		var results []MetricsResult
+		if err := json.Unmarshal(data.Result, &results); err != nil {
+			return nil, err
+		}
+		samples := make([]querySample, 0, len(results))
+		for _, r := range results {
+			t, v, err := parseQueryPoint(r.Value)
+			if err != nil {
+				return nil, err
+			}
+			samples = append(samples, querySample{labels: r.Metric, t: t, v: v})
+		}
+		return samples, nil
+	case "scalar":
+		var point []interface{}
+		if err := json.Unmarshal(data.Result, &point); err != nil {
+			return nil, err
+		}
+		t, v, err := parseQueryPoint(point)
+		if err != nil {
+			return nil, err
+		}
+		return []querySample{{t: t, v: v}}, nil
+	case "matrix":
+		var results []MetricsResult
+		if err := json.Unmarshal(data.Result, &results); err != nil {
+			return nil, err
+		}
+		samples := make([]querySample, 0, len(results))
+		for _, r := range results {
+			if len(r.Values) == 0 {
+				continue
+			}
+			// The samples of a series are ordered by time, the last one is the most recent.
+			t, v, err := parseQueryPoint(r.Values[len(r.Values)-1])
+			if err != nil {
+				return nil, err
+			}
+			samples = append(samples, querySample{labels: r.Metric, t: t, v: v})
+		}
+		return samples, nil
+	default:
+		return nil, fmt.Errorf("unsupported result type %q", data.Type)
+	}
+}
+
+// parseQueryPoint parses a [timestamp, "value"] pair. The value is a string so
+// that NaN and infinities can be represented.
+func parseQueryPoint(point []interface{}) (int64, float64, error) {
+	if len(point) != 2 {
+		return 0, 0, fmt.Errorf("expected a timestamp and a value, got %v", point)
+	}
+	ts, ok := point[0].(float64)
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid timestamp %v", point[0])
+	}
+	s, ok := point[1].(string)
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid value %v", point[1])
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid value %q: %v", s, err)
+	}
+	return int64(ts * 1000), v, nil
+}
+
+// queryFamily builds a family of the given type from the samples. The name of
+// the series returned by the query is replaced by the name of the family.
+func queryFamily(name string, typ clientmodel.MetricType, samples []querySample) *clientmodel.MetricFamily {
+	family := &clientmodel.MetricFamily{
+		Name: proto.String(name),
+		Type: typ.Enum(),
+	}
+	for _, s := range samples {
+		m := &clientmodel.Metric{TimestampMs: proto.Int64(s.t)}
+		names := make([]string, 0, len(s.labels))
+		for k, v := range s.labels {
+			// No value means unset. Never consider those labels.
+			if len(v) == 0 || k == nameLabelName {
+				continue
+			}
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			m.Label = append(m.Label, &clientmodel.LabelPair{
+				Name:  proto.String(k),
+				Value: proto.String(s.labels[k]),
+			})
+		}
+		switch typ {
+		case clientmodel.MetricType_GAUGE:
+			m.Gauge = &clientmodel.Gauge{Value: proto.Float64(s.v)}
+		case clientmodel.MetricType_COUNTER:
+			m.Counter = &clientmodel.Counter{Value: proto.Float64(s.v)}
+		default:
+			m.Untyped = &clientmodel.Untyped{Value: proto.Float64(s.v)}
+		}
+		family.Metric = append(family.Metric, m)
+	}
+	return family
+}
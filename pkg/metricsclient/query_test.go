@@ -0,0 +1,136 @@
+// Copyright Contributors to the Open Cluster Management project
+package metricsclient
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestRetrieveQuery(t *testing.T) {
+	var body string
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+	defer server.Close()
+	client := New(log.NewNopLogger(), server.Client(), 0, time.Minute, "test")
+	query := func(typ clientmodel.MetricType) ([]*clientmodel.MetricFamily, error) {
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		return client.RetrieveQuery(context.Background(), req, "rule", typ)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		status int
+		body   string
+		typ    clientmodel.MetricType
+		values []float64
+		err    bool
+	}{
+		{
+			name:   "vector",
+			body:   `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up","job":"a"},"value":[1600000000.5,"1"]},{"metric":{"job":"b"},"value":[1600000000,"NaN"]}]}}`,
+			typ:    clientmodel.MetricType_GAUGE,
+			values: []float64{1, math.NaN()},
+		},
+		{
+			name:   "scalar",
+			body:   `{"status":"success","data":{"resultType":"scalar","result":[1600000000,"+Inf"]}}`,
+			typ:    clientmodel.MetricType_COUNTER,
+			values: []float64{math.Inf(1)},
+		},
+		{
+			name:   "matrix keeps the most recent sample",
+			body:   `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"job":"a"},"values":[[1600000000,"1"],[1600000060,"-Inf"]]}]}}`,
+			typ:    clientmodel.MetricType_UNTYPED,
+			values: []float64{math.Inf(-1)},
+		},
+		{
+			name: "warnings",
+			body: `{"status":"success","warnings":["partial response"],"data":{"resultType":"vector","result":[]}}`,
+		},
+		{
+			name:   "api error",
+			status: http.StatusUnprocessableEntity,
+			body:   `{"status":"error","errorType":"execution","error":"query timed out"}`,
+			err:    true,
+		},
+		{
+			name: "string result",
+			body: `{"status":"success","data":{"resultType":"string","result":[1600000000,"a"]}}`,
+			err:  true,
+		},
+		{
+			name: "unexpected shape",
+			body: `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":["a"]}]}}`,
+			err:  true,
+		},
+		{
+			name: "invalid value",
+			body: `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1600000000,"a"]}]}}`,
+			err:  true,
+		},
+		{
+			name: "malformed",
+			body: `{"status":`,
+			err:  true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			body, status = tc.body, http.StatusOK
+			if tc.status != 0 {
+				status = tc.status
+			}
+			families, err := query(tc.typ)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(tc.values) == 0 {
+				if len(families) != 0 {
+					t.Errorf("expected no family, got %v", families)
+				}
+				return
+			}
+			if len(families) != 1 || families[0].GetName() != "rule" || families[0].GetType() != tc.typ {
+				t.Fatalf("expected a single %s family named rule, got %v", tc.typ, families)
+			}
+			metrics := families[0].Metric
+			if len(metrics) != len(tc.values) {
+				t.Fatalf("expected %d series, got %d", len(tc.values), len(metrics))
+			}
+			for i, m := range metrics {
+				var v float64
+				switch tc.typ {
+				case clientmodel.MetricType_GAUGE:
+					v = m.GetGauge().GetValue()
+				case clientmodel.MetricType_COUNTER:
+					v = m.GetCounter().GetValue()
+				default:
+					v = m.GetUntyped().GetValue()
+				}
+				if v != tc.values[i] && !(math.IsNaN(v) && math.IsNaN(tc.values[i])) {
+					t.Errorf("expected value %v, got %v", tc.values[i], v)
+				}
+				for _, l := range m.Label {
+					if l.GetName() == nameLabelName {
+						t.Errorf("expected the name of the series to be dropped, got %v", m.Label)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package metricsclient
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cenkalti/backoff"
+)
+
+// The outcomes of the remote write requests.
+const (
+	outcomeSuccess        = "success"
+	outcomeRejected       = "rejected"
+	outcomeThrottled      = "throttled"
+	outcomeServerError    = "server_error"
+	outcomeTransportError = "transport_error"
+)
+
+// RejectedError is returned when the receiver answers a write request with a
+// client error other than 429 Too Many Requests. Sending the same request again
+// would fail the same way, so it is dropped instead of being retried or queued.
+type RejectedError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("write request rejected with status code %d: %s", e.StatusCode, e.Body)
+}
+
+// statusError is a retryable response of the receiver. RetryAfter is the delay
+// requested by the Retry-After header, if any.
+type statusError struct {
+	StatusCode int
+	Body       string
+	RetryAfter time.Duration
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("response status code is %d, response body is %s", e.StatusCode, e.Body)
+}
+
+// outcome classifies a response status code.
+func outcome(code int) string {
+	switch {
+	case code/100 == 2:
+		return outcomeSuccess
+	case code == http.StatusTooManyRequests:
+		return outcomeThrottled
+	case code/100 == 4:
+		return outcomeRejected
+	default:
+		return outcomeServerError
+	}
+}
+
+// parseRetryAfter parses a Retry-After header, either a number of seconds or an
+// HTTP date. It returns zero if the header is missing or invalid.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if len(value) == 0 {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// retryAfterBackOff waits at least the delay requested by the receiver before the
+// next attempt, and gives up if that delay exceeds the time left to retry.
+type retryAfterBackOff struct {
+	*backoff.ExponentialBackOff
+	retryAfter time.Duration
+}
+
+func (b *retryAfterBackOff) NextBackOff() time.Duration {
+	next := b.ExponentialBackOff.NextBackOff()
+	after := b.retryAfter
+	b.retryAfter = 0
+	if next == backoff.Stop || after <= next {
+		return next
+	}
+	if b.MaxElapsedTime != 0 && b.GetElapsedTime()+after > b.MaxElapsedTime {
+		return backoff.Stop
+	}
+	return after
+}
@@ -0,0 +1,131 @@
+// Copyright Contributors to the Open Cluster Management project
+package metricsclient
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	for value, want := range map[string]time.Duration{
+		"":                              0,
+		"3":                             3 * time.Second,
+		"-1":                            0,
+		"soon":                          0,
+		"Fri, 01 Jan 2021 00:00:10 GMT": 10 * time.Second,
+		"Thu, 31 Dec 2020 23:59:00 GMT": 0,
+	} {
+		if got := parseRetryAfter(value, now); got != want {
+			t.Errorf("%q: expected %s, got %s", value, want, got)
+		}
+	}
+}
+
+func TestRemoteWriteRetries(t *testing.T) {
+	var mu sync.Mutex
+	var responses []int
+	var codes []int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		code := http.StatusNoContent
+		if len(responses) > 0 {
+			code, responses = responses[0], responses[1:]
+		}
+		codes = append(codes, code)
+		if code == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "1")
+		}
+		w.WriteHeader(code)
+	}))
+	defer server.Close()
+
+	var results []BatchResult
+	client := New(log.NewNopLogger(), server.Client(), 0, time.Minute, "test").
+		WithRetryPolicy(RetryPolicy{MaxElapsedTime: 10 * time.Second, MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}).
+		WithBatchObserver(func(r BatchResult) { results = append(results, r) })
+	req, _ := http.NewRequest(http.MethodPost, server.URL, nil)
+	push := func(codes ...int) error {
+		mu.Lock()
+		responses = codes
+		mu.Unlock()
+		results = nil
+		return client.RemoteWrite(context.Background(), req, benchmarkFamilies(1, 1), time.Minute)
+	}
+
+	// Server errors are retried.
+	if err := push(http.StatusInternalServerError, http.StatusBadGateway); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Attempts != 3 || results[0].StatusCode != http.StatusNoContent {
+		t.Errorf("expected a request delivered after 3 attempts, got %+v", results)
+	}
+
+	// 429 is retried after the delay requested by the receiver.
+	start := time.Now()
+	if err := push(http.StatusTooManyRequests); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("expected the Retry-After delay to be honoured, retried after %s", elapsed)
+	}
+
+	// Other client errors are dropped without retries.
+	mu.Lock()
+	codes = nil
+	mu.Unlock()
+	err := push(http.StatusBadRequest)
+	var rejected *RejectedError
+	if !errors.As(err, &rejected) || rejected.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected a rejected error, got %v", err)
+	}
+	var unsent *UnsentError
+	if errors.As(err, &unsent) {
+		t.Errorf("expected the rejected request not to be returned for replay")
+	}
+	if !reflect.DeepEqual(codes, []int{http.StatusBadRequest}) || !results[0].Rejected {
+		t.Errorf("expected a single rejected attempt, got %v and %+v", codes, results)
+	}
+
+	// 409 is dropped without retries, but does not fail the push.
+	mu.Lock()
+	codes = nil
+	mu.Unlock()
+	if err := push(http.StatusConflict); err != nil {
+		t.Errorf("expected the conflicting request to be dropped without error, got %v", err)
+	}
+	if !reflect.DeepEqual(codes, []int{http.StatusConflict}) || !results[0].Rejected {
+		t.Errorf("expected a single rejected attempt, got %v and %+v", codes, results)
+	}
+}
+
+func TestRemoteWriteRequestTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	req, _ := http.NewRequest(http.MethodPost, server.URL, nil)
+
+	// Without a request timeout, the attempts are not bounded by the interval of the client.
+	client := New(log.NewNopLogger(), server.Client(), 0, time.Millisecond, "test").
+		WithRetryPolicy(RetryPolicy{MaxElapsedTime: time.Millisecond})
+	if err := client.RemoteWrite(context.Background(), req, benchmarkFamilies(1, 1), time.Minute); err != nil {
+		t.Errorf("expected the request to be delivered, got %v", err)
+	}
+
+	client = New(log.NewNopLogger(), server.Client(), 0, time.Minute, "test").
+		WithRetryPolicy(RetryPolicy{MaxElapsedTime: time.Millisecond, RequestTimeout: 10 * time.Millisecond})
+	if err := client.RemoteWrite(context.Background(), req, benchmarkFamilies(1, 1), time.Minute); err == nil {
+		t.Error("expected the request to time out")
+	}
+}
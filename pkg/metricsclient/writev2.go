@@ -0,0 +1,236 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package metricsclient
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// RemoteWriteVersion is a version of the remote write protocol.
+type RemoteWriteVersion string
+
+const (
+	// RemoteWriteV1 sends prometheus.WriteRequest messages.
+	RemoteWriteV1 RemoteWriteVersion = "1.0"
+	// RemoteWriteV2 sends io.prometheus.write.v2.Request messages, which intern the
+	// label names and values and carry the type and help of the metrics.
+	RemoteWriteV2 RemoteWriteVersion = "2.0"
+)
+
+const (
+	versionHeader = "X-Prometheus-Remote-Write-Version"
+	contentTypeV1 = "application/x-protobuf"
+	contentTypeV2 = "application/x-protobuf;proto=io.prometheus.write.v2.Request"
+)
+
+// errUnsupportedVersion is returned when the receiver rejects a remote write 2.0
+// request with 415 Unsupported Media Type.
+var errUnsupportedVersion = errors.New("the receiver does not support remote write 2.0")
+
+// ParseRemoteWriteVersion returns the version, 1.0 if empty.
+func ParseRemoteWriteVersion(s string) (RemoteWriteVersion, error) {
+	switch RemoteWriteVersion(s) {
+	case "", RemoteWriteV1:
+		return RemoteWriteV1, nil
+	case RemoteWriteV2:
+		return RemoteWriteV2, nil
+	default:
+		return "", fmt.Errorf("unsupported remote write version %q, must be %s or %s", s, RemoteWriteV1, RemoteWriteV2)
+	}
+}
+
+// headers returns the content type and the version header of the requests.
+func (v RemoteWriteVersion) headers() (string, string) {
+	if v == RemoteWriteV2 {
+		return contentTypeV2, "2.0.0"
+	}
+	return contentTypeV1, "0.1.0"
+}
+
+// The metric types of io.prometheus.write.v2.Metadata, which are also the ones of
+// the prometheus.MetricMetadata of remote write 1.0.
+const (
+	metadataUnspecified = 0
+	metadataCounter     = 1
+	metadataGauge       = 2
+	metadataHistogram   = 3
+	metadataSummary     = 5
+)
+
+func metadataType(t clientmodel.MetricType) uint64 {
+	switch t {
+	case clientmodel.MetricType_COUNTER:
+		return metadataCounter
+	case clientmodel.MetricType_GAUGE:
+		return metadataGauge
+	case clientmodel.MetricType_HISTOGRAM:
+		return metadataHistogram
+	case clientmodel.MetricType_SUMMARY:
+		return metadataSummary
+	default:
+		return metadataUnspecified
+	}
+}
+
+// encodeWriteRequestsV2 encodes the families as remote write 2.0 requests. The
+// series are split in requests exactly as encodeWriteRequests does, so that the
+// requests can be encoded again with 1.0 if the receiver rejects 2.0.
+func encodeWriteRequestsV2(families []*clientmodel.MetricFamily, now time.Time, policy BatchPolicy) ([][]byte, int, error) {
+	var batches [][]byte
+	total, err := splitSeries(families, now.UnixNano()/int64(time.Millisecond), policy,
+		func(series []prompb.TimeSeries, owners []*clientmodel.MetricFamily) error {
+			data, err := marshalRequestV2(series, owners)
+			if err != nil {
+				return err
+			}
+			batches = append(batches, snappy.Encode(nil, data))
+			return nil
+		})
+	if err != nil {
+		return nil, 0, err
+	}
+	return batches, total, nil
+}
+
+// symbolTable interns the strings of a request. The first symbol is always empty.
+type symbolTable struct {
+	symbols []string
+	refs    map[string]uint64
+}
+
+func newSymbolTable() *symbolTable {
+	return &symbolTable{symbols: []string{""}, refs: map[string]uint64{"": 0}}
+}
+
+func (t *symbolTable) ref(s string) uint64 {
+	if ref, ok := t.refs[s]; ok {
+		return ref
+	}
+	ref := uint64(len(t.symbols))
+	t.symbols = append(t.symbols, s)
+	t.refs[s] = ref
+	return ref
+}
+
+// marshalRequestV2 encodes an io.prometheus.write.v2.Request:
+//
+//	Request    { repeated string symbols = 4; repeated TimeSeries timeseries = 5; }
+//	TimeSeries { repeated uint32 labels_refs = 1; repeated Sample samples = 2; Metadata metadata = 5; }
+//	Sample     { double value = 1; int64 timestamp = 2; }
+//	Metadata   { MetricType type = 1; uint32 help_ref = 3; uint32 unit_ref = 4; }
+//
+// owners[i] is the family of series[i], which the metadata is derived from. The
+// labels are sorted by name, as 2.0 requires. unit_ref is never set, as the
+// families of the text and protobuf formats decoded here have no unit.
+func marshalRequestV2(series []prompb.TimeSeries, owners []*clientmodel.MetricFamily) ([]byte, error) {
+	symbols := newSymbolTable()
+	timeseries := make([][]byte, 0, len(series))
+	var labels []prompb.Label
+	for i, s := range series {
+		var b protoWriter
+		if len(s.Labels) > 0 {
+			labels = append(labels[:0], s.Labels...)
+			sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+			var refs protoWriter
+			for _, l := range labels {
+				refs.raw(symbols.ref(l.Name))
+				refs.raw(symbols.ref(l.Value))
+			}
+			b.bytes(1, refs.Bytes())
+			if refs.err != nil {
+				return nil, refs.err
+			}
+		}
+		for _, sample := range s.Samples {
+			var sb protoWriter
+			if v := math.Float64bits(sample.Value); v != 0 {
+				sb.fixed64(1, v)
+			}
+			if sample.Timestamp != 0 {
+				sb.varint(2, uint64(sample.Timestamp))
+			}
+			if sb.err != nil {
+				return nil, sb.err
+			}
+			b.bytes(2, sb.Bytes())
+		}
+		var mb protoWriter
+		if typ := metadataType(owners[i].GetType()); typ != metadataUnspecified {
+			mb.varint(1, typ)
+		}
+		if help := owners[i].GetHelp(); len(help) > 0 {
+			mb.varint(3, symbols.ref(help))
+		}
+		if mb.err != nil {
+			return nil, mb.err
+		}
+		if len(mb.Bytes()) > 0 {
+			b.bytes(5, mb.Bytes())
+		}
+		if b.err != nil {
+			return nil, b.err
+		}
+		timeseries = append(timeseries, b.Bytes())
+	}
+
+	var req protoWriter
+	for _, s := range symbols.symbols {
+		req.bytes(4, []byte(s))
+	}
+	for _, ts := range timeseries {
+		req.bytes(5, ts)
+	}
+	if req.err != nil {
+		return nil, req.err
+	}
+	return req.Bytes(), nil
+}
+
+// protoWriter encodes the fields of a protobuf message, keeping the first error.
+type protoWriter struct {
+	buf proto.Buffer
+	err error
+}
+
+func (w *protoWriter) Bytes() []byte {
+	return w.buf.Bytes()
+}
+
+// raw encodes a varint without a field key, as in packed repeated fields.
+func (w *protoWriter) raw(v uint64) {
+	if w.err == nil {
+		w.err = w.buf.EncodeVarint(v)
+	}
+}
+
+func (w *protoWriter) key(field, wire uint64) {
+	w.raw(field<<3 | wire)
+}
+
+func (w *protoWriter) varint(field, v uint64) {
+	w.key(field, proto.WireVarint)
+	w.raw(v)
+}
+
+func (w *protoWriter) fixed64(field, v uint64) {
+	w.key(field, proto.WireFixed64)
+	if w.err == nil {
+		w.err = w.buf.EncodeFixed64(v)
+	}
+}
+
+func (w *protoWriter) bytes(field uint64, b []byte) {
+	w.key(field, proto.WireBytes)
+	if w.err == nil {
+		w.err = w.buf.EncodeRawBytes(b)
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright Contributors to the Open Cluster Management project
+package metricsclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// decodedSeriesV2 is a series of a remote write 2.0 request with its symbols resolved.
+type decodedSeriesV2 struct {
+	labels  []prompb.Label
+	samples []prompb.Sample
+	typ     uint64
+	help    string
+}
+
+// decodeRequestV2 decodes the fields of io.prometheus.write.v2.Request set by marshalRequestV2.
+func decodeRequestV2(t *testing.T, data []byte) []decodedSeriesV2 {
+	t.Helper()
+	var symbols []string
+	var raw [][]byte
+	fields(t, data, func(field uint64, value []byte, _ uint64) {
+		switch field {
+		case 4:
+			symbols = append(symbols, string(value))
+		case 5:
+			raw = append(raw, value)
+		default:
+			t.Fatalf("unexpected request field %d", field)
+		}
+	})
+	if len(symbols) == 0 || symbols[0] != "" {
+		t.Fatalf("the first symbol must be empty, got %q", symbols)
+	}
+
+	var series []decodedSeriesV2
+	for _, ts := range raw {
+		var s decodedSeriesV2
+		fields(t, ts, func(field uint64, msg []byte, _ uint64) {
+			switch field {
+			case 1:
+				for len(msg) > 0 {
+					name, n := proto.DecodeVarint(msg)
+					value, m := proto.DecodeVarint(msg[n:])
+					if n == 0 || m == 0 {
+						t.Fatal("malformed labels refs")
+					}
+					s.labels = append(s.labels, prompb.Label{Name: symbols[name], Value: symbols[value]})
+					msg = msg[n+m:]
+				}
+			case 2:
+				var sample prompb.Sample
+				fields(t, msg, func(field uint64, _ []byte, v uint64) {
+					if field == 1 {
+						sample.Value = math.Float64frombits(v)
+					} else {
+						sample.Timestamp = int64(v)
+					}
+				})
+				s.samples = append(s.samples, sample)
+			case 5:
+				fields(t, msg, func(field uint64, _ []byte, v uint64) {
+					switch field {
+					case 1:
+						s.typ = v
+					case 3:
+						s.help = symbols[v]
+					}
+				})
+			default:
+				t.Fatalf("unexpected series field %d", field)
+			}
+		})
+		series = append(series, s)
+	}
+	return series
+}
+
+// fields calls fn with the number and the value of every field of the message:
+// the bytes of length-delimited fields, the integer of the other ones.
+func fields(t *testing.T, data []byte, fn func(field uint64, b []byte, v uint64)) {
+	t.Helper()
+	for len(data) > 0 {
+		key, n := proto.DecodeVarint(data)
+		if n == 0 {
+			t.Fatal("malformed key")
+		}
+		data = data[n:]
+		switch key & 7 {
+		case proto.WireVarint:
+			v, n := proto.DecodeVarint(data)
+			if n == 0 {
+				t.Fatal("malformed varint")
+			}
+			fn(key>>3, nil, v)
+			data = data[n:]
+		case proto.WireFixed64:
+			if len(data) < 8 {
+				t.Fatal("malformed fixed64")
+			}
+			fn(key>>3, nil, binary.LittleEndian.Uint64(data))
+			data = data[8:]
+		case proto.WireBytes:
+			l, n := proto.DecodeVarint(data)
+			if n == 0 || uint64(len(data)-n) < l {
+				t.Fatal("malformed length")
+			}
+			fn(key>>3, data[n:n+int(l)], 0)
+			data = data[n+int(l):]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+	}
+}
+
+func TestEncodeWriteRequestsV2(t *testing.T) {
+	families := benchmarkFamilies(2, 3)
+	families[0].Help = proto.String("The first metric.")
+	families = append(families, &clientmodel.MetricFamily{
+		Name: proto.String("requests_total"),
+		Type: clientmodel.MetricType_COUNTER.Enum(),
+		Metric: []*clientmodel.Metric{{
+			Counter: &clientmodel.Counter{Value: proto.Float64(3)},
+		}},
+	})
+	now := time.Now()
+
+	batches, total, err := encodeWriteRequestsV2(families, now, BatchPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batches) != 1 || total != 7 {
+		t.Fatalf("expected 7 series in 1 request, got %d in %d", total, len(batches))
+	}
+	data, err := snappy.Decode(nil, batches[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := decodeRequestV2(t, data)
+
+	var want []decodedSeriesV2
+	for _, f := range families {
+		for _, ts := range appendFamily(nil, f, now.UnixNano()/int64(time.Millisecond)) {
+			want = append(want, decodedSeriesV2{labels: ts.Labels, samples: ts.Samples, typ: metadataType(f.GetType()), help: f.GetHelp()})
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected\n%+v\ngot\n%+v", want, got)
+	}
+	if got[0].typ != metadataGauge || got[0].help != "The first metric." || got[6].typ != metadataCounter {
+		t.Errorf("unexpected metadata %+v", got)
+	}
+}
+
+// TestMarshalRequestV2Golden checks the encoding against the field numbers and
+// wire types of io.prometheus.write.v2 in prometheus/prompb/io/prometheus/write/v2/types.proto.
+func TestMarshalRequestV2Golden(t *testing.T) {
+	series := []prompb.TimeSeries{{
+		// Unsorted, they must be sorted by name.
+		Labels:  []prompb.Label{{Name: "job", Value: "a"}, {Name: "__name__", Value: "up"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}},
+	}}
+	owners := []*clientmodel.MetricFamily{{
+		Name: proto.String("up"),
+		Help: proto.String("h"),
+		Type: clientmodel.MetricType_GAUGE.Enum(),
+	}}
+	got, err := marshalRequestV2(series, owners)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte{
+		// symbols = 4: "", "__name__", "up", "job", "a", "h"
+		0x22, 0x00,
+		0x22, 0x08, '_', '_', 'n', 'a', 'm', 'e', '_', '_',
+		0x22, 0x02, 'u', 'p',
+		0x22, 0x03, 'j', 'o', 'b',
+		0x22, 0x01, 'a',
+		0x22, 0x01, 'h',
+		// timeseries = 5, 26 bytes
+		0x2a, 0x1a,
+		// labels_refs = 1, packed: __name__=up, job=a
+		0x0a, 0x04, 0x01, 0x02, 0x03, 0x04,
+		// samples = 2: value = 1 (double 1.0), timestamp = 2 (1000)
+		0x12, 0x0c, 0x09, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xf0, 0x3f, 0x10, 0xe8, 0x07,
+		// metadata = 5: type = 1 (GAUGE), help_ref = 3 ("h")
+		0x2a, 0x04, 0x08, 0x02, 0x18, 0x05,
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("expected\n% x\ngot\n% x", want, got)
+	}
+}
+
+func TestRemoteWriteV2Fallback(t *testing.T) {
+	var mu sync.Mutex
+	var contentTypes, versions []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		contentTypes = append(contentTypes, r.Header.Get("Content-Type"))
+		versions = append(versions, r.Header.Get(versionHeader))
+		if r.Header.Get("Content-Type") == contentTypeV2 {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		compressed, _ := ioutil.ReadAll(r.Body)
+		data, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Error(err)
+		}
+		var wreq prompb.WriteRequest
+		if err := proto.Unmarshal(data, &wreq); err != nil || len(wreq.Timeseries) != 2 {
+			t.Errorf("expected a 1.0 request with 2 series, got %d: %v", len(wreq.Timeseries), err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	client := New(log.NewNopLogger(), server.Client(), 0, time.Minute, "test").WithRemoteWriteVersion(RemoteWriteV2)
+	req, _ := http.NewRequest(http.MethodPost, server.URL, nil)
+	for i := 0; i < 2; i++ {
+		if err := client.RemoteWrite(context.Background(), req, benchmarkFamilies(1, 2), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wantTypes := []string{contentTypeV2, contentTypeV1, contentTypeV1}
+	wantVersions := []string{"2.0.0", "0.1.0", "0.1.0"}
+	if !reflect.DeepEqual(contentTypes, wantTypes) || !reflect.DeepEqual(versions, wantVersions) {
+		t.Errorf("expected content types %q and versions %q, got %q and %q", wantTypes, wantVersions, contentTypes, versions)
+	}
+}
@@ -26,7 +26,7 @@ var ErrTooLong = fmt.Errorf("the incoming sample data is too long")
 // LimitReader returns a Reader that reads from r
 // but stops with ErrTooLong after n bytes.
 // The underlying implementation is a *LimitedReader.
-func LimitReader(r io.Reader, n int64) io.Reader { return &LimitedReader{r, n} }
+func LimitReader(r io.Reader, n int64) io.Reader { return &LimitedReader{R: r, N: n} }
 
 // A LimitedReader reads from R but limits the amount of
 // data returned to just N bytes. Each call to Read
@@ -35,9 +35,26 @@ func LimitReader(r io.Reader, n int64) io.Reader { return &LimitedReader{r, n} }
 type LimitedReader struct {
 	R io.Reader // underlying reader
 	N int64     // max bytes remaining
+	// Probe, if set, reads one more byte from R once N bytes were read, and returns
+	// io.EOF instead of ErrTooLong if there is none, so that data of exactly the
+	// limit is not reported as too long. N is negative if there was one.
+	Probe bool
 }
 
 func (l *LimitedReader) Read(p []byte) (n int, err error) {
+	if l.N == 0 && l.Probe {
+		var b [1]byte
+		for {
+			n, err := l.R.Read(b[:])
+			if n > 0 {
+				l.N = -1
+				break
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
 	if l.N <= 0 {
 		return 0, ErrTooLong
 	}
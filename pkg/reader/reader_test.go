@@ -44,3 +44,30 @@ func TestRead(t *testing.T) {
 		})
 	}
 }
+
+func TestReadProbe(t *testing.T) {
+	for input, want := range map[string]error{
+		"Hello":     io.EOF,
+		"Hello wo":  io.EOF,
+		"Hello wor": ErrTooLong,
+	} {
+		r := &LimitedReader{R: strings.NewReader(input), N: 8, Probe: true}
+		b := make([]byte, 16)
+		var read []byte
+		var err error
+		for err == nil {
+			var n int
+			n, err = r.Read(b)
+			read = append(read, b[:n]...)
+		}
+		if err != want {
+			t.Errorf("%q: expected %v, got %v", input, want, err)
+		}
+		if len(read) > 8 {
+			t.Errorf("%q: expected at most 8 bytes, got %q", input, read)
+		}
+		if (r.N < 0) != (want == ErrTooLong) {
+			t.Errorf("%q: unexpected remaining bytes %d", input, r.N)
+		}
+	}
+}
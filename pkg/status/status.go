@@ -6,6 +6,7 @@ import (
 	"context"
 	"errors"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -28,6 +29,20 @@ const (
 type StatusReport struct {
 	statusClient client.Client
 	logger       log.Logger
+	last         *lastCondition
+}
+
+// Condition is the last condition reported, whether or not it could be written to the addon.
+type Condition struct {
+	Type               string    `json:"type"`
+	Reason             string    `json:"reason"`
+	Message            string    `json:"message"`
+	LastTransitionTime time.Time `json:"lastTransitionTime"`
+}
+
+type lastCondition struct {
+	mu        sync.Mutex
+	condition Condition
 }
 
 func New(logger log.Logger) (*StatusReport, error) {
@@ -56,10 +71,24 @@ func New(logger log.Logger) (*StatusReport, error) {
 	return &StatusReport{
 		statusClient: kubeClient,
 		logger:       log.With(logger, "component", "statusclient"),
+		last:         &lastCondition{},
 	}, nil
 }
 
+// Condition returns the last condition reported.
+func (s *StatusReport) Condition() Condition {
+	s.last.mu.Lock()
+	defer s.last.mu.Unlock()
+	return s.last.condition
+}
+
 func (s *StatusReport) UpdateStatus(t string, r string, m string) error {
+	s.last.mu.Lock()
+	if c := s.last.condition; c.Type != t || c.Reason != r || c.Message != m {
+		s.last.condition = Condition{Type: t, Reason: r, Message: m, LastTransitionTime: time.Now()}
+	}
+	s.last.mu.Unlock()
+
 	if s.statusClient == nil {
 		return nil
 	}
@@ -62,4 +62,8 @@ func TestUpdateStatus(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to update status: (%v)", err)
 	}
+
+	if c := s.Condition(); c.Type != "Ready" || c.Message != "Metrics collector deployed and updated" {
+		t.Errorf("unexpected last condition: %+v", c)
+	}
 }
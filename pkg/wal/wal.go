@@ -0,0 +1,280 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/stolostron/metrics-collector/pkg/logger"
+)
+
+const (
+	batchSuffix = ".batch"
+	tmpSuffix   = ".tmp"
+
+	reasonSize     = "size"
+	reasonAge      = "age"
+	reasonCorrupt  = "corrupt"
+	reasonRejected = "rejected"
+)
+
+// ErrRejected is wrapped by the error returned by the function passed to Replay
+// when the receiver rejected a batch, which would fail the same way if replayed.
+var ErrRejected = errors.New("queued batch rejected")
+
+var (
+	gaugeQueueBatches = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "metricscollector_wal_batches",
+		Help: "The number of remote write batches waiting in the write-ahead queue",
+	}, []string{"queue"})
+	gaugeQueueBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "metricscollector_wal_bytes",
+		Help: "The size in bytes of the remote write batches waiting in the write-ahead queue",
+	}, []string{"queue"})
+	counterDroppedBatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "metricscollector_wal_dropped_batches_total",
+		Help: "The number of queued remote write batches dropped without being sent",
+	}, []string{"queue", "reason"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		gaugeQueueBatches, gaugeQueueBytes, counterDroppedBatches,
+	)
+}
+
+// Queue is a durable, size and age bounded FIFO of remote write batches.
+// Each batch is stored as a separate file in the queue directory whose name
+// encodes the time it was queued, so that batches are replayed oldest-first
+// and survive restarts. Queue is safe for concurrent use.
+type Queue struct {
+	name     string
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+	logger   log.Logger
+
+	mu  sync.Mutex
+	seq uint64
+	now func() time.Time
+}
+
+type entry struct {
+	name    string
+	created time.Time
+	size    int64
+}
+
+// New creates a Queue persisting batches in dir. The name identifies the queue in metrics.
+// A maxBytes or maxAge of zero disables the respective limit.
+func New(l log.Logger, name, dir string, maxBytes int64, maxAge time.Duration) (*Queue, error) {
+	if len(dir) == 0 {
+		return nil, fmt.Errorf("a directory for the write-ahead queue is required")
+	}
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("failed to create write-ahead queue directory: %v", err)
+	}
+	q := &Queue{
+		name:     name,
+		dir:      dir,
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+		logger:   log.With(l, "component", "wal", "queue", name),
+		now:      time.Now,
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, err := q.enforce(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Migrate moves the batches queued in the directory from into the directory to,
+// keeping their names so that they are replayed in the same order. Other files
+// and subdirectories of from are left untouched. It returns the number of batches
+// moved.
+func Migrate(from, to string) (int, error) {
+	files, err := ioutil.ReadDir(from)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read write-ahead queue directory: %v", err)
+	}
+	moved := 0
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), batchSuffix) {
+			continue
+		}
+		if moved == 0 {
+			if err := os.MkdirAll(to, 0750); err != nil {
+				return 0, fmt.Errorf("failed to create write-ahead queue directory: %v", err)
+			}
+		}
+		if err := os.Rename(filepath.Join(from, f.Name()), filepath.Join(to, f.Name())); err != nil {
+			return moved, fmt.Errorf("failed to move queued batch: %v", err)
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+// Append persists a batch at the tail of the queue, dropping the oldest batches if
+// the size limit is exceeded.
+func (q *Queue) Append(data []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.seq++
+	name := fmt.Sprintf("%020d-%010d%s", q.now().UnixNano(), q.seq, batchSuffix)
+	tmp := filepath.Join(q.dir, name+tmpSuffix)
+	if err := ioutil.WriteFile(tmp, data, 0640); err != nil {
+		return fmt.Errorf("failed to write queued batch: %v", err)
+	}
+	// Renaming is atomic, so a crash never leaves a partially written batch behind.
+	if err := os.Rename(tmp, filepath.Join(q.dir, name)); err != nil {
+		return fmt.Errorf("failed to commit queued batch: %v", err)
+	}
+
+	_, err := q.enforce()
+	return err
+}
+
+// Replay calls fn for every queued batch, oldest first, removing each batch once fn
+// succeeds. A batch for which fn returns an error wrapping ErrRejected is dropped
+// and counted as rejected. Replay stops at any other error returned by fn and
+// returns it; the failed batch and all younger ones stay queued.
+func (q *Queue) Replay(fn func(data []byte) error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entries, err := q.enforce()
+	if err != nil {
+		return err
+	}
+	for i, e := range entries {
+		data, err := ioutil.ReadFile(filepath.Join(q.dir, e.name))
+		if err != nil {
+			logger.Log(q.logger, logger.Warn, "msg", "dropping unreadable queued batch", "file", e.name, "err", err)
+			q.remove(e, reasonCorrupt)
+			continue
+		}
+		if err := fn(data); errors.Is(err, ErrRejected) {
+			q.remove(e, reasonRejected)
+			continue
+		} else if err != nil {
+			q.observe(entries[i:])
+			return err
+		}
+		q.remove(e, "")
+	}
+	q.observe(nil)
+	return nil
+}
+
+// Len returns the number of queued batches.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	entries, err := q.list()
+	if err != nil {
+		return 0
+	}
+	return len(entries)
+}
+
+// enforce drops batches exceeding the age and size limits and returns the remaining
+// batches, oldest first. It must be called with the lock held.
+func (q *Queue) enforce() ([]entry, error) {
+	entries, err := q.list()
+	if err != nil {
+		return nil, err
+	}
+
+	if q.maxAge > 0 {
+		min := q.now().Add(-q.maxAge)
+		for len(entries) > 0 && entries[0].created.Before(min) {
+			q.remove(entries[0], reasonAge)
+			entries = entries[1:]
+		}
+	}
+
+	if q.maxBytes > 0 {
+		var total int64
+		for _, e := range entries {
+			total += e.size
+		}
+		for len(entries) > 0 && total > q.maxBytes {
+			total -= entries[0].size
+			q.remove(entries[0], reasonSize)
+			entries = entries[1:]
+		}
+	}
+
+	q.observe(entries)
+	return entries, nil
+}
+
+// list returns the queued batches, oldest first. Leftover temporary files
+// from an interrupted Append are removed.
+func (q *Queue) list() ([]entry, error) {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read write-ahead queue directory: %v", err)
+	}
+	var entries []entry
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(f.Name(), tmpSuffix) {
+			_ = os.Remove(filepath.Join(q.dir, f.Name()))
+			continue
+		}
+		if !strings.HasSuffix(f.Name(), batchSuffix) {
+			continue
+		}
+		ns, err := strconv.ParseInt(strings.SplitN(f.Name(), "-", 2)[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, entry{name: f.Name(), created: time.Unix(0, ns), size: f.Size()})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	return entries, nil
+}
+
+// remove deletes a batch. A non-empty reason counts the batch as dropped.
+func (q *Queue) remove(e entry, reason string) {
+	if err := os.Remove(filepath.Join(q.dir, e.name)); err != nil && !os.IsNotExist(err) {
+		logger.Log(q.logger, logger.Warn, "msg", "failed to remove queued batch", "file", e.name, "err", err)
+	}
+	if len(reason) > 0 {
+		counterDroppedBatches.WithLabelValues(q.name, reason).Inc()
+		logger.Log(q.logger, logger.Warn, "msg", "dropped queued batch", "file", e.name, "reason", reason)
+	}
+}
+
+// observe updates the queue depth and size metrics.
+func (q *Queue) observe(entries []entry) {
+	var total int64
+	for _, e := range entries {
+		total += e.size
+	}
+	gaugeQueueBatches.WithLabelValues(q.name).Set(float64(len(entries)))
+	gaugeQueueBytes.WithLabelValues(q.name).Set(float64(total))
+}
@@ -0,0 +1,202 @@
+// Copyright Contributors to the Open Cluster Management project
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func newTestQueue(t *testing.T, maxBytes int64, maxAge time.Duration) (*Queue, func()) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	q, err := New(log.NewNopLogger(), "test", dir, maxBytes, maxAge)
+	if err != nil {
+		t.Fatalf("failed to create queue: %v", err)
+	}
+	return q, func() { os.RemoveAll(dir) }
+}
+
+func replayAll(t *testing.T, q *Queue) []string {
+	var got []string
+	if err := q.Replay(func(data []byte) error {
+		got = append(got, string(data))
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected replay error: %v", err)
+	}
+	return got
+}
+
+func TestQueueReplayOrder(t *testing.T) {
+	q, cleanup := newTestQueue(t, 0, 0)
+	defer cleanup()
+
+	for _, b := range []string{"a", "b", "c"} {
+		if err := q.Append([]byte(b)); err != nil {
+			t.Fatalf("failed to append: %v", err)
+		}
+	}
+
+	// A failing replay keeps the failed batch and the younger ones queued.
+	var sent []string
+	err := q.Replay(func(data []byte) error {
+		if string(data) == "b" {
+			return errors.New("unavailable")
+		}
+		sent = append(sent, string(data))
+		return nil
+	})
+	if err == nil {
+		t.Fatal("expected replay to fail")
+	}
+	if want := []string{"a"}; !reflect.DeepEqual(sent, want) {
+		t.Errorf("got %v, want %v", sent, want)
+	}
+	if q.Len() != 2 {
+		t.Errorf("got %d queued batches, want 2", q.Len())
+	}
+
+	if got, want := replayAll(t, q), []string{"b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if q.Len() != 0 {
+		t.Errorf("got %d queued batches, want 0", q.Len())
+	}
+}
+
+func TestQueueReplayRejected(t *testing.T) {
+	q, cleanup := newTestQueue(t, 0, 0)
+	defer cleanup()
+
+	for _, b := range []string{"a", "b", "c"} {
+		if err := q.Append([]byte(b)); err != nil {
+			t.Fatalf("failed to append: %v", err)
+		}
+	}
+	dropped := func() float64 {
+		m := &clientmodel.Metric{}
+		if err := counterDroppedBatches.WithLabelValues("test", reasonRejected).Write(m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetCounter().GetValue()
+	}
+	before := dropped()
+
+	// A rejected batch is dropped and counted, the next ones are still replayed.
+	var sent []string
+	err := q.Replay(func(data []byte) error {
+		if string(data) == "b" {
+			return fmt.Errorf("%w: bad request", ErrRejected)
+		}
+		sent = append(sent, string(data))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected replay error: %v", err)
+	}
+	if want := []string{"a", "c"}; !reflect.DeepEqual(sent, want) {
+		t.Errorf("got %v, want %v", sent, want)
+	}
+	if q.Len() != 0 {
+		t.Errorf("got %d queued batches, want 0", q.Len())
+	}
+	if got := dropped() - before; got != 1 {
+		t.Errorf("expected 1 rejected batch to be counted, got %v", got)
+	}
+}
+
+func TestQueueMaxBytes(t *testing.T) {
+	q, cleanup := newTestQueue(t, 4, 0)
+	defer cleanup()
+
+	for _, b := range []string{"aa", "bb", "cc"} {
+		if err := q.Append([]byte(b)); err != nil {
+			t.Fatalf("failed to append: %v", err)
+		}
+	}
+	if got, want := replayAll(t, q), []string{"bb", "cc"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestQueueMaxAge(t *testing.T) {
+	q, cleanup := newTestQueue(t, 0, time.Hour)
+	defer cleanup()
+
+	now := time.Now()
+	q.now = func() time.Time { return now.Add(-2 * time.Hour) }
+	if err := q.Append([]byte("old")); err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+	q.now = func() time.Time { return now }
+	if err := q.Append([]byte("new")); err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+	if got, want := replayAll(t, q), []string{"new"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestQueueSurvivesRestart(t *testing.T) {
+	q, cleanup := newTestQueue(t, 0, 0)
+	defer cleanup()
+
+	if err := q.Append([]byte("a")); err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+	reopened, err := New(log.NewNopLogger(), "test", q.dir, 0, 0)
+	if err != nil {
+		t.Fatalf("failed to reopen queue: %v", err)
+	}
+	if got, want := replayAll(t, reopened), []string{"a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	q, cleanup := newTestQueue(t, 0, 0)
+	defer cleanup()
+	for _, b := range []string{"a", "b"} {
+		if err := q.Append([]byte(b)); err != nil {
+			t.Fatalf("failed to append: %v", err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(q.dir, "other"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	// The batches queued at the root of the directory move into a subdirectory.
+	dir := filepath.Join(q.dir, "to")
+	moved, err := Migrate(q.dir, dir)
+	if err != nil || moved != 2 {
+		t.Fatalf("expected 2 batches moved, got %d: %v", moved, err)
+	}
+	if q.Len() != 0 {
+		t.Errorf("expected no batch left at the root, got %d", q.Len())
+	}
+	migrated, err := New(log.NewNopLogger(), "to", dir, 0, 0)
+	if err != nil {
+		t.Fatalf("failed to create queue: %v", err)
+	}
+	if got, want := replayAll(t, migrated), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	if _, err := os.Stat(filepath.Join(q.dir, "other")); err != nil {
+		t.Errorf("expected the other directories to be left untouched: %v", err)
+	}
+
+	if moved, err := Migrate(filepath.Join(q.dir, "missing"), dir); err != nil || moved != 0 {
+		t.Errorf("expected nothing to migrate from a missing directory, got %d: %v", moved, err)
+	}
+}